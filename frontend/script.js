@@ -90,6 +90,30 @@ function showNoResults(term) {
   container.appendChild(div);
 }
 
+/* ── Display title ─────────────────────────────────────── */
+/* Prefer ComicInfo.xml series info over the filename-derived title */
+function displayTitle(mag) {
+  if (!mag.series) return mag.title;
+  return mag.issueNumber ? mag.series + " #" + mag.issueNumber : mag.series;
+}
+
+/* ── Continue badge ──────────────────────────────────────── */
+/* Shown once a reader has turned past the first page */
+function continueBadge(mag) {
+  if (!(mag.lastPage > 0)) return "";
+  const label = mag.totalPages
+    ? "Page " + (mag.lastPage + 1) + " / " + mag.totalPages
+    : "Page " + (mag.lastPage + 1);
+  return `<span class="continue-badge">${label}</span>`;
+}
+
+/* ── Status badge ────────────────────────────────────────── */
+/* Flags archives the scanner couldn't read */
+function statusBadge(mag) {
+  if (!mag.status || mag.status === "ok") return "";
+  return ` <span class="status-badge">${escapeHtml(mag.status)}</span>`;
+}
+
 /* ── Card builder ────────────────────────────────────────── */
 function createCard(mag) {
   const FALLBACK_SVG = `data:image/svg+xml,${encodeURIComponent(
@@ -104,26 +128,29 @@ function createCard(mag) {
   article.className = "mag-item";
   article.setAttribute("tabindex", "0");
   article.setAttribute("role", "listitem");
+  article.dataset.id = mag.id;
+  const title = displayTitle(mag);
   article.setAttribute(
     "aria-label",
-    mag.title + (mag.category ? ", " + mag.category : ""),
+    title + (mag.category ? ", " + mag.category : ""),
   );
 
-  const src = mag.coverData || FALLBACK_SVG;
+  const src = mag.coverUrl || mag.coverData || FALLBACK_SVG;
 
   article.innerHTML = `
     <div class="cover-wrap" id="cover-${mag.id}">
       <img
         src="${src}"
-        alt="${escapeHtml(mag.title)}"
+        alt="${escapeHtml(title)}"
         loading="lazy"
         decoding="async"
       />
-      <span class="read-btn" aria-hidden="true">Read</span>
+      <span class="read-btn" aria-hidden="true">${mag.lastPage > 0 ? "Continue" : "Read"}</span>
+      ${continueBadge(mag)}
     </div>
     <div class="info">
-      <h3>${escapeHtml(mag.title)}</h3>
-      <p class="cat">${escapeHtml(mag.category || "")}</p>
+      <h3 title="${escapeHtml(mag.title)}">${escapeHtml(title)}</h3>
+      <p class="cat">${escapeHtml(mag.category || "")}${statusBadge(mag)}</p>
     </div>
   `;
 
@@ -202,25 +229,44 @@ async function loadLibrary() {
 }
 
 /* ── Search / filter ─────────────────────────────────────── */
-function filterLibrary(term) {
+/* Matching runs on the server so series and writer are searched too */
+let searchSeq = 0;
+
+async function filterLibrary(term) {
   const container = document.getElementById("library");
-  const items = container.querySelectorAll(".mag-item");
-  const q = term.trim().toLowerCase();
+  const q = term.trim();
+  const seq = ++searchSeq;
+
+  let ids = null;
+  if (q) {
+    try {
+      const res = await fetch(
+        "/api/search?limit=500&q=" + encodeURIComponent(q),
+      );
+      if (!res.ok) throw new Error("Server responded " + res.status);
+      ids = new Set((await res.json()).map((mag) => mag.id));
+    } catch (err) {
+      console.error("Search failed:", err);
+      return;
+    }
+  }
+
+  /* A newer search started while this one was in flight */
+  if (seq !== searchSeq) return;
 
   /* Remove previous no-results message */
   const prev = container.querySelector(".no-results-state");
   if (prev) prev.remove();
 
-  if (!q) {
+  const items = container.querySelectorAll(".mag-item");
+  if (!ids) {
     items.forEach((el) => (el.style.display = ""));
     return;
   }
 
   let visible = 0;
   items.forEach((el) => {
-    const title = el.querySelector("h3")?.textContent.toLowerCase() || "";
-    const cat = el.querySelector(".cat")?.textContent.toLowerCase() || "";
-    const match = title.includes(q) || cat.includes(q);
+    const match = ids.has(Number(el.dataset.id));
     el.style.display = match ? "" : "none";
     if (match) visible++;
   });
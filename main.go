@@ -1,37 +1,73 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"database/sql"
 	"embed" // for embedding frontend
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
 	"image"
+	"image/color"
 	_ "image/gif"
 	"image/jpeg"
+	"image/png"
 	"io"
 	"io/fs"
-	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"archive/tar"
 	"archive/zip"
 
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/time/rate"
 	_ "modernc.org/sqlite"
 
+	"github.com/bodgit/sevenzip"
+	"github.com/fsnotify/fsnotify"
+	_ "github.com/gen2brain/avif"
+	"github.com/gen2brain/webp"
 	"github.com/nwaples/rardecode"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 //go:embed frontend/*
@@ -40,57 +76,558 @@ var frontendContent embed.FS
 // Config represents application configuration
 type Config struct {
 	Port                int      `json:"Port"`
+	BindAddress         string   `json:"BindAddress"`
 	AutoRefreshInterval int      `json:"AutoRefreshInterval"`
 	LibraryPaths        []string `json:"LibraryPaths"`
 	CacheDB             string   `json:"CacheDB"`
 	MaxThumbnailSize    int      `json:"MaxThumbnailSize"`
+	ThumbnailFormat     string   `json:"ThumbnailFormat"`
+	ThumbnailQuality    int      `json:"ThumbnailQuality"`
+	ThumbnailScaleMode  string   `json:"ThumbnailScaleMode"`
+	ThumbnailBackground string   `json:"ThumbnailBackground"`
 	LogLevel            string   `json:"LogLevel"`
+	LogFormat           string   `json:"LogFormat"`
+	WatchEnabled        bool     `json:"WatchEnabled"`
+	ThumbnailDir        string   `json:"ThumbnailDir"`
+	ScanWorkers         int      `json:"ScanWorkers"`
+	CategoryDepth       int      `json:"CategoryDepth"`
+
+	// Suffixes of cover images placed next to an archive or folder that replace its own cover
+	CoverSidecarExtensions []string `json:"CoverSidecarExtensions"`
+
+	// How the cover page is picked: "smart" skips logo and blank pages, "first" takes the first page
+	CoverSelection string `json:"CoverSelection"`
+
+	// Thumbnails decoded at once for image folders and older entries; each holds a full page in memory
+	ThumbnailConcurrency int `json:"ThumbnailConcurrency"`
+
+	// Memory for archive pages read ahead of the reader and rendered PDF pages
+	PageCacheMaxMB int `json:"PageCacheMaxMB"`
+
+	// Read the pages following the one being read ahead into the page cache; on when unset
+	Prefetch *bool `json:"Prefetch"`
+
+	// Seconds a /media response may take to send, in place of the server's 30 second write timeout
+	MediaWriteTimeout int `json:"MediaWriteTimeout"`
+
+	// Requests per second each client IP may make to /media, 0 for no limit, and the burst allowed above it
+	RateLimitRPS   float64 `json:"RateLimitRPS"`
+	RateLimitBurst int     `json:"RateLimitBurst"`
+
+	// Keep items deleted through the API out of later scans, instead of only until the next one
+	ExcludeOnDelete bool `json:"ExcludeOnDelete"`
+
+	// Re-encode WebP/AVIF pages to JPEG for browsers that can't show them
+	TranscodeUnsupported bool `json:"TranscodeUnsupported"`
+
+	// Passwords of encrypted CBR/CB7 archives, keyed by path glob pattern
+	ArchivePasswords map[string]string `json:"ArchivePasswords"`
+
+	// Program rasterizing PDF pages: "auto" looks for pdftoppm and mutool, "off" uses
+	// each page's embedded scan image; otherwise the name or path of either program
+	PDFRenderer string `json:"PDFRenderer"`
+
+	// Resolution PDF pages are rasterized at, in dots per inch
+	PDFRenderDPI int `json:"PDFRenderDPI"`
+
+	Auth AuthConfig `json:"Auth"`
+
+	// Bearer token for the /api/admin endpoints, which are disabled while it is empty
+	AdminToken string `json:"AdminToken"`
+
+	// Certificate and key files; Magz serves HTTPS instead of HTTP when both are set
+	TLSCert string `json:"TLSCert"`
+	TLSKey  string `json:"TLSKey"`
+
+	// Oldest TLS version accepted, "1.2" or "1.3"
+	TLSMinVersion string `json:"TLSMinVersion"`
+
+	// Port of a plain HTTP listener redirecting to HTTPS, 0 for none
+	HTTPSRedirectPort int `json:"HTTPSRedirectPort"`
+
+	// Origins allowed to call the API from other sites, or "*" for any
+	CORSAllowedOrigins []string `json:"CORSAllowedOrigins"`
+}
+
+// AuthConfig enables HTTP Basic Authentication for every endpoint but /api/health
+type AuthConfig struct {
+	Enabled bool              `json:"Enabled"`
+	Users   map[string]string `json:"Users"` // username -> bcrypt hash, see "magz passwd"
 }
 
 // LibraryItem represents a magazine/book entry
 type LibraryItem struct {
-	ID        int      `json:"id"`
-	Category  string   `json:"category"`
-	Title     string   `json:"title"`
-	Path      string   `json:"path"`
-	Cover     string   `json:"cover"`
-	CoverData string   `json:"coverData"`
-	LastMod   string   `json:"lastModified"`
-	Pages     []string `json:"pages,omitempty"`
+	ID          int      `json:"id"`
+	Category    string   `json:"category"`
+	Subcategory string   `json:"subcategory"` // innermost folder of Category
+	Title       string   `json:"title"`
+	Path        string   `json:"path"`
+	Cover       string   `json:"cover"`
+	CoverPage   string   `json:"coverPage"` // page set as cover through PUT /api/item/cover or POST /api/cover
+	CoverData   string   `json:"coverData,omitempty"`
+	CoverURL    string   `json:"coverUrl"`
+	LastMod     string   `json:"lastModified"`
+	Added       string   `json:"added"`   // when a scan or import first listed the item, in UTC
+	Updated     string   `json:"updated"` // when its entry last changed, in UTC
+	Pages       []string `json:"pages,omitempty"`
+
+	// ComicInfo.xml metadata, empty when the archive has none
+	Series      string `json:"series"`
+	IssueNumber string `json:"issueNumber"`
+	Year        int    `json:"year"`
+	Writer      string `json:"writer"`
+	Publisher   string `json:"publisher"`
+	Summary     string `json:"summary"`
+	PageCount   int    `json:"pageCount"`
+	SizeBytes   int64  `json:"sizeBytes"` // archive size, or the sum of a directory's pages
+	Status      string `json:"status"`    // ok, corrupt or unreadable
+
+	// How the viewer lays out pages, from ComicInfo.xml or PUT /api/item/meta
+	ReadingDirection string `json:"readingDirection"` // ltr or rtl
+	DoublePage       bool   `json:"doublePage"`
+
+	// Reading progress, zero-based index of the last page read
+	LastPage   int `json:"lastPage"`
+	TotalPages int `json:"totalPages"`
+
+	// Reading statistics
+	PageViews    int `json:"pageViews"`
+	TotalSeconds int `json:"totalSeconds"`
+
+	Favorite bool `json:"favorite"` // starred through /api/favorite
+
+	seriesKey string // groups the item in /api/series, empty when it belongs to no series
+}
+
+// Progress represents the reading position for a library item
+type Progress struct {
+	ID         int    `json:"id"`
+	Page       int    `json:"page"`
+	TotalPages int    `json:"totalPages"`
+	UpdatedAt  string `json:"updatedAt,omitempty"`
+}
+
+// ItemMeta is the body of PUT /api/item/meta; omitted fields are left unchanged
+type ItemMeta struct {
+	ReadingDirection *string `json:"readingDirection"`
+	DoublePage       *bool   `json:"doublePage"`
+}
+
+// ItemPatch is the body of PATCH /api/item; fields left out keep their value
+type ItemPatch struct {
+	Title    *string `json:"title"`
+	Category *string `json:"category"`
+}
+
+// VacuumResult is the response of /api/admin/vacuum
+type VacuumResult struct {
+	Integrity  []string `json:"integrity"` // ["ok"], or the problems PRAGMA integrity_check found
+	Vacuumed   bool     `json:"vacuumed"`  // false when the integrity check failed
+	BytesFreed int64    `json:"bytesFreed"`
+}
+
+// CatalogEntry is one library row in /api/export and /api/import
+type CatalogEntry struct {
+	Path             string `json:"path"`
+	Category         string `json:"category"`
+	Title            string `json:"title"`
+	Cover            string `json:"cover"`
+	LastMod          string `json:"lastModified"`
+	Series           string `json:"series"`
+	IssueNumber      string `json:"issueNumber"`
+	Year             int    `json:"year"`
+	Writer           string `json:"writer"`
+	Publisher        string `json:"publisher"`
+	Summary          string `json:"summary"`
+	PageCount        int    `json:"pageCount"`
+	SizeBytes        int64  `json:"sizeBytes"`
+	Status           string `json:"status"`
+	ReadingDirection string `json:"readingDirection"`
+	DoublePage       bool   `json:"doublePage"`
+	UserEdited       bool   `json:"userEdited"`          // title and category were renamed, see PATCH /api/item
+	CoverPage        string `json:"coverPage"`           // set through PUT /api/item/cover or POST /api/cover
+	Added            string `json:"added,omitempty"`     // kept by imports, so items don't all turn up as new
+	CoverData        string `json:"coverData,omitempty"` // only with ?covers=1
+}
+
+// ImportResult is the response of /api/import
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"` // outside the library paths, or excluded
 }
 
+// StatsEvent reports one page view and the seconds spent on the previous page
+type StatsEvent struct {
+	ID      int `json:"id"`
+	Seconds int `json:"seconds"`
+}
+
+// ReadingStats is the response of /api/stats
+type ReadingStats struct {
+	MostViewed []LibraryItem `json:"mostViewed"`
+	MostRead   []LibraryItem `json:"mostRead"`
+	Library    LibraryStats  `json:"library"`
+}
+
+// LibraryStats aggregates the library table for /api/stats and /api/stats/library
+type LibraryStats struct {
+	TotalItems        int            `json:"totalItems"`
+	TotalPages        int            `json:"totalPages"`
+	TotalSizeBytes    int64          `json:"totalSizeBytes"` // size on disk, see librarySize
+	TotalCategories   int            `json:"totalCategories"`
+	ItemsWithCover    int            `json:"itemsWithCover"` // items with a cover page, see hasCoverExpr
+	ItemsWithoutCover int            `json:"itemsWithoutCover"`
+	Categories        map[string]int `json:"categories"`
+	Formats           map[string]int `json:"formats"`
+
+	// Both nil until the first full scan completes
+	LastScanFinishedAt *time.Time `json:"lastScanFinishedAt"`
+	LastScanDurationMs *int64     `json:"lastScanDurationMs"`
+}
+
+// ScanTiming records when the last full scan finished and how long it took
+type ScanTiming struct {
+	FinishedAt time.Time
+	Duration   time.Duration
+}
+
+// Category summarizes the library items sharing a category
+type Category struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Cover string `json:"cover"`
+}
+
+// Series is a shelf of /api/series: the items of one series, in issue order
+type Series struct {
+	Name   string        `json:"name"`
+	Count  int           `json:"count"`
+	Issues []LibraryItem `json:"issues"`
+}
+
+// ComicInfo represents the fields Magz reads from a ComicInfo.xml file
+type ComicInfo struct {
+	Series    string `xml:"Series"`
+	Number    string `xml:"Number"`
+	Year      int    `xml:"Year"`
+	Writer    string `xml:"Writer"`
+	Publisher string `xml:"Publisher"`
+	Summary   string `xml:"Summary"`
+	PageCount int    `xml:"PageCount"`
+
+	// Reading hints, see readingDirection and doublePage
+	Manga            string `xml:"Manga"`
+	Format           string `xml:"Format"`
+	ReadingDirection string `xml:"ReadingDirection"`
+}
+
+// readingDirection returns "rtl" or "ltr" as declared by ReadingDirection or
+// Manga, "" if the file declares neither
+func (c *ComicInfo) readingDirection() string {
+	switch strings.ToLower(strings.TrimSpace(c.ReadingDirection)) {
+	case "rtl", "righttoleft", "right-to-left":
+		return "rtl"
+	case "ltr", "lefttoright", "left-to-right":
+		return "ltr"
+	}
+	if strings.EqualFold(strings.TrimSpace(c.Manga), "YesAndRightToLeft") {
+		return "rtl"
+	}
+	return ""
+}
+
+// doublePage reports whether Format marks the book as double-page spreads, e.g. "Double-Page"
+func (c *ComicInfo) doublePage() bool {
+	return strings.Contains(strings.ToLower(c.Format), "double")
+}
+
+// logLevels orders the log levels from most to least verbose
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
 // Logger provides structured logging
 type Logger struct {
-	level string
+	state  *loggerState
+	fields []string // key/value pairs added by With
+}
+
+// loggerState is shared by a logger and the children created with With
+type loggerState struct {
+	level  atomic.Value // string, swapped on config reload
+	format atomic.Value // "text" or "json"
+	mu     sync.Mutex   // serializes writes to out
+	out    io.Writer
+}
+
+// logEntry is one line of JSON log output
+type logEntry struct {
+	Level  string            `json:"level"`
+	TS     string            `json:"ts"`
+	Msg    string            `json:"msg"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// NewLogger creates a logger writing to stderr
+func NewLogger(level, format string) *Logger {
+	l := &Logger{state: &loggerState{out: os.Stderr}}
+	l.SetLevel(level)
+	l.SetFormat(format)
+	return l
+}
+
+// SetLevel changes the minimum level the logger prints
+func (l *Logger) SetLevel(level string) {
+	l.state.level.Store(level)
+}
+
+// SetFormat switches between "text" and "json" output
+func (l *Logger) SetFormat(format string) {
+	l.state.format.Store(format)
+}
+
+// With returns a child logger that adds key=val to every line
+func (l *Logger) With(key, val string) *Logger {
+	fields := make([]string, 0, len(l.fields)+2)
+	fields = append(fields, l.fields...)
+	return &Logger{state: l.state, fields: append(fields, key, val)}
+}
+
+// WithContext returns a child logger that adds the request ID of ctx to every line,
+// or l itself when ctx carries none
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return l.With("request_id", id)
+	}
+	return l
+}
+
+func (l *Logger) Debug(msg string, args ...interface{}) {
+	l.log("debug", msg, args)
 }
 
 func (l *Logger) Info(msg string, args ...interface{}) {
-	log.Printf("[INFO] "+msg, args...)
+	l.log("info", msg, args)
+}
+
+func (l *Logger) Warn(msg string, args ...interface{}) {
+	l.log("warn", msg, args)
 }
 
 func (l *Logger) Error(msg string, args ...interface{}) {
-	log.Printf("[ERROR] "+msg, args...)
+	l.log("error", msg, args)
 }
 
-func (l *Logger) Debug(msg string, args ...interface{}) {
-	if l.level == "debug" {
-		log.Printf("[DEBUG] "+msg, args...)
+// log formats and writes a line if level is enabled
+func (l *Logger) log(level, msg string, args []interface{}) {
+	minLevel, _ := l.state.level.Load().(string)
+	if logLevels[level] < logLevels[minLevel] {
+		return
+	}
+
+	now := time.Now()
+	msg = fmt.Sprintf(msg, args...)
+
+	var line []byte
+	if l.state.format.Load() == "json" {
+		entry := logEntry{Level: level, TS: now.Format(time.RFC3339Nano), Msg: msg}
+		if len(l.fields) > 0 {
+			entry.Fields = make(map[string]string, len(l.fields)/2)
+			for i := 0; i+1 < len(l.fields); i += 2 {
+				entry.Fields[l.fields[i]] = l.fields[i+1]
+			}
+		}
+		line, _ = json.Marshal(entry)
+	} else {
+		var b strings.Builder
+		b.WriteString(now.Format("2006/01/02 15:04:05 [") + strings.ToUpper(level) + "] " + msg)
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			val := l.fields[i+1]
+			if strings.ContainsAny(val, " \t\"=") {
+				val = strconv.Quote(val)
+			}
+			b.WriteString(" " + l.fields[i] + "=" + val)
+		}
+		line = []byte(b.String())
 	}
+
+	l.state.mu.Lock()
+	defer l.state.mu.Unlock()
+	l.state.out.Write(append(line, '\n'))
 }
 
+// defaultConfigPath is read when -config isn't given; it may be missing if
+// MAGZ_ environment variables provide the configuration
+const defaultConfigPath = "magz.config.json"
+
+// configPath is the configuration file read at startup and on SIGHUP, set with -config
+var configPath = defaultConfigPath
+
 var (
-	config Config
-	db     *sql.DB
-	logger *Logger
+	configManager *ConfigManager
+	db            *sql.DB
+	logger        *Logger
 	// Rate limiter for thumbnail generation
 	thumbSemaphore chan struct{}
+	// Serializes library scans started by the ticker and the file watcher
+	scanMu sync.Mutex
+	// Set while a scan started by /api/refresh or /api/rescan runs, so requests don't pile up
+	refreshMu  sync.Mutex
+	refreshing bool
+	// Cancelled on shutdown; scans started by /api/refresh run on it rather than on the request
+	serverCtx = context.Background()
+	// Set when a full scan completes, for /api/stats
+	lastScan atomic.Pointer[ScanTiming]
 )
 
+// ConfigManager holds the active configuration and swaps it on reload
+type ConfigManager struct {
+	mu  sync.RWMutex
+	cfg Config
+}
+
+// NewConfigManager creates a manager for an already validated configuration
+func NewConfigManager(cfg Config) *ConfigManager {
+	return &ConfigManager{cfg: cfg}
+}
+
+// Get returns the current configuration.
+// Reload never modifies a Config in place, so callers may keep the copy.
+func (m *ConfigManager) Get() Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cfg
+}
+
+// Reload reads and validates the configuration file and swaps it in.
+// Settings used only at startup keep their current values until a restart.
+func (m *ConfigManager) Reload(path string) error {
+	cfg, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := m.cfg
+	if cfg.Port != old.Port || cfg.BindAddress != old.BindAddress || cfg.CacheDB != old.CacheDB || cfg.ThumbnailDir != old.ThumbnailDir || cfg.WatchEnabled != old.WatchEnabled ||
+		cfg.ThumbnailConcurrency != old.ThumbnailConcurrency || cfg.PageCacheMaxMB != old.PageCacheMaxMB ||
+		cfg.TLSCert != old.TLSCert || cfg.TLSKey != old.TLSKey || cfg.TLSMinVersion != old.TLSMinVersion || cfg.HTTPSRedirectPort != old.HTTPSRedirectPort {
+		logger.Warn("Port, BindAddress, CacheDB, ThumbnailDir, WatchEnabled, ThumbnailConcurrency, PageCacheMaxMB, TLSCert, TLSKey, TLSMinVersion and HTTPSRedirectPort changes apply after a restart")
+		cfg.Port = old.Port
+		cfg.BindAddress = old.BindAddress
+		cfg.CacheDB = old.CacheDB
+		cfg.ThumbnailDir = old.ThumbnailDir
+		cfg.WatchEnabled = old.WatchEnabled
+		cfg.ThumbnailConcurrency = old.ThumbnailConcurrency
+		cfg.PageCacheMaxMB = old.PageCacheMaxMB
+		cfg.TLSCert = old.TLSCert
+		cfg.TLSKey = old.TLSKey
+		cfg.TLSMinVersion = old.TLSMinVersion
+		cfg.HTTPSRedirectPort = old.HTTPSRedirectPort
+	}
+	m.cfg = *cfg
+	return nil
+}
+
+// prefetchEnabled reports whether pages are read ahead of the reader
+func (c *Config) prefetchEnabled() bool {
+	return c.Prefetch == nil || *c.Prefetch
+}
+
+// isValidHostname reports whether name is a DNS host name such as "localhost" or "nas.lan"
+func isValidHostname(name string) bool {
+	if len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// displayAddr is the address to open the server at, localhost when it listens on every interface
+func displayAddr(cfg *Config) string {
+	host := cfg.BindAddress
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(cfg.Port))
+}
+
+// serverURL is the address Magz is reached at, for the startup log
+func serverURL(cfg *Config) string {
+	if cfg.TLSCert != "" {
+		return "https://" + displayAddr(cfg)
+	}
+	return "http://" + displayAddr(cfg)
+}
+
+// httpsRedirect sends requests to the same host and path on the HTTPS port
+func httpsRedirect(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// tlsVersions maps the values of TLSMinVersion to their protocol version
+var tlsVersions = map[string]uint16{"1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
 // validateConfig checks if the configuration is valid
 func validateConfig(cfg *Config) error {
+	if cfg.Port == 0 {
+		cfg.Port = 8082
+	}
 	if cfg.Port < 1 || cfg.Port > 65535 {
 		return fmt.Errorf("invalid port number: %d", cfg.Port)
 	}
+	if cfg.BindAddress == "" {
+		cfg.BindAddress = "0.0.0.0"
+	}
+	if net.ParseIP(cfg.BindAddress) == nil && !isValidHostname(cfg.BindAddress) {
+		return fmt.Errorf("invalid bind address: %s", cfg.BindAddress)
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return fmt.Errorf("TLSCert and TLSKey must be set together")
+	}
+	for _, file := range []string{cfg.TLSCert, cfg.TLSKey} {
+		if _, err := os.Stat(file); file != "" && err != nil {
+			return fmt.Errorf("invalid TLS file: %w", err)
+		}
+	}
+	if cfg.TLSMinVersion == "" {
+		cfg.TLSMinVersion = "1.2"
+	}
+	if _, ok := tlsVersions[cfg.TLSMinVersion]; !ok {
+		return fmt.Errorf("invalid TLS min version: %s", cfg.TLSMinVersion)
+	}
+	if cfg.HTTPSRedirectPort != 0 {
+		if cfg.TLSCert == "" {
+			return fmt.Errorf("HTTPSRedirectPort needs TLSCert and TLSKey")
+		}
+		if cfg.HTTPSRedirectPort < 1 || cfg.HTTPSRedirectPort > 65535 || cfg.HTTPSRedirectPort == cfg.Port {
+			return fmt.Errorf("invalid HTTPS redirect port: %d", cfg.HTTPSRedirectPort)
+		}
+	}
+	if cfg.AutoRefreshInterval == 0 {
+		cfg.AutoRefreshInterval = 10
+	}
 	if cfg.AutoRefreshInterval < 1 {
 		return fmt.Errorf("invalid refresh interval: %d", cfg.AutoRefreshInterval)
 	}
@@ -108,24 +645,155 @@ func validateConfig(cfg *Config) error {
 	if cfg.MaxThumbnailSize == 0 {
 		cfg.MaxThumbnailSize = 400
 	}
+	if cfg.ThumbnailDir == "" {
+		cfg.ThumbnailDir = "magz_thumbs"
+	}
+	if cfg.ThumbnailFormat == "" {
+		cfg.ThumbnailFormat = "jpeg"
+	}
+	if _, ok := thumbnailFormats[cfg.ThumbnailFormat]; !ok {
+		return fmt.Errorf("invalid thumbnail format: %s", cfg.ThumbnailFormat)
+	}
+	if cfg.ThumbnailQuality == 0 {
+		cfg.ThumbnailQuality = 85
+	}
+	if cfg.ThumbnailQuality < 1 || cfg.ThumbnailQuality > 100 {
+		return fmt.Errorf("invalid thumbnail quality: %d", cfg.ThumbnailQuality)
+	}
+	if cfg.ThumbnailScaleMode == "" {
+		cfg.ThumbnailScaleMode = "fit"
+	}
+	if cfg.ThumbnailScaleMode != "fit" && cfg.ThumbnailScaleMode != "fill" && cfg.ThumbnailScaleMode != "pad" {
+		return fmt.Errorf("invalid thumbnail scale mode: %s", cfg.ThumbnailScaleMode)
+	}
+	if cfg.CoverSelection == "" {
+		cfg.CoverSelection = "smart"
+	}
+	if cfg.CoverSelection != "smart" && cfg.CoverSelection != "first" {
+		return fmt.Errorf("invalid cover selection: %s", cfg.CoverSelection)
+	}
+	if cfg.ThumbnailBackground == "" {
+		cfg.ThumbnailBackground = "#000000"
+	}
+	if _, err := parseHexColor(cfg.ThumbnailBackground); err != nil {
+		return fmt.Errorf("invalid thumbnail background: %w", err)
+	}
+	if cfg.ScanWorkers == 0 {
+		cfg.ScanWorkers = 4
+	}
+	if cfg.ScanWorkers < 1 || cfg.ScanWorkers > maxScanWorkers {
+		return fmt.Errorf("invalid scan workers: %d (1-%d)", cfg.ScanWorkers, maxScanWorkers)
+	}
+	if cfg.ThumbnailConcurrency == 0 {
+		cfg.ThumbnailConcurrency = 4
+	}
+	if cfg.ThumbnailConcurrency < 1 || cfg.ThumbnailConcurrency > maxScanWorkers {
+		return fmt.Errorf("invalid thumbnail concurrency: %d (1-%d)", cfg.ThumbnailConcurrency, maxScanWorkers)
+	}
+	if cfg.PageCacheMaxMB == 0 {
+		cfg.PageCacheMaxMB = 64
+	}
+	if cfg.PageCacheMaxMB < 1 || cfg.PageCacheMaxMB > 4096 {
+		return fmt.Errorf("invalid page cache size: %d MB (1-4096)", cfg.PageCacheMaxMB)
+	}
+	if cfg.MediaWriteTimeout == 0 {
+		cfg.MediaWriteTimeout = 120
+	}
+	if cfg.MediaWriteTimeout < 10 {
+		return fmt.Errorf("invalid media write timeout: %d s (at least 10)", cfg.MediaWriteTimeout)
+	}
+	if cfg.RateLimitRPS < 0 {
+		return fmt.Errorf("invalid rate limit: %g requests/s", cfg.RateLimitRPS)
+	}
+	if cfg.RateLimitBurst == 0 {
+		cfg.RateLimitBurst = 20
+	}
+	if cfg.RateLimitBurst < 1 {
+		return fmt.Errorf("invalid rate limit burst: %d", cfg.RateLimitBurst)
+	}
+	if cfg.CategoryDepth == 0 {
+		cfg.CategoryDepth = 1
+	}
+	if cfg.CategoryDepth < 1 || cfg.CategoryDepth > 5 {
+		return fmt.Errorf("invalid category depth: %d (1-5)", cfg.CategoryDepth)
+	}
+	if cfg.CoverSidecarExtensions == nil {
+		cfg.CoverSidecarExtensions = []string{".cover.jpg", ".cover.png"}
+	}
+	for _, ext := range cfg.CoverSidecarExtensions {
+		if !strings.HasPrefix(ext, ".") || !isImageFile(strings.ToLower(ext)) {
+			return fmt.Errorf("invalid cover sidecar extension: %s", ext)
+		}
+	}
 	if cfg.LogLevel == "" {
 		cfg.LogLevel = "info"
 	}
+	if _, ok := logLevels[cfg.LogLevel]; !ok {
+		return fmt.Errorf("invalid log level: %s", cfg.LogLevel)
+	}
+	for pattern := range cfg.ArchivePasswords {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid archive password pattern %q: %w", pattern, err)
+		}
+	}
+	if cfg.Auth.Enabled && len(cfg.Auth.Users) == 0 {
+		return fmt.Errorf("auth enabled without users")
+	}
+	for user, hash := range cfg.Auth.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("invalid password hash for user %q: %w", user, err)
+		}
+	}
+	for _, origin := range cfg.CORSAllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" {
+			return fmt.Errorf("invalid CORS origin: %s", origin)
+		}
+	}
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = "text"
+	}
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		return fmt.Errorf("invalid log format: %s", cfg.LogFormat)
+	}
+	if cfg.PDFRenderer == "" {
+		cfg.PDFRenderer = "auto"
+	}
+	if cfg.PDFRenderer != "auto" && cfg.PDFRenderer != "off" {
+		if !slices.Contains(pdfRendererPrograms, pdfRendererProgram(cfg.PDFRenderer)) {
+			return fmt.Errorf("invalid PDF renderer: %s (pdftoppm or mutool)", cfg.PDFRenderer)
+		}
+		if _, err := exec.LookPath(cfg.PDFRenderer); err != nil {
+			return fmt.Errorf("invalid PDF renderer: %w", err)
+		}
+	}
+	if cfg.PDFRenderDPI == 0 {
+		cfg.PDFRenderDPI = 150
+	}
+	if cfg.PDFRenderDPI < 36 || cfg.PDFRenderDPI > 600 {
+		return fmt.Errorf("invalid PDF render DPI: %d (36-600)", cfg.PDFRenderDPI)
+	}
 	return nil
 }
 
 // loadConfig reads and validates configuration
 func loadConfig(path string) (*Config, error) {
+	var cfg Config
 	data, err := os.ReadFile(path)
-	if err != nil {
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config: %w", err)
+		}
+	case !(os.IsNotExist(err) && path == defaultConfigPath):
 		return nil, fmt.Errorf("failed to read config: %w", err)
 	}
 
-	var cfg Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse config: %w", err)
+	if err := applyEnvOverrides(&cfg); err != nil {
+		return nil, err
 	}
-
 	if err := validateConfig(&cfg); err != nil {
 		return nil, err
 	}
@@ -133,9 +801,47 @@ func loadConfig(path string) (*Config, error) {
 	return &cfg, nil
 }
 
+// applyEnvOverrides replaces config file values with the MAGZ_ environment
+// variables that are set. MAGZ_LIBRARY_PATHS is a list like PATH.
+func applyEnvOverrides(cfg *Config) error {
+	texts := map[string]*string{
+		"MAGZ_BIND_ADDRESS":  &cfg.BindAddress,
+		"MAGZ_CACHE_DB":      &cfg.CacheDB,
+		"MAGZ_THUMBNAIL_DIR": &cfg.ThumbnailDir,
+		"MAGZ_LOG_LEVEL":     &cfg.LogLevel,
+		"MAGZ_LOG_FORMAT":    &cfg.LogFormat,
+		"MAGZ_ADMIN_TOKEN":   &cfg.AdminToken,
+	}
+	for name, field := range texts {
+		if v, ok := os.LookupEnv(name); ok {
+			*field = v
+		}
+	}
+
+	numbers := map[string]*int{
+		"MAGZ_PORT":                  &cfg.Port,
+		"MAGZ_AUTO_REFRESH_INTERVAL": &cfg.AutoRefreshInterval,
+	}
+	for name, field := range numbers {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", name, v)
+			}
+			*field = n
+		}
+	}
+
+	if v, ok := os.LookupEnv("MAGZ_LIBRARY_PATHS"); ok {
+		cfg.LibraryPaths = filepath.SplitList(v)
+	}
+	return nil
+}
+
 // initDatabase sets up the database schema
 func initDatabase(dbPath string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite", dbPath)
+	// Requests writing while a scan commits a batch wait for it instead of failing
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -145,88 +851,338 @@ func initDatabase(dbPath string) (*sql.DB, error) {
 	db.SetMaxIdleConns(5)
 	db.SetConnMaxLifetime(5 * time.Minute)
 
-	schema := `
-		CREATE TABLE IF NOT EXISTS library (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			category TEXT,
-			title TEXT,
-			path TEXT UNIQUE,
-			cover TEXT,
-			coverData TEXT,
-			lastModified TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		);
-		CREATE INDEX IF NOT EXISTS idx_category ON library(category);
-		CREATE INDEX IF NOT EXISTS idx_title ON library(title);
-	`
+	if err := MigrateDB(db, migrations); err != nil {
+		return nil, fmt.Errorf("failed to migrate schema: %w", err)
+	}
 
-	if _, err := db.Exec(schema); err != nil {
-		return nil, fmt.Errorf("failed to create schema: %w", err)
+	if err := initSearchIndex(db); err != nil {
+		return nil, fmt.Errorf("failed to create search index: %w", err)
+	}
+
+	if err := fillSeriesKeys(db); err != nil {
+		return nil, fmt.Errorf("failed to fill series keys: %w", err)
 	}
 
 	return db, nil
 }
 
-// isPathAllowed checks if the path is within allowed library paths
-func isPathAllowed(path string) bool {
-	cleanPath := filepath.Clean(path)
-	for _, base := range config.LibraryPaths {
-		cleanBase := filepath.Clean(base)
-		if strings.HasPrefix(cleanPath, cleanBase) {
-			return true
+// initSearchIndex creates the FTS5 index over library and the triggers keeping it in sync
+func initSearchIndex(db *sql.DB) error {
+	var ddl string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE name='library_fts'").Scan(&ddl)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	exists := err == nil
+
+	// FTS5 tables can't gain columns, so indexes from before series was searchable are rebuilt
+	if exists && !strings.Contains(ddl, "series") {
+		_, err := db.Exec(`
+			DROP TRIGGER IF EXISTS library_fts_insert;
+			DROP TRIGGER IF EXISTS library_fts_delete;
+			DROP TRIGGER IF EXISTS library_fts_update;
+			DROP TABLE library_fts;
+		`)
+		if err != nil {
+			return err
 		}
+		exists = false
 	}
-	return false
+
+	schema := `
+		CREATE VIRTUAL TABLE IF NOT EXISTS library_fts USING fts5(
+			title, category, series, writer, summary,
+			content='library', content_rowid='id'
+		);
+		CREATE TRIGGER IF NOT EXISTS library_fts_insert AFTER INSERT ON library BEGIN
+			INSERT INTO library_fts(rowid, title, category, series, writer, summary)
+			VALUES (new.id, new.title, new.category, new.series, new.writer, new.summary);
+		END;
+		CREATE TRIGGER IF NOT EXISTS library_fts_delete AFTER DELETE ON library BEGIN
+			INSERT INTO library_fts(library_fts, rowid, title, category, series, writer, summary)
+			VALUES ('delete', old.id, old.title, old.category, old.series, old.writer, old.summary);
+		END;
+		CREATE TRIGGER IF NOT EXISTS library_fts_update AFTER UPDATE ON library BEGIN
+			INSERT INTO library_fts(library_fts, rowid, title, category, series, writer, summary)
+			VALUES ('delete', old.id, old.title, old.category, old.series, old.writer, old.summary);
+			INSERT INTO library_fts(rowid, title, category, series, writer, summary)
+			VALUES (new.id, new.title, new.category, new.series, new.writer, new.summary);
+		END;
+	`
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+
+	// Index rows that existed before the index did
+	if !exists {
+		if _, err := db.Exec("INSERT INTO library_fts(library_fts) VALUES('rebuild')"); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// getImagesFromCBR extracts image list from CBR archive
-func getImagesFromCBR(cbrPath string) ([]string, error) {
-	f, err := os.Open(cbrPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open CBR: %w", err)
+// migrations brings the schema to version N when entry N-1 is applied.
+// Never change an applied migration; append a new one instead.
+var migrations = []string{
+	// 1: initial schema
+	`CREATE TABLE IF NOT EXISTS library (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		category TEXT,
+		title TEXT,
+		path TEXT UNIQUE,
+		cover TEXT,
+		coverData TEXT,
+		lastModified TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_category ON library(category);
+	CREATE INDEX IF NOT EXISTS idx_title ON library(title);
+	CREATE TABLE IF NOT EXISTS progress (
+		item_id INTEGER NOT NULL UNIQUE,
+		page_index INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	// 2: ComicInfo.xml metadata, filled in by a full rescan
+	`ALTER TABLE library ADD COLUMN series TEXT DEFAULT '';
+	ALTER TABLE library ADD COLUMN issue_number TEXT DEFAULT '';
+	ALTER TABLE library ADD COLUMN year INTEGER DEFAULT 0;
+	ALTER TABLE library ADD COLUMN writer TEXT DEFAULT '';
+	ALTER TABLE library ADD COLUMN summary TEXT DEFAULT '';
+	UPDATE library SET lastModified=''`,
+
+	// 3: ComicInfo.xml publisher
+	`ALTER TABLE library ADD COLUMN publisher TEXT DEFAULT '';
+	UPDATE library SET lastModified=''`,
+
+	// 4: on-disk thumbnails, migrated lazily by ensureThumbnail
+	`ALTER TABLE library ADD COLUMN thumbnail TEXT DEFAULT ''`,
+
+	// 5: reading statistics
+	`CREATE TABLE IF NOT EXISTS stats (
+		item_id INTEGER NOT NULL UNIQUE,
+		page_views INTEGER NOT NULL DEFAULT 0,
+		total_seconds INTEGER NOT NULL DEFAULT 0,
+		last_read DATETIME
+	)`,
+
+	// 6: page count seen by the viewer, for the "continue" badge
+	`ALTER TABLE progress ADD COLUMN total_pages INTEGER NOT NULL DEFAULT 0`,
+
+	// 7: page counts for OPDS page streaming, filled in by a full rescan
+	`ALTER TABLE library ADD COLUMN page_count INTEGER DEFAULT 0;
+	UPDATE library SET lastModified=''`,
+
+	// 8: page lists of archives, so /api/pages doesn't reopen them
+	`CREATE TABLE IF NOT EXISTS pages (
+		item_id INTEGER PRIMARY KEY,
+		pages_json TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	// 9: archive health, filled in by a full rescan
+	`ALTER TABLE library ADD COLUMN status TEXT DEFAULT 'ok';
+	CREATE INDEX IF NOT EXISTS idx_status ON library(status);
+	UPDATE library SET lastModified=''`,
+	// 10: modification time of the archive a cached page list was read from
+	`ALTER TABLE pages ADD COLUMN mod_time TEXT DEFAULT ''`,
+	// 11: thumbnails used to scale the smaller side to MaxThumbnailSize, regenerate them
+	`UPDATE library SET thumbnail=''`,
+	// 12: paths removed through DELETE /api/item that scans skip
+	`CREATE TABLE IF NOT EXISTS excluded (
+		path TEXT PRIMARY KEY,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// 13: bytes on disk for /api/stats, filled in by a full rescan
+	`ALTER TABLE library ADD COLUMN file_size INTEGER DEFAULT 0;
+	UPDATE library SET lastModified=''`,
+	// 14: reading direction and double-page spreads, filled in from ComicInfo.xml by a full rescan
+	`ALTER TABLE library ADD COLUMN reading_direction TEXT DEFAULT 'ltr';
+	ALTER TABLE library ADD COLUMN double_page INTEGER DEFAULT 0;
+	UPDATE library SET lastModified=''`,
+	// 15: items starred through /api/favorite
+	`CREATE TABLE IF NOT EXISTS favorites (
+		item_id INTEGER PRIMARY KEY,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`,
+	// 16: titles and categories renamed through PATCH /api/item, which scans keep
+	`ALTER TABLE library ADD COLUMN user_edited INTEGER DEFAULT 0`,
+	// 17: series keys /api/series groups by; NULL until fillSeriesKeys computes them
+	`ALTER TABLE library ADD COLUMN series_key TEXT;
+	CREATE INDEX IF NOT EXISTS idx_series_key ON library(series_key)`,
+	// 18: newest items first for /api/recent
+	`CREATE INDEX IF NOT EXISTS idx_created_at ON library(created_at)`,
+	// 19: cover pages chosen through PUT /api/item/cover or POST /api/cover; thumbnails are regenerated with the new cover selection
+	`ALTER TABLE library ADD COLUMN cover_page TEXT DEFAULT '';
+	UPDATE library SET thumbnail=''`,
+	// 20: page sizes for /api/pages?metadata=1, dropped with the page list they belong to
+	`ALTER TABLE pages ADD COLUMN sizes_json TEXT DEFAULT ''`,
+}
+
+// MigrateDB applies the migrations newer than the version recorded in schema_version.
+// Databases from before versioning start at version 0; the columns they already
+// have are skipped, and they get one full rescan.
+func MigrateDB(db *sql.DB, migrations []string) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+		return err
 	}
-	defer f.Close()
 
-	rr, err := rardecode.NewReader(f, "")
-	if err != nil {
-		return nil, fmt.Errorf("failed to create RAR reader: %w", err)
+	var version int
+	if err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return err
 	}
 
-	var pages []string
-	for {
-		h, err := rr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("error reading RAR entry: %w", err)
-		}
-		name := strings.ToLower(h.Name)
-		if isImageFile(name) && !strings.HasPrefix(filepath.Base(name), ".") {
-			pages = append(pages, h.Name)
+	for v := version + 1; v <= len(migrations); v++ {
+		if err := applyMigration(db, v, migrations[v-1]); err != nil {
+			return fmt.Errorf("migration %d: %w", v, err)
 		}
+		logger.Debug("Applied schema migration %d", v)
 	}
-
-	sort.Slice(pages, func(i, j int) bool { return naturalLess(pages[i], pages[j]) })
-	return pages, nil
+	return nil
 }
 
-// readImageFromCBR reads a specific image from CBR archive
-func readImageFromCBR(cbrPath, imgName string) (image.Image, error) {
-	f, err := os.Open(cbrPath)
+// applyMigration runs one migration and records its version in a single transaction
+func applyMigration(db *sql.DB, version int, migration string) error {
+	tx, err := db.Begin()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer f.Close()
+	defer tx.Rollback()
 
-	rr, err := rardecode.NewReader(f, "")
-	if err != nil {
-		return nil, err
+	for _, stmt := range strings.Split(migration, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		// SQLite has no ADD COLUMN IF NOT EXISTS
+		if _, err := tx.Exec(stmt); err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+			return err
+		}
 	}
 
-	for {
-		h, err := rr.Next()
+	if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version) VALUES (?)", version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// isPathAllowed checks if the path is within allowed library paths
+func isPathAllowed(path string) bool {
+	_, ok := libraryRoot(path)
+	return ok
+}
+
+// libraryRoot returns the library path containing path, the innermost one if they nest
+func libraryRoot(path string) (string, bool) {
+	cleanPath := filepath.Clean(path)
+	root := ""
+	for _, base := range configManager.Get().LibraryPaths {
+		base = filepath.Clean(base)
+		// Rel stays boundary-aware, so /library doesn't also allow /library2
+		rel, err := filepath.Rel(base, cleanPath)
+		if err != nil {
+			continue
+		}
+		if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && len(base) > len(root) {
+			root = base
+		}
+	}
+	return root, root != ""
+}
+
+// errArchiveLocked is reported for archives that can't be decrypted
+var errArchiveLocked = errors.New("archive is encrypted and its password is missing or wrong")
+
+// isPasswordError reports whether err comes from decrypting an archive
+func isPasswordError(err error) bool {
+	var readErr *sevenzip.ReadError
+	if errors.As(err, &readErr) && readErr.Encrypted {
+		return true
+	}
+	// rardecode doesn't export its errors
+	msg := err.Error()
+	return strings.Contains(msg, "incorrect password") || strings.Contains(msg, "encryption data") ||
+		strings.Contains(msg, "no password set")
+}
+
+// archiveError answers a failed archive read with 403 when the archive needs
+// a password, so it isn't mistaken for a server fault
+func archiveError(w http.ResponseWriter, msg string, err error) {
+	if isPasswordError(err) {
+		http.Error(w, errArchiveLocked.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+// resolvePassword returns the password of the first ArchivePasswords pattern matching path.
+// Patterns are tried in sorted order so overlapping ones resolve the same way every time.
+func resolvePassword(path string) string {
+	passwords := configManager.Get().ArchivePasswords
+	patterns := make([]string, 0, len(passwords))
+	for pattern := range passwords {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return passwords[pattern]
+		}
+	}
+	return ""
+}
+
+// getImagesFromCBR extracts image list from CBR archive
+func getImagesFromCBR(cbrPath string) ([]string, error) {
+	f, err := os.Open(cbrPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CBR: %w", err)
+	}
+	defer f.Close()
+
+	rr, err := rardecode.NewReader(f, resolvePassword(cbrPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create RAR reader: %w", err)
+	}
+
+	var pages []string
+	for {
+		h, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading RAR entry: %w", err)
+		}
+		if isPageEntry(h.Name) {
+			pages = append(pages, h.Name)
+		}
+	}
+
+	sort.Slice(pages, func(i, j int) bool { return naturalLess(pages[i], pages[j]) })
+	return pages, nil
+}
+
+// readPageFromCBR reads a specific image from CBR archive
+func readPageFromCBR(cbrPath, imgName string) ([]byte, error) {
+	f, err := os.Open(cbrPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rr, err := rardecode.NewReader(f, resolvePassword(cbrPath))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		h, err := rr.Next()
 		if err == io.EOF {
 			break
 		}
@@ -234,11 +1190,7 @@ func readImageFromCBR(cbrPath, imgName string) (image.Image, error) {
 			return nil, err
 		}
 		if h.Name == imgName {
-			img, _, err := image.Decode(rr)
-			if err != nil {
-				return nil, fmt.Errorf("failed to decode image: %w", err)
-			}
-			return img, nil
+			return io.ReadAll(rr)
 		}
 	}
 
@@ -255,8 +1207,11 @@ func getImagesFromCBZ(cbzPath string) ([]string, error) {
 
 	var pages []string
 	for _, f := range r.File {
-		name := strings.ToLower(f.Name)
-		if isImageFile(name) && !strings.HasPrefix(filepath.Base(name), ".") {
+		if !isSafeEntryName(f.Name) {
+			logger.Warn("Skipping unsafe entry %q in %s", f.Name, cbzPath)
+			continue
+		}
+		if isPageEntry(f.Name) {
 			pages = append(pages, f.Name)
 		}
 	}
@@ -265,8 +1220,8 @@ func getImagesFromCBZ(cbzPath string) ([]string, error) {
 	return pages, nil
 }
 
-// readImageFromCBZ reads a specific image from CBZ archive
-func readImageFromCBZ(cbzPath, imgName string) (image.Image, error) {
+// readPageFromCBZ reads a specific image from CBZ archive
+func readPageFromCBZ(cbzPath, imgName string) ([]byte, error) {
 	r, err := zip.OpenReader(cbzPath)
 	if err != nil {
 		return nil, err
@@ -275,693 +1230,6822 @@ func readImageFromCBZ(cbzPath, imgName string) (image.Image, error) {
 
 	for _, f := range r.File {
 		if f.Name == imgName {
-			rc, err := f.Open()
-			if err != nil {
-				return nil, err
-			}
-			defer rc.Close()
-			img, _, err := image.Decode(rc)
-			if err != nil {
-				return nil, fmt.Errorf("failed to decode image: %w", err)
-			}
-			return img, nil
+			return readZipEntry(f)
 		}
 	}
 	return nil, fmt.Errorf("image not found: %s", imgName)
 }
 
-// isImageFile checks if the file is a supported image
-func isImageFile(name string) bool {
-	return strings.HasSuffix(name, ".jpg") ||
-		strings.HasSuffix(name, ".jpeg") ||
-		strings.HasSuffix(name, ".png") ||
-		strings.HasSuffix(name, ".webp") ||
-		strings.HasSuffix(name, ".avif") ||
-		strings.HasSuffix(name, ".gif")
-}
+// getImagesFromCB7 extracts image list from CB7 archive
+func getImagesFromCB7(cb7Path string) (pages []string, err error) {
+	defer recoverCB7(&err)
 
-// generateThumbnailBase64 creates a thumbnail from file path
-func generateThumbnailBase64(path string) (string, error) {
-	f, err := os.Open(path)
+	r, err := sevenzip.OpenReaderWithPassword(cb7Path, resolvePassword(cb7Path))
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("failed to open CB7: %w", err)
 	}
-	defer f.Close()
+	defer r.Close()
 
-	src, _, err := image.Decode(f)
-	if err != nil {
-		return "", err
+	return listCB7Pages(&r.Reader), nil
+}
+
+// listCB7Pages returns the sorted image entries of an open CB7 archive
+func listCB7Pages(r *sevenzip.Reader) []string {
+	var pages []string
+	for _, f := range r.File {
+		if isPageEntry(f.Name) {
+			pages = append(pages, f.Name)
+		}
 	}
 
-	return imageToThumbnailBase64(src, config.MaxThumbnailSize)
+	sort.Slice(pages, func(i, j int) bool { return naturalLess(pages[i], pages[j]) })
+	return pages
 }
 
-// imageToThumbnailBase64 converts image to base64 thumbnail
-func imageToThumbnailBase64(src image.Image, maxDim int) (string, error) {
-	b := src.Bounds()
-	w := b.Dx()
-	h := b.Dy()
+// readPageFromCB7 reads a specific image from CB7 archive
+func readPageFromCB7(cb7Path, imgName string) (data []byte, err error) {
+	defer recoverCB7(&err)
 
-	if w == 0 || h == 0 {
-		return "", fmt.Errorf("invalid image dimensions")
+	r, err := sevenzip.OpenReaderWithPassword(cb7Path, resolvePassword(cb7Path))
+	if err != nil {
+		return nil, err
 	}
+	defer r.Close()
 
-	var targetW, targetH int
-	if w >= h {
-		targetH = maxDim
-		targetW = int(float64(w) * (float64(maxDim) / float64(h)))
-	} else {
-		targetW = maxDim
-		targetH = int(float64(h) * (float64(maxDim) / float64(w)))
+	for _, f := range r.File {
+		if f.Name == imgName {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return io.ReadAll(rc)
+		}
 	}
+	return nil, fmt.Errorf("image not found: %s", imgName)
+}
 
-	dst := image.NewRGBA(image.Rect(0, 0, targetW, targetH))
-	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
-
-	var buf bytes.Buffer
-	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
-		return "", err
+// recoverCB7 turns a panic from a corrupt CB7 archive into an error
+func recoverCB7(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("corrupt CB7 archive: %v", r)
 	}
+}
 
-	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+// cb7Archive is a CB7 archive kept open between page requests.
+// 7z archives are usually solid, so reading page N+1 right after page N
+// continues the same decompression stream instead of restarting it.
+type cb7Archive struct {
+	mu      sync.Mutex // serialises reads so the solid stream advances in order
+	r       *sevenzip.ReadCloser
+	modTime time.Time
+	lastUse time.Time
 }
 
-// naturalLess compares strings with natural number ordering
-func naturalLess(a, b string) bool {
-	ai, bi := 0, 0
-	for ai < len(a) && bi < len(b) {
-		if isDigit(a[ai]) && isDigit(b[bi]) {
-			startA, startB := ai, bi
-			for ai < len(a) && isDigit(a[ai]) {
-				ai++
-			}
-			for bi < len(b) && isDigit(b[bi]) {
-				bi++
-			}
-			na, _ := strconv.Atoi(a[startA:ai])
-			nb, _ := strconv.Atoi(b[startB:bi])
-			if na != nb {
-				return na < nb
-			}
-		} else {
-			if a[ai] != b[bi] {
-				return a[ai] < b[bi]
-			}
-			ai++
-			bi++
-		}
+const (
+	maxOpenCB7Archives = 8
+	cb7ArchiveIdle     = 2 * time.Minute
+)
+
+var (
+	cb7ArchivesMu sync.Mutex
+	cb7Archives   = make(map[string]*cb7Archive)
+)
+
+// openCB7Archive returns a cached open archive, reopening it when the file changed.
+// The returned archive is locked; callers must unlock a.mu when done.
+func openCB7Archive(cb7Path string) (a *cb7Archive, err error) {
+	defer recoverCB7(&err)
+
+	info, err := os.Stat(cb7Path)
+	if err != nil {
+		return nil, err
 	}
-	return len(a) < len(b)
-}
 
-func isDigit(b byte) bool { return b >= '0' && b <= '9' }
+	cb7ArchivesMu.Lock()
+	defer cb7ArchivesMu.Unlock()
 
-// selectCoverImage finds the best cover image from page list
-func selectCoverImage(pages []string) string {
-	// Look for files with "cover" in the name
-	for _, p := range pages {
-		lower := strings.ToLower(filepath.Base(p))
-		if strings.Contains(lower, "cover") {
-			return p
-		}
+	if a, ok := cb7Archives[cb7Path]; ok && a.modTime.Equal(info.ModTime()) {
+		a.lastUse = time.Now()
+		a.mu.Lock()
+		return a, nil
 	}
-	// Look for files starting with "00" or "01"
-	for _, p := range pages {
-		base := filepath.Base(p)
-		if strings.HasPrefix(base, "00") || strings.HasPrefix(base, "01") {
-			return p
+	closeCB7Archive(cb7Path)
+
+	// Close idle archives and make room for the new one
+	var oldest string
+	for p, a := range cb7Archives {
+		if time.Since(a.lastUse) > cb7ArchiveIdle {
+			closeCB7Archive(p)
+		} else if oldest == "" || a.lastUse.Before(cb7Archives[oldest].lastUse) {
+			oldest = p
 		}
 	}
-	// Return first page
-	if len(pages) > 0 {
-		return pages[0]
+	if len(cb7Archives) >= maxOpenCB7Archives && oldest != "" {
+		closeCB7Archive(oldest)
 	}
-	return ""
-}
 
-// processCBZ handles CBZ file scanning
-func processCBZ(path string, existing map[string]string, seen map[string]bool, newCount, updatedCount int) (int, int) {
-	info, err := os.Stat(path)
+	r, err := sevenzip.OpenReaderWithPassword(cb7Path, resolvePassword(cb7Path))
 	if err != nil {
-		logger.Error("Failed to stat CBZ: %v", err)
-		return newCount, updatedCount
+		return nil, fmt.Errorf("failed to open CB7: %w", err)
 	}
 
-	lastMod := info.ModTime().Format(time.RFC3339)
-	prevMod, exists := existing[path]
-	seen[path] = true
+	a = &cb7Archive{r: r, modTime: info.ModTime(), lastUse: time.Now()}
+	a.mu.Lock()
+	cb7Archives[cb7Path] = a
+	return a, nil
+}
 
-	category := filepath.Base(filepath.Dir(path))
-	title := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+// closeCB7Archive closes and forgets a cached archive once no request is using it.
+// cb7ArchivesMu must be held.
+func closeCB7Archive(cb7Path string) {
+	a, ok := cb7Archives[cb7Path]
+	if !ok {
+		return
+	}
+	delete(cb7Archives, cb7Path)
+	go func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.r.Close()
+	}()
+}
 
-	var coverData string
-	if !exists || prevMod != lastMod {
-		pages, err := getImagesFromCBZ(path)
+// cbtEntry locates an entry's data inside a CBT archive
+type cbtEntry struct {
+	offset int64
+	size   int64
+}
+
+// cbtIndex is the entry table of a CBT archive.
+// Tar has no central directory, so it is built once per file and cached.
+// Gzip-compressed archives can't seek, so only their page names are indexed.
+type cbtIndex struct {
+	modTime time.Time
+	gzipped bool
+	pages   []string
+	entries map[string]cbtEntry
+}
+
+// readCloser pairs a reader with the file that backs it
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// isGzip sniffs the gzip magic number at the start of a stream
+func isGzip(br *bufio.Reader) bool {
+	magic, err := br.Peek(2)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+const maxCBTIndexes = 64
+
+var (
+	cbtIndexMu sync.Mutex
+	cbtIndexes = make(map[string]*cbtIndex)
+)
+
+// newCBTReader reads the tar stream of a CBT, decompressing it if it is gzipped.
+// Plain archives are read straight from f, so f's offset tracks the entries.
+func newCBTReader(f *os.File) (*tar.Reader, bool, error) {
+	br := bufio.NewReader(f)
+	if isGzip(br) {
+		zr, err := gzip.NewReader(br)
 		if err != nil {
-			logger.Error("Failed to read CBZ pages: %v", err)
-		} else if len(pages) > 0 {
-			cover := selectCoverImage(pages)
-			img, err := readImageFromCBZ(path, cover)
-			if err == nil {
-				coverData, _ = imageToThumbnailBase64(img, config.MaxThumbnailSize)
-			}
+			return nil, false, err
 		}
+		return tar.NewReader(zr), true, nil
 	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+	return tar.NewReader(f), false, nil
+}
 
-	if exists {
-		if prevMod != lastMod {
-			_, err := db.Exec(`UPDATE library SET category=?, title=?, cover=?, coverData=?, lastModified=?, updated_at=CURRENT_TIMESTAMP WHERE path=?`,
-				category, title, "(cbz internal)", coverData, lastMod, path)
-			if err != nil {
-				logger.Error("Failed to update CBZ entry: %v", err)
-			} else {
-				updatedCount++
-			}
-		}
-	} else {
-		_, err := db.Exec(`INSERT INTO library (category, title, path, cover, coverData, lastModified)
-			VALUES (?, ?, ?, ?, ?, ?)`,
-			category, title, path, "(cbz internal)", coverData, lastMod)
-		if err != nil {
-			logger.Error("Failed to insert CBZ entry: %v", err)
-		} else {
-			newCount++
-		}
+// indexCBT returns the cached entry table of a CBT archive, rebuilding it when the file changed
+func indexCBT(cbtPath string) (*cbtIndex, error) {
+	info, err := os.Stat(cbtPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CBT: %w", err)
 	}
 
-	return newCount, updatedCount
-}
+	cbtIndexMu.Lock()
+	idx, ok := cbtIndexes[cbtPath]
+	cbtIndexMu.Unlock()
+	if ok && idx.modTime.Equal(info.ModTime()) {
+		return idx, nil
+	}
 
-// processCBR handles CBR file scanning
-func processCBR(path string, existing map[string]string, seen map[string]bool, newCount, updatedCount int) (int, int) {
-	info, err := os.Stat(path)
+	f, err := os.Open(cbtPath)
 	if err != nil {
-		logger.Error("Failed to stat CBR: %v", err)
-		return newCount, updatedCount
+		return nil, fmt.Errorf("failed to open CBT: %w", err)
 	}
+	defer f.Close()
 
-	lastMod := info.ModTime().Format(time.RFC3339)
-	prevMod, exists := existing[path]
-	seen[path] = true
+	idx = &cbtIndex{modTime: info.ModTime(), entries: make(map[string]cbtEntry)}
 
-	category := filepath.Base(filepath.Dir(path))
-	title := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	tr, gzipped, err := newCBTReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open CBT: %w", err)
+	}
+	idx.gzipped = gzipped
 
-	var coverData string
-	if !exists || prevMod != lastMod {
-		pages, err := getImagesFromCBR(path)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			logger.Error("Failed to read CBR pages: %v", err)
-		} else if len(pages) > 0 {
-			cover := selectCoverImage(pages)
-			img, err := readImageFromCBR(path, cover)
-			if err == nil {
-				coverData, _ = imageToThumbnailBase64(img, config.MaxThumbnailSize)
+			return nil, fmt.Errorf("error reading CBT entry: %w", err)
+		}
+		if h.Typeflag != tar.TypeReg {
+			continue
+		}
+		entry := cbtEntry{offset: -1, size: h.Size}
+		if !idx.gzipped {
+			// tar.Reader leaves the file positioned at the start of the entry data
+			if entry.offset, err = f.Seek(0, io.SeekCurrent); err != nil {
+				return nil, fmt.Errorf("error reading CBT entry: %w", err)
 			}
 		}
+		idx.entries[h.Name] = entry
+		if isPageEntry(h.Name) {
+			idx.pages = append(idx.pages, h.Name)
+		}
 	}
 
-	if exists {
-		if prevMod != lastMod {
-			_, err := db.Exec(`UPDATE library SET category=?, title=?, cover=?, coverData=?, lastModified=?, updated_at=CURRENT_TIMESTAMP WHERE path=?`,
-				category, title, "(cbr internal)", coverData, lastMod, path)
-			if err != nil {
-				logger.Error("Failed to update CBR entry: %v", err)
-			} else {
-				updatedCount++
-			}
-		}
-	} else {
-		_, err := db.Exec(`INSERT INTO library (category, title, path, cover, coverData, lastModified)
-			VALUES (?, ?, ?, ?, ?, ?)`,
-			category, title, path, "(cbr internal)", coverData, lastMod)
-		if err != nil {
-			logger.Error("Failed to insert CBR entry: %v", err)
-		} else {
-			newCount++
+	sort.Slice(idx.pages, func(i, j int) bool { return naturalLess(idx.pages[i], idx.pages[j]) })
+
+	cbtIndexMu.Lock()
+	if len(cbtIndexes) >= maxCBTIndexes {
+		for p := range cbtIndexes {
+			delete(cbtIndexes, p)
+			break
 		}
 	}
+	cbtIndexes[cbtPath] = idx
+	cbtIndexMu.Unlock()
 
-	return newCount, updatedCount
+	return idx, nil
 }
 
-// buildCache scans library directories and updates cache
-func buildCache() {
-	logger.Info("🔄 Scanning libraries...")
-	startTime := time.Now()
-
-	existing := make(map[string]string)
-	rows, err := db.Query("SELECT path, lastModified FROM library")
+// openCBTEntry opens a single entry of a CBT archive using the cached index
+func openCBTEntry(cbtPath, name string) (io.ReadCloser, error) {
+	idx, err := indexCBT(cbtPath)
 	if err != nil {
-		logger.Error("Failed to query existing entries: %v", err)
-		return
+		return nil, err
 	}
+	e, ok := idx.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("image not found: %s", name)
+	}
+
+	f, err := os.Open(cbtPath)
+	if err != nil {
+		return nil, err
+	}
+	if !idx.gzipped {
+		return readCloser{io.NewSectionReader(f, e.offset, e.size), f}, nil
+	}
+
+	// Compressed archives are read from the start up to the entry
+	tr, _, err := newCBTReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	for {
+		h, err := tr.Next()
+		if err != nil {
+			f.Close()
+			if err == io.EOF {
+				return nil, fmt.Errorf("image not found: %s", name)
+			}
+			return nil, err
+		}
+		if h.Name == name {
+			return readCloser{tr, f}, nil
+		}
+	}
+}
+
+// getImagesFromCBT extracts image list from CBT archive
+func getImagesFromCBT(cbtPath string) ([]string, error) {
+	idx, err := indexCBT(cbtPath)
+	if err != nil {
+		return nil, err
+	}
+	return idx.pages, nil
+}
+
+// readPageFromCBT reads a specific image from CBT archive
+func readPageFromCBT(cbtPath, imgName string) ([]byte, error) {
+	rc, err := openCBTEntry(cbtPath, imgName)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// errPDFEncrypted is returned for PDFs that cannot be opened without a password
+var errPDFEncrypted = errors.New("pdf is encrypted")
+
+// openPDFContext reads and validates the PDF cross reference table without decoding page content
+func openPDFContext(pdfPath string) (*model.Context, *os.File, error) {
+	f, err := os.Open(pdfPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open PDF: %w", err)
+	}
+
+	ctx, err := api.ReadAndValidate(f, model.NewDefaultConfiguration())
+	if err != nil {
+		f.Close()
+		if errors.Is(err, pdfcpu.ErrWrongPassword) {
+			return nil, nil, errPDFEncrypted
+		}
+		return nil, nil, fmt.Errorf("failed to read PDF: %w", err)
+	}
+
+	return ctx, f, nil
+}
+
+// epubPackage is the part of an EPUB's OPF package document Magz reads
+type epubPackage struct {
+	Metadata struct {
+		Creators    []string `xml:"creator"`
+		Publisher   string   `xml:"publisher"`
+		Date        string   `xml:"date"`
+		Description string   `xml:"description"`
+		Meta        []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:"content,attr"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+	Guide []struct {
+		Type string `xml:"type,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"guide>reference"`
+}
+
+// epubBook is an opened EPUB: its entries by name and its package document
+type epubBook struct {
+	files   map[string]*zip.File
+	pkg     epubPackage
+	opfPath string
+}
+
+// openEPUB reads META-INF/container.xml and the package document it points to
+func openEPUB(r *zip.Reader) (*epubBook, error) {
+	book := &epubBook{files: make(map[string]*zip.File, len(r.File))}
+	for _, f := range r.File {
+		if isSafeEntryName(f.Name) {
+			book.files[f.Name] = f
+		}
+	}
+
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := book.decodeXML("META-INF/container.xml", &container); err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, fmt.Errorf("no rootfile in container.xml")
+	}
+	book.opfPath = container.Rootfiles[0].FullPath
+	if err := book.decodeXML(book.opfPath, &book.pkg); err != nil {
+		return nil, err
+	}
+	return book, nil
+}
+
+// decodeXML unmarshals an XML entry of the book into v
+func (b *epubBook) decodeXML(name string, v interface{}) error {
+	f, ok := b.files[name]
+	if !ok {
+		return fmt.Errorf("%s not found", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := xml.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+// resolve turns an href found in the entry base into an entry name, "" if the book lacks it
+func (b *epubBook) resolve(base, href string) string {
+	href, _, _ = strings.Cut(href, "#")
+	if unescaped, err := url.PathUnescape(href); err == nil {
+		href = unescaped
+	}
+	name := path.Join(path.Dir(base), href)
+	if _, ok := b.files[name]; !ok {
+		return ""
+	}
+	return name
+}
+
+// spine returns the content documents of the book in reading order
+func (b *epubBook) spine() []string {
+	hrefs := make(map[string]string, len(b.pkg.Manifest))
+	for _, item := range b.pkg.Manifest {
+		hrefs[item.ID] = item.Href
+	}
+	var docs []string
+	for _, ref := range b.pkg.Spine {
+		if name := b.resolve(b.opfPath, hrefs[ref.IDRef]); name != "" {
+			docs = append(docs, name)
+		}
+	}
+	return docs
+}
+
+// firstImage returns the first image a content document shows, "" if it has none.
+// Documents are often XHTML in name only, so they are read leniently.
+func (b *epubBook) firstImage(doc string) string {
+	rc, err := b.files[doc].Open()
+	if err != nil {
+		return ""
+	}
+	defer rc.Close()
+
+	d := xml.NewDecoder(io.LimitReader(rc, 1<<20))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		el, ok := tok.(xml.StartElement)
+		if !ok || (el.Name.Local != "img" && el.Name.Local != "image") {
+			continue
+		}
+		for _, attr := range el.Attr {
+			if attr.Name.Local == "src" || attr.Name.Local == "href" {
+				if name := b.resolve(doc, attr.Value); name != "" && isImageFile(strings.ToLower(name)) {
+					return name
+				}
+			}
+		}
+	}
+}
+
+// cover returns the cover image declared by the package document, "" if there is none
+func (b *epubBook) cover() string {
+	// EPUB 3 marks the cover in the manifest, EPUB 2 names its manifest id in a meta element
+	coverID := ""
+	for _, m := range b.pkg.Metadata.Meta {
+		if m.Name == "cover" {
+			coverID = m.Content
+		}
+	}
+	for _, item := range b.pkg.Manifest {
+		if strings.Contains(" "+item.Properties+" ", " cover-image ") || (coverID != "" && item.ID == coverID) {
+			if name := b.resolve(b.opfPath, item.Href); name != "" && isImageFile(strings.ToLower(name)) {
+				return name
+			}
+		}
+	}
+	// The guide may point at a cover page instead
+	for _, ref := range b.pkg.Guide {
+		if ref.Type == "cover" {
+			if doc := b.resolve(b.opfPath, ref.Href); doc != "" {
+				return b.firstImage(doc)
+			}
+		}
+	}
+	return ""
+}
+
+// comicInfo maps the package metadata onto the ComicInfo.xml fields Magz shows
+func (b *epubBook) comicInfo() *ComicInfo {
+	meta := b.pkg.Metadata
+	info := &ComicInfo{
+		Writer:    strings.TrimSpace(strings.Join(meta.Creators, ", ")),
+		Publisher: strings.TrimSpace(meta.Publisher),
+		Summary:   strings.TrimSpace(meta.Description),
+	}
+	if len(meta.Date) >= 4 {
+		info.Year, _ = strconv.Atoi(meta.Date[:4])
+	}
+	return info
+}
+
+// getImagesFromEPUB lists the image shown by each document of an EPUB's spine, so
+// image-based books such as comics and magazines read like a CBZ. Documents
+// without an image, the text of a novel for instance, are left out.
+func getImagesFromEPUB(epubPath string) ([]string, error) {
+	r, err := zip.OpenReader(epubPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open EPUB: %w", err)
+	}
+	defer r.Close()
+
+	book, err := openEPUB(&r.Reader)
+	if err != nil {
+		return nil, err
+	}
+	var pages []string
+	for _, doc := range book.spine() {
+		page := doc
+		if !isImageFile(strings.ToLower(doc)) {
+			page = book.firstImage(doc)
+		}
+		if page != "" && (len(pages) == 0 || pages[len(pages)-1] != page) {
+			pages = append(pages, page)
+		}
+	}
+	return pages, nil
+}
+
+// readEPUBMetadata returns the package metadata of an EPUB and its declared cover image, if any
+func readEPUBMetadata(epubPath string) (*ComicInfo, string, error) {
+	r, err := zip.OpenReader(epubPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open EPUB: %w", err)
+	}
+	defer r.Close()
+
+	book, err := openEPUB(&r.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	return book.comicInfo(), book.cover(), nil
+}
+
+// epubCoverPages lists the declared cover of an EPUB, falling back to its pages
+func epubCoverPages(epubPath string) ([]string, error) {
+	if _, cover, err := readEPUBMetadata(epubPath); err == nil && cover != "" {
+		return []string{cover}, nil
+	}
+	return getImagesFromEPUB(epubPath)
+}
+
+// getImagesFromPDF returns the page numbers of a PDF as page names
+func getImagesFromPDF(pdfPath string) ([]string, error) {
+	ctx, f, err := openPDFContext(pdfPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pages := make([]string, 0, ctx.PageCount)
+	for i := 1; i <= ctx.PageCount; i++ {
+		pages = append(pages, strconv.Itoa(i))
+	}
+	return pages, nil
+}
+
+// extractPDFPage returns the largest image placed on a PDF page, which stands in for
+// the page when no renderer is available. Scanned magazines store one full-page image
+// per page, so this is the page itself; text and vector pages have no such image and fail.
+func extractPDFPage(pdfPath, pageName string) (*model.Image, error) {
+	pageNr, err := strconv.Atoi(pageName)
+	if err != nil || pageNr < 1 {
+		return nil, fmt.Errorf("invalid page number: %s", pageName)
+	}
+
+	f, err := os.Open(pdfPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PDF: %w", err)
+	}
+	defer f.Close()
+
+	// Only the requested page is extracted, so large PDFs are never held in memory whole
+	pageImages, err := api.ExtractImagesRaw(f, []string{strconv.Itoa(pageNr)}, model.NewDefaultConfiguration())
+	if err != nil {
+		if errors.Is(err, pdfcpu.ErrWrongPassword) {
+			return nil, errPDFEncrypted
+		}
+		return nil, fmt.Errorf("failed to extract PDF page: %w", err)
+	}
+
+	best := largestPDFImage(pageImages...)
+	if best == nil {
+		return nil, fmt.Errorf("no image on page %d", pageNr)
+	}
+	return best, nil
+}
+
+// largestPDFImage returns the largest image placed on a page, which extractPDFPage takes for the page
+func largestPDFImage(pageImages ...map[int]model.Image) *model.Image {
+	var best *model.Image
+	for _, m := range pageImages {
+		for _, img := range m {
+			if img.Thumb {
+				continue
+			}
+			// Raw extraction may leave the size unset, then the stream length decides
+			if best == nil || img.Width*img.Height > best.Width*best.Height ||
+				img.Width*img.Height == best.Width*best.Height && img.Size > best.Size {
+				img := img
+				best = &img
+			}
+		}
+	}
+	return best
+}
+
+// readPDFPageSizes reads the size of each page as readPDFPage returns it, parsing the
+// PDF once: rasterized pages from their media box, embedded images from their image
+// dictionaries, decoding no image streams
+func readPDFPageSizes(pdfPath string, index map[string]int, sizes []PageSize) error {
+	f, err := os.Open(pdfPath)
+	if err != nil {
+		return fmt.Errorf("failed to open PDF: %w", err)
+	}
+	defer f.Close()
+
+	conf := model.NewDefaultConfiguration()
+	conf.Cmd = model.EXTRACTIMAGES
+	ctx, err := api.ReadValidateAndOptimize(f, conf)
+	if err != nil {
+		if errors.Is(err, pdfcpu.ErrWrongPassword) {
+			return errPDFEncrypted
+		}
+		return fmt.Errorf("failed to read PDF: %w", err)
+	}
+
+	if currentPDFRenderer() != nil {
+		dims, err := ctx.PageDims()
+		if err != nil {
+			return fmt.Errorf("failed to read PDF page sizes: %w", err)
+		}
+		// Media boxes are in points, 72 to the inch
+		scale := float64(configManager.Get().PDFRenderDPI) / 72
+		for name, i := range index {
+			if pageNr, err := strconv.Atoi(name); err == nil && pageNr >= 1 && pageNr <= len(dims) {
+				d := dims[pageNr-1]
+				sizes[i] = PageSize{Width: int(math.Ceil(d.Width * scale)), Height: int(math.Ceil(d.Height * scale))}
+			}
+		}
+		return nil
+	}
+
+	for name, i := range index {
+		pageNr, err := strconv.Atoi(name)
+		if err != nil || pageNr < 1 || pageNr > ctx.PageCount {
+			continue
+		}
+		// Stubs carry the dictionary's Width and Height without the stream being decoded
+		stubs, _ := pdfcpu.ExtractPageImages(ctx, pageNr, true)
+		if img := largestPDFImage(stubs); img != nil {
+			sizes[i] = PageSize{Width: img.Width, Height: img.Height}
+		}
+	}
+	return nil
+}
+
+// readPageFromPDF reads a PDF page as an image file, see readPDFPage
+func readPageFromPDF(pdfPath, pageName string) ([]byte, error) {
+	data, _, err := readPDFPage(context.Background(), pdfPath, pageName)
+	return data, err
+}
+
+// readPDFPage returns a PDF page as an image file and its extension. The page is
+// rasterized when a renderer is available, otherwise its largest embedded image is
+// taken; images in formats Go can't decode, such as JPX or CCITT, then fail to decode
+// like text pages.
+func readPDFPage(ctx context.Context, pdfPath, pageName string) ([]byte, string, error) {
+	renderer := currentPDFRenderer()
+	if renderer == nil {
+		img, err := extractPDFPage(pdfPath, pageName)
+		if err != nil {
+			return nil, "", err
+		}
+		data, err := io.ReadAll(img)
+		return data, "." + img.FileType, err
+	}
+
+	pageNr, err := strconv.Atoi(pageName)
+	if err != nil || pageNr < 1 {
+		return nil, "", fmt.Errorf("invalid page number: %s", pageName)
+	}
+	data, err := renderer.RenderPage(ctx, pdfPath, pageNr)
+	if err != nil {
+		// Renderers only say they failed; pdfcpu tells whether a password is missing
+		if pdfCtx, f, perr := openPDFContext(pdfPath); perr != nil {
+			if errors.Is(perr, errPDFEncrypted) {
+				return nil, "", errPDFEncrypted
+			}
+		} else {
+			f.Close()
+			if pageNr > pdfCtx.PageCount {
+				return nil, "", fmt.Errorf("no page %d in PDF", pageNr)
+			}
+		}
+		return nil, "", err
+	}
+	if ext := pdfPageExt(data); ext == ".jpg" || ext == ".png" {
+		return data, ext, nil
+	}
+	return nil, "", fmt.Errorf("PDF renderer returned no JPEG or PNG for page %d", pageNr)
+}
+
+// pdfRenderer rasterizes single PDF pages, so text and vector pages can be shown too
+type pdfRenderer interface {
+	// RenderPage returns page n of a PDF, counting from 1, as a JPEG or PNG file
+	RenderPage(ctx context.Context, pdfPath string, n int) ([]byte, error)
+}
+
+// pdfRendererPrograms are the programs PDFRenderer can run, in the order "auto" looks for them
+var pdfRendererPrograms = []string{"pdftoppm", "mutool"}
+
+// pdfRenderTimeout bounds the rendering of a single page
+const pdfRenderTimeout = 30 * time.Second
+
+// pdfRendererProgram is the program a PDFRenderer value names, without directory or .exe
+func pdfRendererProgram(name string) string {
+	return strings.TrimSuffix(filepath.Base(name), ".exe")
+}
+
+// commandRenderer renders pages with pdftoppm from Poppler or mutool from MuPDF,
+// which write each page to a file in a temporary directory
+type commandRenderer struct {
+	path string // of the program
+	dpi  int
+}
+
+// RenderPage runs the program for page n alone, so large PDFs are never rendered whole
+func (c commandRenderer) RenderPage(ctx context.Context, pdfPath string, n int) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, pdfRenderTimeout)
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "magz-pdf-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	page, dpi := strconv.Itoa(n), strconv.Itoa(c.dpi)
+	var cmd *exec.Cmd
+	var out string
+	if pdfRendererProgram(c.path) == "mutool" {
+		out = filepath.Join(dir, "page.png")
+		cmd = exec.CommandContext(ctx, c.path, "draw", "-F", "png", "-r", dpi, "-o", out, pdfPath, page)
+	} else {
+		out = filepath.Join(dir, "page.jpg")
+		cmd = exec.CommandContext(ctx, c.path, "-f", page, "-l", page, "-r", dpi,
+			"-jpeg", "-jpegopt", "quality=90", "-singlefile", pdfPath, strings.TrimSuffix(out, ".jpg"))
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to render page %d with %s: %w: %s", n, filepath.Base(c.path), err, bytes.TrimSpace(output))
+	}
+	return os.ReadFile(out)
+}
+
+// pdfRendering holds the renderer in use, nil when PDF pages are taken from their
+// embedded images; configurePDFRenderer sets it at startup and on reload
+var pdfRendering struct {
+	mu       sync.RWMutex
+	renderer pdfRenderer
+}
+
+// currentPDFRenderer returns the renderer in use, or nil
+func currentPDFRenderer() pdfRenderer {
+	pdfRendering.mu.RLock()
+	defer pdfRendering.mu.RUnlock()
+	return pdfRendering.renderer
+}
+
+// setPDFRenderer replaces the renderer in use
+func setPDFRenderer(r pdfRenderer) {
+	pdfRendering.mu.Lock()
+	defer pdfRendering.mu.Unlock()
+	pdfRendering.renderer = r
+}
+
+// configurePDFRenderer picks the renderer PDFRenderer asks for. With "auto" and
+// neither program installed, PDF pages fall back to their embedded images.
+func configurePDFRenderer(cfg Config) {
+	var path string
+	switch cfg.PDFRenderer {
+	case "off":
+	case "auto":
+		for _, name := range pdfRendererPrograms {
+			if p, err := exec.LookPath(name); err == nil {
+				path = p
+				break
+			}
+		}
+		if path == "" {
+			logger.Warn("Neither pdftoppm nor mutool found: PDF pages are shown from their embedded scan images, text and vector pages can't be shown")
+		}
+	default:
+		// validateConfig found it
+		path, _ = exec.LookPath(cfg.PDFRenderer)
+	}
+
+	if path == "" {
+		setPDFRenderer(nil)
+		return
+	}
+	logger.Info("📄 Rendering PDF pages with %s at %d dpi", path, cfg.PDFRenderDPI)
+	setPDFRenderer(commandRenderer{path: path, dpi: cfg.PDFRenderDPI})
+}
+
+// isComicInfoFile checks if an archive entry is a ComicInfo.xml file
+func isComicInfoFile(name string) bool {
+	return strings.EqualFold(filepath.Base(name), "ComicInfo.xml")
+}
+
+// parseComicInfo decodes ComicInfo.xml metadata
+func parseComicInfo(r io.Reader) (*ComicInfo, error) {
+	var info ComicInfo
+	if err := xml.NewDecoder(r).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to parse ComicInfo.xml: %w", err)
+	}
+	info.Series = strings.TrimSpace(info.Series)
+	info.Number = strings.TrimSpace(info.Number)
+	info.Writer = strings.TrimSpace(info.Writer)
+	info.Publisher = strings.TrimSpace(info.Publisher)
+	info.Summary = strings.TrimSpace(info.Summary)
+	return &info, nil
+}
+
+// readComicInfoFromCBZ reads ComicInfo.xml from CBZ archive, returning nil if absent
+func readComicInfoFromCBZ(cbzPath string) (*ComicInfo, error) {
+	r, err := zip.OpenReader(cbzPath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if isComicInfoFile(f.Name) {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return parseComicInfo(rc)
+		}
+	}
+	return nil, nil
+}
+
+// readComicInfoFromCBR reads ComicInfo.xml from CBR archive, returning nil if absent
+func readComicInfoFromCBR(cbrPath string) (*ComicInfo, error) {
+	f, err := os.Open(cbrPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rr, err := rardecode.NewReader(f, resolvePassword(cbrPath))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		h, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if isComicInfoFile(h.Name) {
+			return parseComicInfo(rr)
+		}
+	}
+	return nil, nil
+}
+
+// isSafeEntryName rejects archive entry names that are absolute or escape the archive root
+func isSafeEntryName(name string) bool {
+	// Archives made on Windows may use backslashes as separators
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || (len(name) > 1 && name[1] == ':') {
+		return false
+	}
+	clean := path.Clean(name)
+	return clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// isJunkEntry checks if an archive entry is a hidden file or macOS metadata
+func isJunkEntry(name string) bool {
+	return strings.HasPrefix(filepath.Base(name), ".") || strings.Contains(name, "__MACOSX")
+}
+
+// isPageEntry checks if an archive entry is a page, skipping junk entries and unsafe names
+func isPageEntry(name string) bool {
+	if isJunkEntry(name) || !isSafeEntryName(name) {
+		return false
+	}
+	return isImageFile(strings.ToLower(name))
+}
+
+// isImageFile checks if the file is a supported image
+func isImageFile(name string) bool {
+	return strings.HasSuffix(name, ".jpg") ||
+		strings.HasSuffix(name, ".jpeg") ||
+		strings.HasSuffix(name, ".png") ||
+		strings.HasSuffix(name, ".webp") ||
+		strings.HasSuffix(name, ".avif") ||
+		strings.HasSuffix(name, ".gif")
+}
+
+// decodeImageFile decodes an image file from disk
+func decodeImageFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// loadCoverImage decodes the cover of a library item from its directory or archive
+func loadCoverImage(path, cover string) (image.Image, error) {
+	var (
+		listPages func(string) ([]string, error)
+		readPage  func(string, string) ([]byte, error)
+	)
+
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".cbz"):
+		listPages, readPage = getImagesFromCBZ, readPageFromCBZ
+	case strings.HasSuffix(lower, ".cbr"):
+		listPages, readPage = getImagesFromCBR, readPageFromCBR
+	case strings.HasSuffix(lower, ".cb7"):
+		listPages, readPage = getImagesFromCB7, readPageFromCB7
+	case strings.HasSuffix(lower, ".cbt"):
+		listPages, readPage = getImagesFromCBT, readPageFromCBT
+	case strings.HasSuffix(lower, ".pdf"):
+		listPages, readPage = getImagesFromPDF, readPageFromPDF
+	case strings.HasSuffix(lower, ".epub"):
+		listPages, readPage = epubCoverPages, readPageFromCBZ
+	default:
+		if _, img := overrideCover(path, readFolderPage); img != nil {
+			return img, nil
+		}
+		if sidecar, _ := coverSidecar(path); sidecar != "" {
+			return decodeImageFile(sidecar)
+		}
+		return decodeImageFile(filepath.Join(path, cover))
+	}
+
+	pages, err := listPages(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no pages in %s", path)
+	}
+	return archiveCover(path, pages, readPage)
+}
+
+// archiveCover decodes the cover of an archive: the page set through /api/item/cover or /api/cover,
+// else its cover sidecar, else the page pickCover picks
+func archiveCover(path string, pages []string, readPage func(string, string) ([]byte, error)) (image.Image, error) {
+	if _, img := overrideCover(path, readPage); img != nil {
+		return img, nil
+	}
+	if sidecar, _ := coverSidecar(path); sidecar != "" {
+		img, err := decodeImageFile(sidecar)
+		if err == nil {
+			return img, nil
+		}
+		logger.Warn("Ignoring cover sidecar %s: %v", sidecar, err)
+	}
+	_, img, err := pickCover(path, pages, readPage)
+	return img, err
+}
+
+// coverSidecar finds the cover image placed next to an archive or folder, such
+// as "Issue 1.cover.jpg" for "Issue 1.cbz"
+func coverSidecar(path string) (string, os.FileInfo) {
+	base := path
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		base = strings.TrimSuffix(path, filepath.Ext(path))
+	}
+	for _, ext := range configManager.Get().CoverSidecarExtensions {
+		if info, err := os.Stat(base + ext); err == nil && !info.IsDir() {
+			return base + ext, info
+		}
+	}
+	return "", nil
+}
+
+// isCoverSidecar reports whether a file name is a cover sidecar
+func isCoverSidecar(name string) bool {
+	return coverSidecarBase(name) != ""
+}
+
+// coverSidecarBase strips the sidecar extension off a cover sidecar path, or
+// returns "" for other files
+func coverSidecarBase(path string) string {
+	lower := strings.ToLower(path)
+	for _, ext := range configManager.Get().CoverSidecarExtensions {
+		if strings.HasSuffix(lower, strings.ToLower(ext)) {
+			return path[:len(path)-len(ext)]
+		}
+	}
+	return ""
+}
+
+// itemModTime is the modification time of an item, or of its cover sidecar when
+// that is newer, so adding or replacing a sidecar rescans the item
+func itemModTime(path string, info os.FileInfo) string {
+	mod := info.ModTime()
+	if _, sidecar := coverSidecar(path); sidecar != nil && sidecar.ModTime().After(mod) {
+		mod = sidecar.ModTime()
+	}
+	return mod.Format(time.RFC3339)
+}
+
+// thumbnailFormats maps the ThumbnailFormat values to their file extension and MIME type
+var thumbnailFormats = map[string]struct{ ext, mime string }{
+	"jpeg": {".jpg", "image/jpeg"},
+	"png":  {".png", "image/png"},
+	"webp": {".webp", "image/webp"},
+}
+
+// thumbnailType returns the MIME type of a cached thumbnail file
+func thumbnailType(name string) string {
+	for _, f := range thumbnailFormats {
+		if f.ext == filepath.Ext(name) {
+			return f.mime
+		}
+	}
+	return "image/jpeg"
+}
+
+// thumbnailName derives the thumbnail cache file name of an item version
+func thumbnailName(path, lastMod, ext string) string {
+	sum := sha1.Sum([]byte(path + "\x00" + lastMod))
+	return hex.EncodeToString(sum[:]) + ext
+}
+
+// saveThumbnail writes the thumbnail of an item to the thumbnail cache and returns its file name
+func saveThumbnail(path, lastMod string, src image.Image) (string, error) {
+	cfg := configManager.Get()
+	format := cfg.ThumbnailFormat
+	data, err := imageToThumbnail(src, cfg.MaxThumbnailSize, cfg.ThumbnailScaleMode, thumbnailBackground(), format, cfg.ThumbnailQuality)
+	if err != nil {
+		thumbnailErrors.Inc()
+		return "", err
+	}
+
+	// A new cover page gets a new name, and with it a new ETag
+	version := lastMod
+	if page := coverPage(path); page != "" {
+		version += "\x00" + page
+	}
+	name := thumbnailName(path, version, thumbnailFormats[format].ext)
+	if err := os.WriteFile(filepath.Join(cfg.ThumbnailDir, name), data, 0o644); err != nil {
+		thumbnailErrors.Inc()
+		return "", fmt.Errorf("failed to write thumbnail: %w", err)
+	}
+	thumbnailsGenerated.Inc()
+	return name, nil
+}
+
+// imageToThumbnailBase64 converts image to base64 thumbnail
+func imageToThumbnailBase64(src image.Image, maxDim int, mode string, bg color.Color, format string, quality int) (string, error) {
+	data, err := imageToThumbnail(src, maxDim, mode, bg, format, quality)
+	if err != nil {
+		return "", err
+	}
+	return "data:" + thumbnailFormats[format].mime + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// imageToThumbnail scales an image down to a thumbnail in the given format. The
+// "fit" mode keeps the whole image within maxDim, "fill" crops it to a centered square
+// and "pad" centers the fitted image on a maxDim square of the bg color.
+func imageToThumbnail(src image.Image, maxDim int, mode string, bg color.Color, format string, quality int) ([]byte, error) {
+	b := src.Bounds()
+	w := b.Dx()
+	h := b.Dy()
+
+	if w == 0 || h == 0 {
+		return nil, fmt.Errorf("invalid image dimensions")
+	}
+
+	var targetW, targetH int
+	switch {
+	case mode == "fill":
+		side := min(w, h)
+		x, y := b.Min.X+(w-side)/2, b.Min.Y+(h-side)/2
+		b = image.Rect(x, y, x+side, y+side)
+		targetW, targetH = maxDim, maxDim
+	case h >= w:
+		targetH = maxDim
+		targetW = max(1, int(float64(w)*(float64(maxDim)/float64(h))))
+	default:
+		targetW = maxDim
+		targetH = max(1, int(float64(h)*(float64(maxDim)/float64(w))))
+	}
+
+	canvas := image.Rect(0, 0, targetW, targetH)
+	if mode == "pad" {
+		canvas = image.Rect(0, 0, maxDim, maxDim)
+	}
+	dst := image.NewRGBA(canvas)
+	if mode == "pad" {
+		draw.Draw(dst, canvas, image.NewUniform(bg), image.Point{}, draw.Src)
+	}
+	at := image.Rect(0, 0, targetW, targetH).Add(image.Pt((canvas.Dx()-targetW)/2, (canvas.Dy()-targetH)/2))
+	draw.CatmullRom.Scale(dst, at, src, b, draw.Over, nil)
+
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, dst)
+	case "webp":
+		err = webp.Encode(&buf, dst, webp.Options{Quality: quality, Method: webp.DefaultMethod})
+	default:
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// thumbnailBackground is the ThumbnailBackground color, validated when the config is loaded
+func thumbnailBackground() color.Color {
+	c, _ := parseHexColor(configManager.Get().ThumbnailBackground)
+	return c
+}
+
+// parseHexColor parses a CSS-style "#rgb" or "#rrggbb" color
+func parseHexColor(s string) (color.RGBA, error) {
+	hexDigits := strings.TrimPrefix(s, "#")
+	if len(hexDigits) == 3 {
+		hexDigits = string([]byte{hexDigits[0], hexDigits[0], hexDigits[1], hexDigits[1], hexDigits[2], hexDigits[2]})
+	}
+	raw, err := hex.DecodeString(hexDigits)
+	if !strings.HasPrefix(s, "#") || err != nil || len(raw) != 3 {
+		return color.RGBA{}, fmt.Errorf("not a #rrggbb color: %s", s)
+	}
+	return color.RGBA{raw[0], raw[1], raw[2], 0xff}, nil
+}
+
+// naturalLess compares strings with natural number ordering
+func naturalLess(a, b string) bool {
+	ai, bi := 0, 0
+	for ai < len(a) && bi < len(b) {
+		if isDigit(a[ai]) && isDigit(b[bi]) {
+			startA, startB := ai, bi
+			for ai < len(a) && isDigit(a[ai]) {
+				ai++
+			}
+			for bi < len(b) && isDigit(b[bi]) {
+				bi++
+			}
+			na, _ := strconv.Atoi(a[startA:ai])
+			nb, _ := strconv.Atoi(b[startB:bi])
+			if na != nb {
+				return na < nb
+			}
+		} else {
+			if a[ai] != b[bi] {
+				return a[ai] < b[bi]
+			}
+			ai++
+			bi++
+		}
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(b byte) bool { return b >= '0' && b <= '9' }
+
+// coverName matches page names marking a cover, such as "cover.jpg" or "000_Front.png"
+var coverName = regexp.MustCompile(`(?i)(^|[^a-z])(cover|front)([^a-z]|$)`)
+
+// coverCandidates is how many leading pages are tried when no page is named as cover
+const coverCandidates = 3
+
+// pickCover decodes the cover page of an item as CoverSelection picks it: with
+// "smart", a page named as cover, else the first of coverCandidates pages that
+// looksLikeContent, else the first page
+func pickCover(path string, pages []string, readPage func(string, string) ([]byte, error)) (string, image.Image, error) {
+	if configManager.Get().CoverSelection == "first" {
+		img, err := decodePage(path, pages[0], readPage)
+		return pages[0], img, err
+	}
+	for _, p := range pages {
+		if coverName.MatchString(filepath.Base(p)) {
+			if img, err := decodePage(path, p, readPage); err == nil {
+				return p, img, nil
+			}
+			break
+		}
+	}
+
+	// Candidates too small for a cover are passed over from their header; only
+	// the others are decoded to look at their pixels
+	var (
+		fallback     string
+		fallbackData []byte
+		fallbackImg  image.Image
+		err          error
+	)
+	for _, p := range pages[:min(coverCandidates, len(pages))] {
+		var data []byte
+		if data, err = readPage(path, p); err != nil {
+			continue
+		}
+		var cfg image.Config
+		if cfg, _, err = image.DecodeConfig(bytes.NewReader(data)); err != nil {
+			continue
+		}
+		if fallbackData == nil {
+			fallback, fallbackData = p, data
+		}
+		if !largeEnoughForCover(cfg) {
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			continue
+		}
+		if looksLikeContent(img) {
+			return p, img, nil
+		}
+		if p == fallback {
+			fallbackImg = img
+		}
+	}
+	if fallbackData == nil {
+		return "", nil, err
+	}
+	if fallbackImg == nil {
+		if fallbackImg, _, err = image.Decode(bytes.NewReader(fallbackData)); err != nil {
+			return "", nil, fmt.Errorf("failed to decode image: %w", err)
+		}
+	}
+	return fallback, fallbackImg, nil
+}
+
+// decodePage reads and decodes the page name of the item at path
+func decodePage(path, name string, readPage func(string, string) ([]byte, error)) (image.Image, error) {
+	data, err := readPage(path, name)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	return img, nil
+}
+
+// minCoverSize is the smallest width and height of a page taken for a cover;
+// smaller ones are usually a scan group's logo
+const minCoverSize = 300
+
+// largeEnoughForCover reports whether a page of the size in cfg, read from its
+// header with image.DecodeConfig, can be a cover
+func largeEnoughForCover(cfg image.Config) bool {
+	return cfg.Width >= minCoverSize && cfg.Height >= minCoverSize
+}
+
+// looksLikeContent reports whether a decoded page large enough for a cover isn't
+// mostly one shade, like a blank, logo or credits page
+func looksLikeContent(img image.Image) bool {
+	b := img.Bounds()
+
+	// Sample a grid and count the samples per shade of gray
+	const grid = 32
+	var shades [16]int
+	for y := 0; y < grid; y++ {
+		for x := 0; x < grid; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x*b.Dx()/grid, b.Min.Y+y*b.Dy()/grid).RGBA()
+			shades[(299*r+587*g+114*bl)/1000>>12]++
+		}
+	}
+	return slices.Max(shades[:]) < grid*grid*9/10
+}
+
+// coverPage returns the page set as cover of the item at path through /api/item/cover
+// or /api/cover. The choice is dropped once the file changes, as its pages may have too.
+func coverPage(path string) string {
+	var page, lastMod string
+	if err := db.QueryRow("SELECT COALESCE(cover_page, ''), lastModified FROM library WHERE path=?", path).Scan(&page, &lastMod); err != nil || page == "" {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil || itemModTime(path, info) != lastMod {
+		return ""
+	}
+	return page
+}
+
+// overrideCover decodes the page coverPage returns, or returns nil when there
+// is none or it can't be read
+func overrideCover(path string, readPage func(string, string) ([]byte, error)) (string, image.Image) {
+	page := coverPage(path)
+	if page == "" {
+		return "", nil
+	}
+	img, err := decodePage(path, page, readPage)
+	if err != nil {
+		logger.Warn("Ignoring cover page %s of %s: %v", page, path, err)
+		return "", nil
+	}
+	return page, img
+}
+
+// readFolderPage reads the page name of an image folder
+func readFolderPage(dir, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(dir, name))
+}
+
+// processCBZ handles CBZ file scanning
+func processCBZ(path string, scan *scanState) scanResult {
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Error("Failed to stat CBZ: %v", err)
+		return scanUnchanged
+	}
+
+	lastMod := itemModTime(path, info)
+	prevMod, exists := scan.markSeen(path)
+
+	category := itemCategory(path)
+	title := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	var (
+		thumbnail string
+		pageList  []string
+		status    = statusOK
+	)
+	meta := &ComicInfo{}
+	if !exists || prevMod != lastMod {
+		pages, err := getImagesFromCBZ(path)
+		if err != nil {
+			logger.Error("Failed to read CBZ pages: %v", err)
+			status = archiveStatus(err)
+		} else if len(pages) > 0 {
+			pageList = pages
+			img, err := archiveCover(path, pages, readPageFromCBZ)
+			if err == nil {
+				thumbnail, err = saveThumbnail(path, lastMod, img)
+			}
+			if err != nil {
+				logger.Warn("Failed to generate thumbnail for %s: %v", path, err)
+			}
+		}
+
+		if info, err := readComicInfoFromCBZ(path); err != nil {
+			logger.Debug("Failed to read ComicInfo.xml from %s: %v", path, err)
+		} else if info != nil {
+			meta = info
+		}
+	}
+
+	scan.mu.Lock()
+	defer scan.mu.Unlock()
+
+	if exists {
+		if prevMod != lastMod {
+			scan.exec(path, `UPDATE library SET category=IIF(user_edited, category, ?), title=IIF(user_edited, title, ?), series_key=IIF(user_edited, NULL, ?), cover=?, thumbnail=?, coverData='', cover_page='', lastModified=?, page_count=?, file_size=?, status=?,
+				series=?, issue_number=?, year=?, writer=?, publisher=?, summary=?,
+				reading_direction=COALESCE(NULLIF(?, ''), reading_direction), double_page=MAX(double_page, ?), updated_at=CURRENT_TIMESTAMP WHERE path=?`,
+				category, title, itemSeriesKey(category, title, meta.Series), "(cbz internal)", thumbnail, lastMod, len(pageList), info.Size(), status,
+				meta.Series, meta.Number, meta.Year, meta.Writer, meta.Publisher, meta.Summary,
+				meta.readingDirection(), meta.doublePage(), path)
+			scan.storePageList(path, pageList)
+			return scanUpdated
+		}
+	} else {
+		scan.exec(path, `INSERT INTO library (category, title, series_key, path, cover, thumbnail, lastModified, page_count, file_size, status,
+			series, issue_number, year, writer, publisher, summary, reading_direction, double_page)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(NULLIF(?, ''), 'ltr'), ?)`,
+			category, title, itemSeriesKey(category, title, meta.Series), path, "(cbz internal)", thumbnail, lastMod, len(pageList), info.Size(), status,
+			meta.Series, meta.Number, meta.Year, meta.Writer, meta.Publisher, meta.Summary,
+			meta.readingDirection(), meta.doublePage())
+		scan.storePageList(path, pageList)
+		return scanAdded
+	}
+
+	return scanUnchanged
+}
+
+// processCBR handles CBR file scanning
+func processCBR(path string, scan *scanState) scanResult {
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Error("Failed to stat CBR: %v", err)
+		return scanUnchanged
+	}
+
+	lastMod := itemModTime(path, info)
+	prevMod, exists := scan.markSeen(path)
+
+	category := itemCategory(path)
+	title := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	var (
+		thumbnail string
+		pageList  []string
+		status    = statusOK
+	)
+	meta := &ComicInfo{}
+	if !exists || prevMod != lastMod {
+		pages, err := getImagesFromCBR(path)
+		if err != nil {
+			logger.Error("Failed to read CBR pages: %v", err)
+			status = archiveStatus(err)
+		} else if len(pages) > 0 {
+			pageList = pages
+			img, err := archiveCover(path, pages, readPageFromCBR)
+			if err == nil {
+				thumbnail, err = saveThumbnail(path, lastMod, img)
+			}
+			if err != nil {
+				logger.Warn("Failed to generate thumbnail for %s: %v", path, err)
+			}
+		}
+
+		if info, err := readComicInfoFromCBR(path); err != nil {
+			logger.Debug("Failed to read ComicInfo.xml from %s: %v", path, err)
+		} else if info != nil {
+			meta = info
+		}
+	}
+
+	scan.mu.Lock()
+	defer scan.mu.Unlock()
+
+	if exists {
+		if prevMod != lastMod {
+			scan.exec(path, `UPDATE library SET category=IIF(user_edited, category, ?), title=IIF(user_edited, title, ?), series_key=IIF(user_edited, NULL, ?), cover=?, thumbnail=?, coverData='', cover_page='', lastModified=?, page_count=?, file_size=?, status=?,
+				series=?, issue_number=?, year=?, writer=?, publisher=?, summary=?,
+				reading_direction=COALESCE(NULLIF(?, ''), reading_direction), double_page=MAX(double_page, ?), updated_at=CURRENT_TIMESTAMP WHERE path=?`,
+				category, title, itemSeriesKey(category, title, meta.Series), "(cbr internal)", thumbnail, lastMod, len(pageList), info.Size(), status,
+				meta.Series, meta.Number, meta.Year, meta.Writer, meta.Publisher, meta.Summary,
+				meta.readingDirection(), meta.doublePage(), path)
+			scan.storePageList(path, pageList)
+			return scanUpdated
+		}
+	} else {
+		scan.exec(path, `INSERT INTO library (category, title, series_key, path, cover, thumbnail, lastModified, page_count, file_size, status,
+			series, issue_number, year, writer, publisher, summary, reading_direction, double_page)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(NULLIF(?, ''), 'ltr'), ?)`,
+			category, title, itemSeriesKey(category, title, meta.Series), path, "(cbr internal)", thumbnail, lastMod, len(pageList), info.Size(), status,
+			meta.Series, meta.Number, meta.Year, meta.Writer, meta.Publisher, meta.Summary,
+			meta.readingDirection(), meta.doublePage())
+		scan.storePageList(path, pageList)
+		return scanAdded
+	}
+
+	return scanUnchanged
+}
+
+// processCB7 handles CB7 file scanning
+func processCB7(path string, scan *scanState) scanResult {
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Error("Failed to stat CB7: %v", err)
+		return scanUnchanged
+	}
+
+	lastMod := itemModTime(path, info)
+	prevMod, exists := scan.markSeen(path)
+
+	category := itemCategory(path)
+	title := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	var (
+		thumbnail string
+		pageList  []string
+		status    = statusOK
+	)
+	if !exists || prevMod != lastMod {
+		pages, err := getImagesFromCB7(path)
+		if err != nil {
+			logger.Error("Failed to read CB7 pages: %v", err)
+			status = archiveStatus(err)
+		} else if len(pages) > 0 {
+			pageList = pages
+			img, err := archiveCover(path, pages, readPageFromCB7)
+			if err == nil {
+				thumbnail, err = saveThumbnail(path, lastMod, img)
+			}
+			if err != nil {
+				logger.Warn("Failed to generate thumbnail for %s: %v", path, err)
+			}
+		}
+	}
+
+	scan.mu.Lock()
+	defer scan.mu.Unlock()
+
+	if exists {
+		if prevMod != lastMod {
+			scan.exec(path, `UPDATE library SET category=IIF(user_edited, category, ?), title=IIF(user_edited, title, ?), series_key=IIF(user_edited, NULL, ?), cover=?, thumbnail=?, coverData='', cover_page='', lastModified=?, page_count=?, file_size=?, status=?, updated_at=CURRENT_TIMESTAMP WHERE path=?`,
+				category, title, itemSeriesKey(category, title, ""), "(cb7 internal)", thumbnail, lastMod, len(pageList), info.Size(), status, path)
+			scan.storePageList(path, pageList)
+			return scanUpdated
+		}
+	} else {
+		scan.exec(path, `INSERT INTO library (category, title, series_key, path, cover, thumbnail, lastModified, page_count, file_size, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			category, title, itemSeriesKey(category, title, ""), path, "(cb7 internal)", thumbnail, lastMod, len(pageList), info.Size(), status)
+		scan.storePageList(path, pageList)
+		return scanAdded
+	}
+
+	return scanUnchanged
+}
+
+// processCBT handles CBT file scanning
+func processCBT(path string, scan *scanState) scanResult {
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Error("Failed to stat CBT: %v", err)
+		return scanUnchanged
+	}
+
+	lastMod := itemModTime(path, info)
+	prevMod, exists := scan.markSeen(path)
+
+	category := itemCategory(path)
+	title := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	var (
+		thumbnail string
+		pageList  []string
+		status    = statusOK
+	)
+	if !exists || prevMod != lastMod {
+		pages, err := getImagesFromCBT(path)
+		if err != nil {
+			logger.Error("Failed to read CBT pages: %v", err)
+			status = archiveStatus(err)
+		} else if len(pages) > 0 {
+			pageList = pages
+			img, err := archiveCover(path, pages, readPageFromCBT)
+			if err == nil {
+				thumbnail, err = saveThumbnail(path, lastMod, img)
+			}
+			if err != nil {
+				logger.Warn("Failed to generate thumbnail for %s: %v", path, err)
+			}
+		}
+	}
+
+	scan.mu.Lock()
+	defer scan.mu.Unlock()
+
+	if exists {
+		if prevMod != lastMod {
+			scan.exec(path, `UPDATE library SET category=IIF(user_edited, category, ?), title=IIF(user_edited, title, ?), series_key=IIF(user_edited, NULL, ?), cover=?, thumbnail=?, coverData='', cover_page='', lastModified=?, page_count=?, file_size=?, status=?, updated_at=CURRENT_TIMESTAMP WHERE path=?`,
+				category, title, itemSeriesKey(category, title, ""), "(cbt internal)", thumbnail, lastMod, len(pageList), info.Size(), status, path)
+			scan.storePageList(path, pageList)
+			return scanUpdated
+		}
+	} else {
+		scan.exec(path, `INSERT INTO library (category, title, series_key, path, cover, thumbnail, lastModified, page_count, file_size, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			category, title, itemSeriesKey(category, title, ""), path, "(cbt internal)", thumbnail, lastMod, len(pageList), info.Size(), status)
+		scan.storePageList(path, pageList)
+		return scanAdded
+	}
+
+	return scanUnchanged
+}
+
+// processPDF handles PDF file scanning
+func processPDF(path string, scan *scanState) scanResult {
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Error("Failed to stat PDF: %v", err)
+		return scanUnchanged
+	}
+
+	lastMod := itemModTime(path, info)
+	prevMod, exists := scan.markSeen(path)
+
+	category := itemCategory(path)
+	title := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	var (
+		thumbnail string
+		pageList  []string
+		status    = statusOK
+	)
+	if !exists || prevMod != lastMod {
+		pages, err := getImagesFromPDF(path)
+		if errors.Is(err, errPDFEncrypted) {
+			logger.Warn("Skipping encrypted PDF: %s", path)
+			scan.forget(path)
+			return scanUnchanged
+		}
+		if err != nil {
+			logger.Error("Failed to read PDF pages: %v", err)
+			status = archiveStatus(err)
+		} else if len(pages) > 0 {
+			pageList = pages
+			img, err := archiveCover(path, pages, readPageFromPDF)
+			if err == nil {
+				thumbnail, err = saveThumbnail(path, lastMod, img)
+			}
+			if err != nil {
+				logger.Warn("Failed to generate thumbnail for %s: %v", path, err)
+			}
+		}
+	}
+
+	scan.mu.Lock()
+	defer scan.mu.Unlock()
+
+	if exists {
+		if prevMod != lastMod {
+			scan.exec(path, `UPDATE library SET category=IIF(user_edited, category, ?), title=IIF(user_edited, title, ?), series_key=IIF(user_edited, NULL, ?), cover=?, thumbnail=?, coverData='', cover_page='', lastModified=?, page_count=?, file_size=?, status=?, updated_at=CURRENT_TIMESTAMP WHERE path=?`,
+				category, title, itemSeriesKey(category, title, ""), "(pdf internal)", thumbnail, lastMod, len(pageList), info.Size(), status, path)
+			scan.storePageList(path, pageList)
+			return scanUpdated
+		}
+	} else {
+		scan.exec(path, `INSERT INTO library (category, title, series_key, path, cover, thumbnail, lastModified, page_count, file_size, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			category, title, itemSeriesKey(category, title, ""), path, "(pdf internal)", thumbnail, lastMod, len(pageList), info.Size(), status)
+		scan.storePageList(path, pageList)
+		return scanAdded
+	}
+
+	return scanUnchanged
+}
+
+// processEPUB handles EPUB file scanning. Only image-based books are listed;
+// text-only EPUBs have no pages the viewer could show.
+func processEPUB(path string, scan *scanState) scanResult {
+	info, err := os.Stat(path)
+	if err != nil {
+		logger.Error("Failed to stat EPUB: %v", err)
+		return scanUnchanged
+	}
+
+	lastMod := itemModTime(path, info)
+	prevMod, exists := scan.markSeen(path)
+
+	category := itemCategory(path)
+	title := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	var (
+		thumbnail string
+		pageList  []string
+		status    = statusOK
+	)
+	meta := &ComicInfo{}
+	if !exists || prevMod != lastMod {
+		pages, err := getImagesFromEPUB(path)
+		if err != nil {
+			logger.Error("Failed to read EPUB pages: %v", err)
+			status = archiveStatus(err)
+		} else if len(pages) == 0 {
+			logger.Debug("Skipping EPUB without page images: %s", path)
+			scan.forget(path)
+			return scanUnchanged
+		} else {
+			pageList = pages
+			cover := pages
+			info, declared, err := readEPUBMetadata(path)
+			if err == nil {
+				meta = info
+			}
+			if declared != "" {
+				cover = []string{declared}
+			}
+			img, err := archiveCover(path, cover, readPageFromCBZ)
+			if err == nil {
+				thumbnail, err = saveThumbnail(path, lastMod, img)
+			}
+			if err != nil {
+				logger.Warn("Failed to generate thumbnail for %s: %v", path, err)
+			}
+		}
+	}
+
+	scan.mu.Lock()
+	defer scan.mu.Unlock()
+
+	if exists {
+		if prevMod != lastMod {
+			scan.exec(path, `UPDATE library SET category=IIF(user_edited, category, ?), title=IIF(user_edited, title, ?), series_key=IIF(user_edited, NULL, ?), cover=?, thumbnail=?, coverData='', cover_page='', lastModified=?, page_count=?, file_size=?, status=?,
+				year=?, writer=?, publisher=?, summary=?, updated_at=CURRENT_TIMESTAMP WHERE path=?`,
+				category, title, itemSeriesKey(category, title, ""), "(epub internal)", thumbnail, lastMod, len(pageList), info.Size(), status,
+				meta.Year, meta.Writer, meta.Publisher, meta.Summary, path)
+			scan.storePageList(path, pageList)
+			return scanUpdated
+		}
+	} else {
+		scan.exec(path, `INSERT INTO library (category, title, series_key, path, cover, thumbnail, lastModified, page_count, file_size, status,
+			year, writer, publisher, summary)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			category, title, itemSeriesKey(category, title, ""), path, "(epub internal)", thumbnail, lastMod, len(pageList), info.Size(), status,
+			meta.Year, meta.Writer, meta.Publisher, meta.Summary)
+		scan.storePageList(path, pageList)
+		return scanAdded
+	}
+
+	return scanUnchanged
+}
+
+// deriveCategory joins up to depth folder names above path, stopping at the
+// library path base. Items directly in base are filed under its name.
+func deriveCategory(path, base string, depth int) string {
+	dir := filepath.Dir(path)
+	rel, err := filepath.Rel(base, dir)
+	if base == "" || err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return filepath.Base(dir)
+	}
+
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	if len(segments) > depth {
+		segments = segments[len(segments)-depth:]
+	}
+	return strings.Join(segments, "/")
+}
+
+// itemCategory derives the category of a library entry with the configured CategoryDepth
+func itemCategory(path string) string {
+	base, _ := libraryRoot(path)
+	return deriveCategory(path, base, configManager.Get().CategoryDepth)
+}
+
+// recategorize moves entries to the categories of the current CategoryDepth,
+// which unchanged files would otherwise keep from when they were scanned
+func recategorize() {
+	rows, err := db.Query("SELECT path, category FROM library WHERE NOT user_edited")
+	if err != nil {
+		logger.Error("Failed to query categories: %v", err)
+		return
+	}
+	moved := make(map[string]string)
+	for rows.Next() {
+		var path, category string
+		rows.Scan(&path, &category)
+		if c := itemCategory(path); c != category {
+			moved[path] = c
+		}
+	}
+	rows.Close()
+
+	if len(moved) == 0 {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		logger.Error("Failed to update categories: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	for path, category := range moved {
+		if _, err := tx.Exec("UPDATE library SET category=?, series_key=NULL WHERE path=?", category, path); err != nil {
+			logger.Error("Failed to update category: %v", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		logger.Error("Failed to update categories: %v", err)
+		return
+	}
+	logger.Info("Moved %d entries to new categories", len(moved))
+	if err := fillSeriesKeys(db); err != nil {
+		logger.Error("Failed to fill series keys: %v", err)
+	}
+}
+
+// scanState is shared by the workers of a library scan
+type scanState struct {
+	existing map[string]string // path -> lastModified, read-only during the scan
+	excluded map[string]bool   // paths deleted with ExcludeOnDelete, read-only during the scan
+	mu       sync.Mutex        // guards seen and pending
+	seen     map[string]bool
+	pending  []scanWrite
+}
+
+// newScanState prepares a scan of the library entries in existing
+func newScanState(existing map[string]string) *scanState {
+	scan := &scanState{existing: existing, excluded: make(map[string]bool), seen: make(map[string]bool)}
+	rows, err := db.Query("SELECT path FROM excluded")
+	if err != nil {
+		logger.Error("Failed to query excluded paths: %v", err)
+		return scan
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var path string
+		rows.Scan(&path)
+		scan.excluded[path] = true
+	}
+	return scan
+}
+
+// scanWrite is a database write queued by a scan worker
+type scanWrite struct {
+	path  string
+	query string
+	args  []interface{}
+}
+
+// scanBatchSize is how many writes a scan queues before committing them in one transaction
+const scanBatchSize = 200
+
+// exec queues a write for the entry at path. The caller holds s.mu.
+func (s *scanState) exec(path, query string, args ...interface{}) {
+	s.pending = append(s.pending, scanWrite{path, query, args})
+	if len(s.pending) >= scanBatchSize {
+		s.writeBatch()
+	}
+}
+
+// storePageList queues caching the page list of an archive entry. The caller holds s.mu.
+func (s *scanState) storePageList(path string, pages []string) {
+	query, args := pageListQuery(path, pages)
+	s.exec(path, query, args...)
+}
+
+// commit writes what is still queued once the workers are done, then computes
+// the series keys the processors left unset
+func (s *scanState) commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeBatch()
+	if err := fillSeriesKeys(db); err != nil {
+		logger.Error("Failed to fill series keys: %v", err)
+	}
+}
+
+// writeBatch commits the queued writes in one transaction. If that fails the batch
+// is rolled back and retried one write at a time, so a single bad entry only loses
+// its own changes. The caller holds s.mu.
+func (s *scanState) writeBatch() {
+	batch := s.pending
+	s.pending = nil
+	if len(batch) == 0 {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err == nil {
+		for _, w := range batch {
+			if _, err = tx.Exec(w.query, w.args...); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}
+	if err == nil {
+		return
+	}
+
+	logger.Warn("Failed to commit %d scan writes, retrying one by one: %v", len(batch), err)
+	for _, w := range batch {
+		if _, err := db.Exec(w.query, w.args...); err != nil {
+			logger.Error("Failed to store entry %s: %v", w.path, err)
+		}
+	}
+}
+
+// markSeen records path as still present and returns its previous lastModified
+func (s *scanState) markSeen(path string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen[path] = true
+	prevMod, exists := s.existing[path]
+	return prevMod, exists
+}
+
+// forget drops path from the scan so its entry gets removed
+func (s *scanState) forget(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.seen, path)
+}
+
+// scanResult is what processing a single path did to the library
+type scanResult int
+
+const (
+	scanUnchanged scanResult = iota
+	scanAdded
+	scanUpdated
+)
+
+// maxScanWorkers caps ScanWorkers; more mostly adds contention on the database lock
+const maxScanWorkers = 32
+
+// Values of the library status column
+const (
+	statusOK         = "ok"
+	statusCorrupt    = "corrupt"    // the archive's entries can't be listed
+	statusUnreadable = "unreadable" // the file can't be opened, or needs a password
+)
+
+// archiveStatus classifies the error of listing an archive's pages
+func archiveStatus(err error) string {
+	switch {
+	case err == nil:
+		return statusOK
+	case errors.Is(err, fs.ErrPermission), errors.Is(err, fs.ErrNotExist), isPasswordError(err):
+		return statusUnreadable
+	}
+	return statusCorrupt
+}
+
+// scanCounts tallies the results of one scan worker
+type scanCounts struct {
+	processed, added, updated int
+}
+
+func (c *scanCounts) add(r scanResult) {
+	c.processed++
+	switch r {
+	case scanAdded:
+		c.added++
+	case scanUpdated:
+		c.updated++
+	}
+}
+
+// progressReporter lets another goroutine follow a running scan
+type progressReporter struct {
+	scanned atomic.Int64
+	total   atomic.Int64 // grows while the library paths are walked
+	done    chan struct{}
+
+	// Final counts, valid once done is closed
+	summary ScanSummary
+}
+
+func newProgressReporter() *progressReporter {
+	return &progressReporter{done: make(chan struct{})}
+}
+
+// The methods below accept a nil reporter so unobserved scans skip the bookkeeping
+
+func (r *progressReporter) queued() {
+	if r != nil {
+		r.total.Add(1)
+	}
+}
+
+func (r *progressReporter) processed() {
+	if r != nil {
+		r.scanned.Add(1)
+	}
+}
+
+func (r *progressReporter) finish(summary ScanSummary) {
+	if r != nil {
+		r.summary = summary
+		close(r.done)
+	}
+}
+
+// checkLibraryHealth returns the library paths that can't be listed, such as
+// network mounts that went away after startup
+func checkLibraryHealth(paths []string) []string {
+	var bad []string
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err == nil {
+			_, err = f.Readdirnames(1)
+			f.Close()
+		}
+		if err != nil && err != io.EOF {
+			bad = append(bad, path)
+		}
+	}
+	return bad
+}
+
+// buildCache scans library directories and updates cache until ctx is cancelled
+func buildCache(ctx context.Context) {
+	buildCacheWithProgress(ctx, nil)
+}
+
+// buildCacheWithProgress is buildCache reporting to r, which may be nil.
+// Cancelling ctx stops the walk and the workers once their current path is
+// stored; entries not reached yet are kept.
+func buildCacheWithProgress(ctx context.Context, r *progressReporter) {
+	scanMu.Lock()
+	defer scanMu.Unlock()
+
+	newCount, updatedCount, deletedCount := 0, 0, 0
+	var unavailable []string
+	defer func() {
+		countScanChanges(newCount, updatedCount, deletedCount)
+		r.finish(ScanSummary{newCount, updatedCount, deletedCount, unavailable})
+	}()
+
+	logger.Info("🔄 Scanning libraries...")
+	startTime := time.Now()
+
+	// A missing mount would otherwise look like a library whose files were all deleted
+	unavailable = checkLibraryHealth(configManager.Get().LibraryPaths)
+	skipped := make(map[string]bool, len(unavailable))
+	for _, base := range unavailable {
+		logger.Warn("Library path %s is not readable, keeping its entries until it is back", base)
+		skipped[filepath.Clean(base)] = true
+	}
+
+	recategorize()
+
+	existing := make(map[string]string)
+	rows, err := db.Query("SELECT path, lastModified FROM library")
+	if err != nil {
+		logger.Error("Failed to query existing entries: %v", err)
+		scansTotal.WithLabelValues("failed").Inc()
+		return
+	}
+	for rows.Next() {
+		var path, mod string
+		rows.Scan(&path, &mod)
+		existing[path] = mod
+	}
+	rows.Close()
+
+	scan := newScanState(existing)
+
+	// Use worker pool for parallel processing
+	var wg sync.WaitGroup
+	workChan := make(chan string, 100)
+
+	// Start workers, each keeping its own counts so they only meet at the end
+	numWorkers := configManager.Get().ScanWorkers
+	counts := make([]scanCounts, numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(c *scanCounts) {
+			defer wg.Done()
+			for path := range workChan {
+				// Drain what was queued without processing it
+				if ctx.Err() != nil {
+					continue
+				}
+				c.add(processPath(path, scan))
+				r.processed()
+			}
+		}(&counts[i])
+	}
+
+	// Walk directories and send to workers
+	for _, base := range configManager.Get().LibraryPaths {
+		if skipped[filepath.Clean(base)] {
+			continue
+		}
+		filepath.WalkDir(base, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return filepath.SkipAll
+			}
+			r.queued()
+			workChan <- path
+			return nil
+		})
+	}
+
+	close(workChan)
+	wg.Wait()
+	scan.commit()
+
+	perWorker := make([]string, len(counts))
+	for i, c := range counts {
+		newCount += c.added
+		updatedCount += c.updated
+		perWorker[i] = strconv.Itoa(c.processed)
+	}
+	logger.Debug("Paths processed per worker: %s", strings.Join(perWorker, ", "))
+
+	// Entries the walk never reached may still exist
+	if ctx.Err() != nil {
+		logger.Warn("Scan cancelled — %d new, %d updated", newCount, updatedCount)
+		scansTotal.WithLabelValues("cancelled").Inc()
+		return
+	}
+
+	// Remove deleted entries
+	var gone []string
+	for path := range existing {
+		if root, _ := libraryRoot(path); !scan.seen[path] && !skipped[root] {
+			gone = append(gone, path)
+		}
+	}
+	if err := removeEntries(gone); err != nil {
+		logger.Error("Failed to delete entries: %v", err)
+	} else {
+		deletedCount = len(gone)
+	}
+
+	pruneThumbnails()
+
+	duration := time.Since(startTime)
+	lastScan.Store(&ScanTiming{FinishedAt: time.Now().UTC(), Duration: duration})
+	scansTotal.WithLabelValues("ok").Inc()
+	scanDuration.Set(duration.Seconds())
+	logger.Info("✅ Cache updated in %v — %d new, %d updated, %d removed", duration, newCount, updatedCount, deletedCount)
+}
+
+// removeEntry deletes a library entry along with its page list, progress, statistics and favorite
+func removeEntry(path string) error {
+	return removeEntries([]string{path})
+}
+
+// removeEntries deletes library entries in one transaction; on failure none are removed
+func removeEntries(paths []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, path := range paths {
+		for _, query := range []string{
+			"DELETE FROM pages WHERE item_id IN (SELECT id FROM library WHERE path=?)",
+			"DELETE FROM progress WHERE item_id IN (SELECT id FROM library WHERE path=?)",
+			"DELETE FROM stats WHERE item_id IN (SELECT id FROM library WHERE path=?)",
+			"DELETE FROM favorites WHERE item_id IN (SELECT id FROM library WHERE path=?)",
+			"DELETE FROM library WHERE path=?",
+		} {
+			if _, err := tx.Exec(query, path); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", path, err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// rescanPaths reprocesses only the entries affected by changed files: the files
+// themselves, their folders (for image folders) and everything in new directories.
+// Entries at or below a path that is gone are removed.
+func rescanPaths(changed []string) {
+	scanMu.Lock()
+	defer scanMu.Unlock()
+
+	startTime := time.Now()
+
+	existing := make(map[string]string)
+	rows, err := db.Query("SELECT path, lastModified FROM library")
+	if err != nil {
+		logger.Error("Failed to query existing entries: %v", err)
+		return
+	}
+	for rows.Next() {
+		var path, mod string
+		rows.Scan(&path, &mod)
+		existing[path] = mod
+	}
+	rows.Close()
+
+	targets := make(map[string]bool)
+	for _, path := range changed {
+		targets[path] = true
+		targets[filepath.Dir(path)] = true
+
+		// A cover sidecar changes the item it belongs to
+		if base := coverSidecarBase(path); base != "" {
+			for entry := range existing {
+				if entry == base || strings.TrimSuffix(entry, filepath.Ext(entry)) == base {
+					targets[entry] = true
+				}
+			}
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			// Gone, along with anything it contained
+			for entry := range existing {
+				if strings.HasPrefix(entry, path+string(filepath.Separator)) {
+					targets[entry] = true
+				}
+			}
+			continue
+		}
+		if info.IsDir() {
+			filepath.WalkDir(path, func(sub string, d os.DirEntry, err error) error {
+				if err == nil {
+					targets[sub] = true
+				}
+				return nil
+			})
+		}
+	}
+
+	scan := newScanState(existing)
+	var counts scanCounts
+	for path := range targets {
+		counts.add(processPath(path, scan))
+	}
+	scan.commit()
+
+	deletedCount := 0
+	var gone []string
+	for path := range targets {
+		if _, ok := existing[path]; ok && !scan.seen[path] {
+			gone = append(gone, path)
+		}
+	}
+	if err := removeEntries(gone); err != nil {
+		logger.Error("Failed to delete entries: %v", err)
+	} else {
+		deletedCount = len(gone)
+	}
+
+	if counts.added+counts.updated+deletedCount > 0 {
+		pruneThumbnails()
+	}
+
+	countScanChanges(counts.added, counts.updated, deletedCount)
+	logger.Info("✅ %d changed paths rescanned in %v — %d new, %d updated, %d removed",
+		len(changed), time.Since(startTime), counts.added, counts.updated, deletedCount)
+}
+
+// watchDebounce is how long the watcher waits for changes to settle before rescanning
+const watchDebounce = 2 * time.Second
+
+// libraryPathsChanged tells the watcher that a config reload changed LibraryPaths
+var libraryPathsChanged = make(chan struct{}, 1)
+
+// watchLibraries rescans the paths that changed on disk once they settle. The
+// ticker's full scan stays as a safety net for events the watcher misses.
+// It stops when ctx is cancelled.
+func watchLibraries(ctx context.Context) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logger.Error("Failed to start file watcher: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	for _, base := range configManager.Get().LibraryPaths {
+		addWatchRecursive(watcher, base)
+	}
+	logger.Info("👀 Watching library paths for changes")
+
+	// Copying or extracting an archive fires many events; coalesce them into one
+	// rescan so half-written files aren't read
+	var (
+		debounce  *time.Timer
+		pendingMu sync.Mutex
+		pending   = make(map[string]bool)
+	)
+	flush := func() {
+		pendingMu.Lock()
+		paths := make([]string, 0, len(pending))
+		for path := range pending {
+			paths = append(paths, path)
+		}
+		pending = make(map[string]bool)
+		pendingMu.Unlock()
+		rescanPaths(paths)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			if debounce != nil {
+				debounce.Stop()
+			}
+			return
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			logger.Debug("File change: %s", event)
+
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					addWatchRecursive(watcher, event.Name)
+				}
+			}
+
+			pendingMu.Lock()
+			pending[event.Name] = true
+			pendingMu.Unlock()
+
+			if debounce == nil {
+				debounce = time.AfterFunc(watchDebounce, flush)
+			} else {
+				debounce.Reset(watchDebounce)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("File watcher error: %v", err)
+
+		case <-libraryPathsChanged:
+			for _, path := range watcher.WatchList() {
+				watcher.Remove(path)
+			}
+			for _, base := range configManager.Get().LibraryPaths {
+				addWatchRecursive(watcher, base)
+			}
+			logger.Info("👀 Watching the reloaded library paths")
+		}
+	}
+}
+
+// addWatchRecursive watches a directory and all of its subdirectories
+func addWatchRecursive(watcher *fsnotify.Watcher, root string) {
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if err := watcher.Add(path); err != nil {
+			logger.Error("Failed to watch %s: %v", path, err)
+		}
+		return nil
+	})
+}
+
+// processPath handles individual path processing
+func processPath(path string, scan *scanState) scanResult {
+	if scan.excluded[path] {
+		return scanUnchanged
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return scanUnchanged
+	}
+
+	lower := strings.ToLower(info.Name())
+	switch {
+	case strings.HasSuffix(lower, ".cbz"):
+		return processCBZ(path, scan)
+	case strings.HasSuffix(lower, ".cbr"):
+		return processCBR(path, scan)
+	case strings.HasSuffix(lower, ".cb7"):
+		return processCB7(path, scan)
+	case strings.HasSuffix(lower, ".cbt"):
+		return processCBT(path, scan)
+	case strings.HasSuffix(lower, ".pdf"):
+		return processPDF(path, scan)
+	case strings.HasSuffix(lower, ".epub"):
+		return processEPUB(path, scan)
+	case info.IsDir():
+		return processDirectory(path, info, scan)
+	}
+	return scanUnchanged
+}
+
+// processDirectory handles directories of loose images
+func processDirectory(path string, info os.FileInfo, scan *scanState) scanResult {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return scanUnchanged
+	}
+
+	var pages []string
+	var size int64
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := strings.ToLower(e.Name())
+		if isImageFile(name) && !strings.HasPrefix(e.Name(), ".") && !isCoverSidecar(name) {
+			pages = append(pages, e.Name())
+			if fi, err := e.Info(); err == nil {
+				size += fi.Size()
+			}
+		}
+	}
+
+	if len(pages) == 0 {
+		return scanUnchanged
+	}
+
+	sort.Slice(pages, func(i, j int) bool { return naturalLess(pages[i], pages[j]) })
+
+	pageCount := len(pages)
+	cover := pages[0]
+	lastMod := itemModTime(path, info)
+
+	prevMod, exists := scan.markSeen(path)
+
+	category := itemCategory(path)
+	title := filepath.Base(path)
+
+	thumbnail := ""
+	if !exists || prevMod != lastMod {
+		// Use semaphore to limit concurrent thumbnail generation
+		thumbSemaphore <- struct{}{}
+		var (
+			img image.Image
+			err error
+		)
+		if page, overridden := overrideCover(path, readFolderPage); overridden != nil {
+			cover, img = page, overridden
+		} else if sidecar, _ := coverSidecar(path); sidecar != "" {
+			img, err = decodeImageFile(sidecar)
+		} else {
+			var page string
+			if page, img, err = pickCover(path, pages, readFolderPage); err == nil {
+				cover = page
+			}
+		}
+		if err == nil {
+			thumbnail, err = saveThumbnail(path, lastMod, img)
+		}
+		if err != nil {
+			logger.Debug("Failed to generate thumbnail for %s: %v", path, err)
+		}
+		<-thumbSemaphore
+	}
+
+	scan.mu.Lock()
+	defer scan.mu.Unlock()
+
+	if exists {
+		if prevMod != lastMod {
+			scan.exec(path, `UPDATE library SET category=IIF(user_edited, category, ?), title=IIF(user_edited, title, ?), series_key=IIF(user_edited, NULL, ?), cover=?, thumbnail=?, coverData='', cover_page='', lastModified=?, page_count=?, file_size=?, updated_at=CURRENT_TIMESTAMP WHERE path=?`,
+				category, title, itemSeriesKey(category, title, ""), cover, thumbnail, lastMod, pageCount, size, path)
+			return scanUpdated
+		}
+	} else {
+		scan.exec(path, `INSERT INTO library (category, title, series_key, path, cover, thumbnail, lastModified, page_count, file_size)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			category, title, itemSeriesKey(category, title, ""), path, cover, thumbnail, lastMod, pageCount, size)
+		return scanAdded
+	}
+	return scanUnchanged
+}
+
+// HTTP Handlers
+
+// handleMedia serves media files with security checks
+func handleMedia(w http.ResponseWriter, r *http.Request) {
+	cbrPath := r.URL.Query().Get("cbr")
+	cbzPath := r.URL.Query().Get("cbz")
+	cb7Path := r.URL.Query().Get("cb7")
+	cbtPath := r.URL.Query().Get("cbt")
+	pdfPath := r.URL.Query().Get("pdf")
+	epubPath := r.URL.Query().Get("epub")
+	pageName := r.URL.Query().Get("page")
+
+	// Serve CBZ pages
+	if cbzPath != "" && pageName != "" {
+		if !isPathAllowed(cbzPath) {
+			logger.WithContext(r.Context()).Error("Unauthorized CBZ access attempt: %s", cbzPath)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if archivePageNotModified(w, r, cbzPath, pageName) {
+			return
+		}
+		serveCBZPage(w, r, cbzPath, pageName)
+		return
+	}
+
+	// Serve CBR pages
+	if cbrPath != "" && pageName != "" {
+		if !isPathAllowed(cbrPath) {
+			logger.WithContext(r.Context()).Error("Unauthorized CBR access attempt: %s", cbrPath)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if archivePageNotModified(w, r, cbrPath, pageName) {
+			return
+		}
+		serveCBRPage(w, r, cbrPath, pageName)
+		return
+	}
+
+	// Serve CB7 pages
+	if cb7Path != "" && pageName != "" {
+		if !isPathAllowed(cb7Path) {
+			logger.WithContext(r.Context()).Error("Unauthorized CB7 access attempt: %s", cb7Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if archivePageNotModified(w, r, cb7Path, pageName) {
+			return
+		}
+		serveCB7Page(w, r, cb7Path, pageName)
+		return
+	}
+
+	// Serve CBT pages
+	if cbtPath != "" && pageName != "" {
+		if !isPathAllowed(cbtPath) {
+			logger.WithContext(r.Context()).Error("Unauthorized CBT access attempt: %s", cbtPath)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if archivePageNotModified(w, r, cbtPath, pageName) {
+			return
+		}
+		serveCBTPage(w, r, cbtPath, pageName)
+		return
+	}
+
+	// Serve PDF pages
+	if pdfPath != "" && pageName != "" {
+		if !isPathAllowed(pdfPath) {
+			logger.WithContext(r.Context()).Error("Unauthorized PDF access attempt: %s", pdfPath)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if archivePageNotModified(w, r, pdfPath, pageName) {
+			return
+		}
+		servePDFPage(w, r, pdfPath, pageName)
+		return
+	}
+
+	// Serve EPUB pages; an EPUB is a zip archive
+	if epubPath != "" && pageName != "" {
+		if !isPathAllowed(epubPath) {
+			logger.WithContext(r.Context()).Error("Unauthorized EPUB access attempt: %s", epubPath)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if archivePageNotModified(w, r, epubPath, pageName) {
+			return
+		}
+		serveCBZPage(w, r, epubPath, pageName)
+		return
+	}
+
+	// Serve normal filesystem file
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		http.Error(w, "missing path", http.StatusBadRequest)
+		return
+	}
+
+	// Security: ensure file is inside library dirs
+	if !isPathAllowed(path) {
+		logger.WithContext(r.Context()).Error("Unauthorized path access attempt: %s", path)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Check if file exists
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	// ServeFile answers If-None-Match and If-Modified-Since itself once the ETag is set
+	if err == nil {
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	}
+
+	if needsTranscode(r, path) {
+		w.Header().Set("ETag", transcodedETag(w.Header().Get("ETag")))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			logger.WithContext(r.Context()).Error("Cannot read file: %v", err)
+			http.Error(w, "cannot read file", http.StatusInternalServerError)
+			return
+		}
+		servePageContent(w, r, path, filepath.Base(path), data)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// pageETag is a cached ETag for one archive entry
+type pageETag struct {
+	modTime time.Time
+	size    int64
+	etag    string
+}
+
+// Page ETags keyed by archivePath+":"+entryName
+var pageETags sync.Map
+
+// archivePageETag returns the ETag of an archive entry and the archive's modification time.
+// Tags are derived from the archive's mtime and size, so the archive itself is never opened.
+func archivePageETag(archivePath, pageName string) (string, time.Time, error) {
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	key := archivePath + ":" + pageName
+	if v, ok := pageETags.Load(key); ok {
+		cached := v.(pageETag)
+		if cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+			return cached.etag, cached.modTime, nil
+		}
+	}
+
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s:%d:%d", key, info.ModTime().UnixNano(), info.Size())))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	pageETags.Store(key, pageETag{modTime: info.ModTime(), size: info.Size(), etag: etag})
+	return etag, info.ModTime(), nil
+}
+
+// archivePageNotModified sets caching headers for an archive page and
+// answers 304 when the client already has it
+func archivePageNotModified(w http.ResponseWriter, r *http.Request, archivePath, pageName string) bool {
+	etag, modTime, err := archivePageETag(archivePath, pageName)
+	if err != nil {
+		// Let the page handler report the missing archive
+		return false
+	}
+	if needsTranscode(r, pageName) {
+		etag = transcodedETag(etag)
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatches(inm, etag) {
+			return false
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || modTime.Truncate(time.Second).After(ims) {
+		return false
+	}
+
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches reports whether an If-None-Match header lists etag
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveCBZPage serves a single page from CBZ archive
+func serveCBZPage(w http.ResponseWriter, r *http.Request, cbzPath, pageName string) {
+	if !isSafeEntryName(pageName) {
+		logger.WithContext(r.Context()).Error("Unsafe CBZ page name: %q", pageName)
+		http.Error(w, "page not found", http.StatusNotFound)
+		return
+	}
+
+	var modTime time.Time
+	if info, err := os.Stat(cbzPath); err == nil {
+		modTime = info.ModTime()
+	}
+	// Checked here too, so no read-ahead goroutine is started while Prefetch is off
+	if cfg := configManager.Get(); cfg.prefetchEnabled() {
+		go prefetchCBZPages(cbzPath, pageName, modTime)
+	}
+
+	if data, ok := cachedPages.Get(pageKey(cbzPath, pageName, modTime)); ok {
+		servePageContent(w, r, cbzPath, pageName, data)
+		return
+	}
+
+	archive, err := zipReaders.Open(cbzPath, modTime)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Cannot open CBZ: %v", err)
+		http.Error(w, "cannot open cbz", http.StatusInternalServerError)
+		return
+	}
+	defer zipReaders.Release(archive)
+
+	f, ok := archive.files[pageName]
+	if !ok {
+		http.Error(w, "page not found", http.StatusNotFound)
+		return
+	}
+	data, err := readZipEntry(f)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Cannot read page: %v", err)
+		http.Error(w, "cannot read page", http.StatusInternalServerError)
+		return
+	}
+	cachedPages.Add(pageKey(cbzPath, f.Name, modTime), data)
+	servePageContent(w, r, cbzPath, f.Name, data)
+}
+
+// readZipEntry decompresses a whole zip entry
+func readZipEntry(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// prefetchPages is how many pages after the one being read are decompressed ahead
+const prefetchPages = 4
+
+// prefetching holds the archives being read ahead, so each is read by one goroutine at a time
+var prefetching sync.Map
+
+// pagesToPrefetch returns the pages following pageName that aren't cached yet,
+// or none while Prefetch is off
+func pagesToPrefetch(archivePath, pageName string, modTime time.Time) []string {
+	if cfg := configManager.Get(); !cfg.prefetchEnabled() {
+		return nil
+	}
+	_, pages, err := cachedItemPages(archivePath, false)
+	if err != nil {
+		return nil
+	}
+	var next []string
+	for i, name := range pages {
+		if name == pageName {
+			for _, name := range pages[i+1 : min(i+1+prefetchPages, len(pages))] {
+				if !cachedPages.Has(pageKey(archivePath, name, modTime)) {
+					next = append(next, name)
+				}
+			}
+			break
+		}
+	}
+	return next
+}
+
+// prefetchCBZPages decompresses the pages following pageName into cachedPages, so
+// turning the page doesn't have to search the archive again
+func prefetchCBZPages(cbzPath, pageName string, modTime time.Time) {
+	next := pagesToPrefetch(cbzPath, pageName, modTime)
+	if len(next) == 0 {
+		return
+	}
+	if _, busy := prefetching.LoadOrStore(cbzPath, true); busy {
+		return
+	}
+
+	defer prefetching.Delete(cbzPath)
+
+	archive, err := zipReaders.Open(cbzPath, modTime)
+	if err != nil {
+		return
+	}
+	defer zipReaders.Release(archive)
+
+	for _, name := range next {
+		f, ok := archive.files[name]
+		if !ok {
+			continue
+		}
+		data, err := readZipEntry(f)
+		if err != nil {
+			logger.Debug("Cannot prefetch %s from %s: %v", f.Name, cbzPath, err)
+			continue
+		}
+		cachedPages.Add(pageKey(cbzPath, f.Name, modTime), data)
+	}
+}
+
+// prefetchCBRPages reads on through a CBR after one of its pages was served, caching
+// the pages in next. Reopening the archive would decompress it from the start again.
+func prefetchCBRPages(f *os.File, rr *rardecode.Reader, cbrPath string, next []string, modTime time.Time) {
+	defer prefetching.Delete(cbrPath)
+	defer f.Close()
+
+	wanted := make(map[string]bool, len(next))
+	for _, name := range next {
+		wanted[name] = true
+	}
+	// Pages stored out of order aren't worth decompressing the rest of the archive for
+	for skipped := 0; len(wanted) > 0 && skipped <= prefetchPages; {
+		h, err := rr.Next()
+		if err != nil {
+			return
+		}
+		if !wanted[h.Name] {
+			skipped++
+			continue
+		}
+		delete(wanted, h.Name)
+		data, err := io.ReadAll(rr)
+		if err != nil {
+			logger.Debug("Cannot prefetch %s from %s: %v", h.Name, cbrPath, err)
+			return
+		}
+		cachedPages.Add(pageKey(cbrPath, h.Name, modTime), data)
+	}
+}
+
+// serveCBRPage serves a single page from CBR archive
+func serveCBRPage(w http.ResponseWriter, r *http.Request, cbrPath, pageName string) {
+	var modTime time.Time
+	if info, err := os.Stat(cbrPath); err == nil {
+		modTime = info.ModTime()
+	}
+	if data, ok := cachedPages.Get(pageKey(cbrPath, pageName, modTime)); ok {
+		servePageContent(w, r, cbrPath, pageName, data)
+		return
+	}
+
+	f, err := os.Open(cbrPath)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Cannot open CBR: %v", err)
+		http.Error(w, "cannot open cbr", http.StatusInternalServerError)
+		return
+	}
+	// Unless prefetchCBRPages takes over the open archive
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	rr, err := rardecode.NewReader(f, resolvePassword(cbrPath))
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Cannot read CBR: %v", err)
+		archiveError(w, "cannot read cbr", err)
+		return
+	}
+
+	for {
+		h, err := rr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.WithContext(r.Context()).Error("Error reading CBR: %v", err)
+			archiveError(w, "error reading cbr", err)
+			return
+		}
+		if h.Name == pageName {
+			// Pages are sent as stored; servePageContent transcodes only when the browser needs it
+			data, err := io.ReadAll(rr)
+			if err != nil {
+				logger.WithContext(r.Context()).Error("Cannot read page: %v", err)
+				archiveError(w, "cannot read page", err)
+				return
+			}
+			if next := pagesToPrefetch(cbrPath, pageName, modTime); len(next) > 0 {
+				if _, busy := prefetching.LoadOrStore(cbrPath, true); !busy {
+					go prefetchCBRPages(f, rr, cbrPath, next, modTime)
+					f = nil
+				}
+			}
+			servePageContent(w, r, cbrPath, h.Name, data)
+			return
+		}
+	}
+
+	http.Error(w, "page not found", http.StatusNotFound)
+}
+
+// serveCB7Page serves a single page from CB7 archive
+func serveCB7Page(w http.ResponseWriter, r *http.Request, cb7Path, pageName string) {
+	a, err := openCB7Archive(cb7Path)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Cannot open CB7: %v", err)
+		archiveError(w, "cannot open cb7", err)
+		return
+	}
+	defer a.mu.Unlock()
+
+	defer func() {
+		if p := recover(); p != nil {
+			logger.WithContext(r.Context()).Error("Corrupt CB7 %s: %v", cb7Path, p)
+			http.Error(w, "cannot read page", http.StatusInternalServerError)
+		}
+	}()
+
+	for _, f := range a.r.File {
+		if f.Name == pageName {
+			rc, err := f.Open()
+			if err != nil {
+				logger.WithContext(r.Context()).Error("Cannot read page: %v", err)
+				archiveError(w, "cannot read page", err)
+				return
+			}
+			defer rc.Close()
+
+			data, err := io.ReadAll(rc)
+			if err != nil {
+				logger.WithContext(r.Context()).Error("Cannot read page: %v", err)
+				archiveError(w, "cannot read page", err)
+				return
+			}
+			servePageContent(w, r, cb7Path, f.Name, data)
+			return
+		}
+	}
+
+	http.Error(w, "page not found", http.StatusNotFound)
+}
+
+// serveCBTPage serves a single page from CBT archive
+func serveCBTPage(w http.ResponseWriter, r *http.Request, cbtPath, pageName string) {
+	rc, err := openCBTEntry(cbtPath, pageName)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Cannot read CBT page: %v", err)
+		http.Error(w, "page not found", http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Cannot read CBT page: %v", err)
+		http.Error(w, "cannot read page", http.StatusInternalServerError)
+		return
+	}
+	servePageContent(w, r, cbtPath, pageName, data)
+}
+
+// servePDFPage serves a single page from PDF file, see readPDFPage. Pages are kept in
+// the page cache, as rendering one takes much longer than reading an archive entry.
+func servePDFPage(w http.ResponseWriter, r *http.Request, pdfPath, pageName string) {
+	var modTime time.Time
+	if info, err := os.Stat(pdfPath); err == nil {
+		modTime = info.ModTime()
+	}
+	key := pageKey(pdfPath, pageName, modTime)
+	if data, ok := cachedPages.Get(key); ok {
+		servePageContent(w, r, pdfPath, pageName+pdfPageExt(data), data)
+		return
+	}
+
+	data, ext, err := readPDFPage(r.Context(), pdfPath, pageName)
+	if errors.Is(err, errPDFEncrypted) {
+		http.Error(w, "pdf is encrypted", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Cannot read PDF page: %v", err)
+		http.Error(w, "page not found", http.StatusNotFound)
+		return
+	}
+	cachedPages.Add(key, data)
+	servePageContent(w, r, pdfPath, pageName+ext, data)
+}
+
+// pdfPageExt is the extension of a page readPDFPage returned, from its content
+func pdfPageExt(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	}
+	// Other embedded images are served as they are
+	if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		return "." + format
+	}
+	return ""
+}
+
+// servePageContent serves a page read from an archive, with Range and
+// conditional request support. The archive's mtime is the page's modtime.
+func servePageContent(w http.ResponseWriter, r *http.Request, archivePath, pageName string, data []byte) {
+	var modTime time.Time
+	if info, err := os.Stat(archivePath); err == nil {
+		modTime = info.ModTime()
+	}
+
+	// A JPEG would keep only the first frame of an animation
+	if needsTranscode(r, pageName) && !isAnimatedWebP(data) {
+		if jpg, err := transcodeToJPEG(pageKey(archivePath, pageName, modTime)+":jpg", data); err != nil {
+			logger.WithContext(r.Context()).Error("Cannot transcode %s: %v", pageName, err)
+		} else {
+			data = jpg
+			pageName = strings.TrimSuffix(pageName, filepath.Ext(pageName)) + ".jpg"
+		}
+	}
+
+	setImageContentType(w, pageName)
+	http.ServeContent(w, r, pageName, modTime, bytes.NewReader(data))
+}
+
+// needsTranscode reports whether pageName is WebP or AVIF and the client can't display it
+func needsTranscode(r *http.Request, pageName string) bool {
+	if !configManager.Get().TranscodeUnsupported {
+		return false
+	}
+
+	var mime string
+	switch strings.ToLower(filepath.Ext(pageName)) {
+	case ".webp":
+		mime = "image/webp"
+	case ".avif":
+		mime = "image/avif"
+	default:
+		return false
+	}
+	return !strings.Contains(r.Header.Get("Accept"), mime)
+}
+
+// isAnimatedWebP reports whether data is a WebP of more than one frame, by
+// counting the ANMF chunks of its RIFF container
+func isAnimatedWebP(data []byte) bool {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return false
+	}
+	frames := 0
+	for p := 12; p+8 <= len(data); {
+		if string(data[p:p+4]) == "ANMF" {
+			if frames++; frames > 1 {
+				return true
+			}
+		}
+		// Chunks are padded to an even size
+		size := int(binary.LittleEndian.Uint32(data[p+4 : p+8]))
+		p += 8 + size + size&1
+	}
+	return false
+}
+
+// transcodedETag derives the ETag of the JPEG version of a page
+func transcodedETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + `-jpg"`
+}
+
+// cachedPages holds archive pages read ahead by prefetchCBZPages
+var cachedPages *pageCache
+
+// transcodedPages holds pages re-encoded by transcodeToJPEG, at most
+// MaxThumbnailSize * 100 of them
+var transcodedPages *pageCache
+
+// pageKey identifies a page of an archive in cachedPages
+func pageKey(archivePath, pageName string, modTime time.Time) string {
+	return fmt.Sprintf("%s:%s:%d", archivePath, pageName, modTime.UnixNano())
+}
+
+// transcodeToJPEG re-encodes a page to JPEG, caching the result under key
+func transcodeToJPEG(key string, data []byte) ([]byte, error) {
+	if jpg, ok := transcodedPages.Get(key); ok {
+		return jpg, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+
+	transcodedPages.Add(key, buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// pageCache is a least-recently-used cache of encoded pages
+type pageCache struct {
+	mu         sync.Mutex
+	max        int // bytes, or 0 for no limit
+	maxEntries int // pages, or 0 for no limit
+	size       int
+	order      *list.List // most recently used at the front
+	items      map[string]*list.Element
+}
+
+// pageCacheEntry is the value stored in pageCache.order
+type pageCacheEntry struct {
+	key  string
+	data []byte
+}
+
+// newPageCache creates a cache holding at most max bytes of pages
+func newPageCache(max int) *pageCache {
+	return &pageCache{max: max, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// newPageCacheEntries creates a cache holding at most n pages of any size
+func newPageCacheEntries(n int) *pageCache {
+	return &pageCache{maxEntries: n, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// full reports whether the cache is over its limit
+func (c *pageCache) full() bool {
+	return c.max > 0 && c.size > c.max || c.maxEntries > 0 && c.order.Len() > c.maxEntries
+}
+
+// Get returns the cached page for key
+func (c *pageCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	pageCacheLookups.WithLabelValues(cacheResult(ok)).Inc()
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*pageCacheEntry).data, true
+}
+
+// Has reports whether key is cached, without counting as a use
+func (c *pageCache) Has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.items[key]
+	return ok
+}
+
+// Add stores a page, evicting the least recently used ones when full
+func (c *pageCache) Add(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*pageCacheEntry)
+		c.size += len(data) - len(entry.data)
+		entry.data = data
+		c.order.MoveToFront(e)
+	} else {
+		c.items[key] = c.order.PushFront(&pageCacheEntry{key: key, data: data})
+		c.size += len(data)
+	}
+	for c.full() && c.order.Len() > 0 {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*pageCacheEntry)
+		c.order.Remove(oldest)
+		delete(c.items, entry.key)
+		c.size -= len(entry.data)
+	}
+}
+
+// maxOpenZips caps the archives zipReaders keeps open, and so their file descriptors
+const maxOpenZips = 16
+
+// zipReaders keeps the CBZ archives being read open, so a page turn finds its
+// entry without reopening the archive and reading its central directory again
+var zipReaders = newZipCache(maxOpenZips)
+
+// zipCache is a least-recently-used cache of open zip archives. Archives are
+// reference counted, so an evicted one is closed once its last user releases it.
+type zipCache struct {
+	mu    sync.Mutex
+	max   int        // archives
+	order *list.List // most recently used at the front
+	items map[string]*list.Element
+}
+
+// sharedZip is an archive opened by zipCache, with its entries by name
+type sharedZip struct {
+	path    string
+	modTime time.Time
+	reader  *zip.ReadCloser
+	files   map[string]*zip.File
+	refs    int // users, plus one while cached
+}
+
+// newZipCache creates a cache keeping at most max archives open
+func newZipCache(max int) *zipCache {
+	return &zipCache{max: max, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// Open returns the archive at path, reusing the open one unless the file changed
+// since. Callers pass it to Release when done.
+func (c *zipCache) Open(path string, modTime time.Time) (*sharedZip, error) {
+	if z := c.get(path, modTime); z != nil {
+		return z, nil
+	}
+
+	// Opened outside the lock, so a slow disk doesn't hold up other archives
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	z := &sharedZip{path: path, modTime: modTime, reader: r, files: make(map[string]*zip.File, len(r.File)), refs: 2}
+	for _, f := range r.File {
+		// The first of duplicate names wins, as in the page list
+		if _, dup := z.files[f.Name]; !dup {
+			z.files[f.Name] = f
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[path]; ok {
+		// Another request opened it meanwhile
+		if other := e.Value.(*sharedZip); other.modTime.Equal(modTime) {
+			r.Close()
+			other.refs++
+			c.order.MoveToFront(e)
+			return other, nil
+		}
+		c.remove(e)
+	}
+	c.items[path] = c.order.PushFront(z)
+	for c.order.Len() > c.max {
+		c.remove(c.order.Back())
+	}
+	return z, nil
+}
+
+// get returns the cached archive at path if it is still current, dropping a stale one
+func (c *zipCache) get(path string, modTime time.Time) *sharedZip {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[path]
+	if ok && !e.Value.(*sharedZip).modTime.Equal(modTime) {
+		c.remove(e)
+		ok = false
+	}
+	zipReaderLookups.WithLabelValues(cacheResult(ok)).Inc()
+	if !ok {
+		return nil
+	}
+	z := e.Value.(*sharedZip)
+	z.refs++
+	c.order.MoveToFront(e)
+	return z
+}
+
+// Release gives back an archive returned by Open
+func (c *zipCache) Release(z *sharedZip) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unref(z)
+}
+
+// remove drops an entry from the cache; its archive stays open while in use
+func (c *zipCache) remove(e *list.Element) {
+	z := e.Value.(*sharedZip)
+	c.order.Remove(e)
+	delete(c.items, z.path)
+	c.unref(z)
+}
+
+// unref closes the archive of z once neither the cache nor a user holds it
+func (c *zipCache) unref(z *sharedZip) {
+	if z.refs--; z.refs == 0 {
+		z.reader.Close()
+	}
+}
+
+// setImageContentType sets appropriate content type for images
+func setImageContentType(w http.ResponseWriter, filename string) {
+	// The same URL may be transcoded for some browsers and not others
+	if configManager.Get().TranscodeUnsupported {
+		w.Header().Add("Vary", "Accept")
+	}
+
+	w.Header().Set("Content-Type", imageContentType(filename))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+}
+
+// imageContentType guesses the MIME type of a page from its name, JPEG if unknown
+func imageContentType(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".png":
+		return "image/png"
+	case ".webp":
+		return "image/webp"
+	case ".gif":
+		return "image/gif"
+	case ".avif":
+		return "image/avif"
+	case ".tif", ".tiff":
+		return "image/tiff"
+	}
+	return "image/jpeg"
+}
+
+// libraryColumns lists the columns scanned into a LibraryItem, in scan order
+const libraryColumns = `l.id, l.category, l.title, l.path, l.cover, l.cover_page, l.lastModified, COALESCE(l.created_at, ''), COALESCE(l.updated_at, ''),
+	l.series, l.issue_number, l.year, l.writer, l.publisher, l.summary, l.page_count, l.file_size, l.status, l.reading_direction, l.double_page, COALESCE(p.page_index, 0),
+	COALESCE(p.total_pages, 0), COALESCE(s.page_views, 0), COALESCE(s.total_seconds, 0), f.item_id IS NOT NULL, COALESCE(l.series_key, '')`
+
+// libraryFrom joins the tables libraryColumns reads from
+const libraryFrom = `library l LEFT JOIN progress p ON p.item_id = l.id LEFT JOIN stats s ON s.item_id = l.id
+	LEFT JOIN favorites f ON f.item_id = l.id`
+
+// queryLibraryItems runs a query selecting libraryColumns from libraryFrom
+func queryLibraryItems(query string, args ...interface{}) ([]LibraryItem, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []LibraryItem
+
+	for rows.Next() {
+		var item LibraryItem
+		err := rows.Scan(&item.ID, &item.Category, &item.Title, &item.Path, &item.Cover, &item.CoverPage, &item.LastMod, &item.Added, &item.Updated,
+			&item.Series, &item.IssueNumber, &item.Year, &item.Writer, &item.Publisher, &item.Summary, &item.PageCount, &item.SizeBytes, &item.Status, &item.ReadingDirection, &item.DoublePage, &item.LastPage,
+			&item.TotalPages, &item.PageViews, &item.TotalSeconds, &item.Favorite, &item.seriesKey)
+		if err != nil {
+			logger.Error("Scan error: %v", err)
+			continue
+		}
+
+		item.Subcategory = item.Category[strings.LastIndex(item.Category, "/")+1:]
+
+		// The version parameter lets browsers cache covers until the item or its cover page changes
+		version := item.LastMod
+		if item.CoverPage != "" {
+			version += ":" + item.CoverPage
+		}
+		item.CoverURL = fmt.Sprintf("/api/thumbnail?id=%d&v=%s", item.ID, url.QueryEscape(version))
+
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// librarySorts maps the sort values of /api/library to their column
+var librarySorts = map[string]string{
+	"title":        "l.title",
+	"lastModified": "l.lastModified",
+	"created_at":   "l.created_at",
+	"added":        "l.created_at",
+	"category":     "l.category",
+	"year":         "l.year",
+	"views":        "COALESCE(s.page_views, 0)",
+}
+
+// handleLibrary returns all library items, or those of one category or status.
+// With limit or offset it returns one page and the total in X-Total-Count.
+func handleLibrary(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if category := params.Get("category"); category != "" {
+		// Nested categories are included; a range instead of LIKE keeps idx_category usable
+		conds = append(conds, "(l.category = ? OR (l.category >= ? AND l.category < ?))")
+		args = append(args, category, category+"/", category+"0")
+	}
+	if status := params.Get("status"); status != "" {
+		conds = append(conds, "l.status = ?")
+		args = append(args, status)
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	// Column names can't be bound as parameters, so only whitelisted ones reach the query
+	sortColumn := "l.title"
+	if v := params.Get("sort"); v != "" {
+		col, ok := librarySorts[v]
+		if !ok {
+			http.Error(w, "invalid sort", http.StatusBadRequest)
+			return
+		}
+		sortColumn = col
+	}
+	direction := "ASC"
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		direction = "DESC"
+	default:
+		http.Error(w, "invalid order", http.StatusBadRequest)
+		return
+	}
+	orderBy := " ORDER BY " + sortColumn + " " + direction
+	if sortColumn != "l.title" {
+		orderBy += ", l.title"
+	}
+	query := "SELECT " + libraryColumns + " FROM " + libraryFrom + where + orderBy
+
+	// Without paging parameters every item is returned, as older clients expect
+	if params.Has("limit") || params.Has("offset") {
+		limit, offset, err := parsePaging(params)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var total int
+		if err := db.QueryRow("SELECT COUNT(*) FROM library l"+where, args...).Scan(&total); err != nil {
+			logger.WithContext(r.Context()).Error("Query failed: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+
+	items, err := queryLibraryItems(query, args...)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Query failed: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Older clients expect covers embedded as data URIs
+	if r.URL.Query().Get("inline") == "1" {
+		for i := range items {
+			items[i].CoverData = inlineThumbnail(items[i].ID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(items)
+}
+
+// handleItem returns, renames or deletes a single library entry
+func handleItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, PATCH, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		handlePatchItem(w, r, id)
+		return
+	}
+
+	item, err := queryLibraryItem(id)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Query failed: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if item == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		deleteItem(w, r, item.Path)
+		return
+	}
+
+	if r.URL.Query().Get("inline") == "1" {
+		item.CoverData = inlineThumbnail(item.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(item)
+}
+
+// handleItemMeta updates the reading direction and double-page flag of an item
+func handleItemMeta(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", "PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	var meta ItemMeta
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&meta); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if d := meta.ReadingDirection; d != nil && *d != "ltr" && *d != "rtl" {
+		http.Error(w, "invalid reading direction", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec(`UPDATE library SET reading_direction=COALESCE(?, reading_direction),
+		double_page=COALESCE(?, double_page) WHERE id=?`, meta.ReadingDirection, meta.DoublePage, id)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to save item meta: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleItemCover sets the cover of an item to one of its pages, numbered from 1
+// as in /api/pages or by name, or with DELETE lets CoverSelection pick it again.
+// The thumbnail is regenerated right away and the updated item returned.
+func handleItemCover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	var path string
+	if err := db.QueryRow("SELECT path FROM library WHERE id=?", id).Scan(&path); err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	page := ""
+	if r.Method == http.MethodPut {
+		params := r.URL.Query()
+		name := params.Get("name")
+		n, err := strconv.Atoi(params.Get("page"))
+		if name == "" && err != nil {
+			http.Error(w, "missing page", http.StatusBadRequest)
+			return
+		}
+		param, pages, err := cachedItemPages(path, false)
+		if err != nil {
+			logger.WithContext(r.Context()).Error("Failed to list pages of %s: %v", path, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		// Image folders list their pages by path, but are read by name
+		if param == "path" {
+			for i, p := range pages {
+				pages[i] = filepath.Base(p)
+			}
+		}
+		switch {
+		case name != "":
+			if param == "path" {
+				name = filepath.Base(name)
+			}
+			if !slices.Contains(pages, name) {
+				http.Error(w, "page not found", http.StatusNotFound)
+				return
+			}
+			page = name
+		case n < 1 || n > len(pages):
+			http.Error(w, "invalid page", http.StatusBadRequest)
+			return
+		default:
+			page = pages[n-1]
+		}
+	}
+
+	item, err := setCoverPage(r.Context(), id, path, page)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to set cover: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
+
+// handleCover answers POST /api/cover?id=N&page=NAME as PUT /api/item/cover with the
+// page given by name, as it appears in the page URLs of /api/pages. Other methods serve
+// the thumbnail, as /api/cover did before /api/thumbnail and is kept for existing links.
+func handleCover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		handleThumbnail(w, r)
+		return
+	}
+
+	params := r.URL.Query()
+	if params.Get("page") == "" {
+		http.Error(w, "missing page", http.StatusBadRequest)
+		return
+	}
+	params.Set("name", params.Get("page"))
+	params.Del("page")
+
+	put := r.Clone(r.Context())
+	put.Method = http.MethodPut
+	put.URL.RawQuery = params.Encode()
+	handleItemCover(w, put)
+}
+
+// setCoverPage stores the cover page of an item, or clears it when page is empty,
+// and regenerates its thumbnail
+func setCoverPage(ctx context.Context, id int, path, page string) (*LibraryItem, error) {
+	if _, err := db.Exec("UPDATE library SET cover_page=?, thumbnail='', coverData='', updated_at=CURRENT_TIMESTAMP WHERE id=?", page, id); err != nil {
+		return nil, err
+	}
+	if _, err := ensureThumbnail(id); err != nil {
+		logger.WithContext(ctx).Warn("Failed to regenerate thumbnail of %s: %v", path, err)
+	}
+
+	item, err := queryLibraryItem(id)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, fmt.Errorf("item %d disappeared", id)
+	}
+	return item, nil
+}
+
+// handlePatchItem renames the title and category of an item. Scans keep the new
+// names instead of deriving them from the path again.
+func handlePatchItem(w http.ResponseWriter, r *http.Request, id int) {
+	var patch ItemPatch
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&patch); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if patch.Title == nil && patch.Category == nil {
+		http.Error(w, "nothing to update", http.StatusBadRequest)
+		return
+	}
+	for _, field := range []*string{patch.Title, patch.Category} {
+		if field == nil {
+			continue
+		}
+		*field = strings.TrimSpace(*field)
+		if *field == "" {
+			http.Error(w, "title and category can't be empty", http.StatusBadRequest)
+			return
+		}
+	}
+
+	res, err := db.Exec(`UPDATE library SET title=COALESCE(?, title), category=COALESCE(?, category), user_edited=1,
+		series_key=NULL, updated_at=CURRENT_TIMESTAMP WHERE id=?`, patch.Title, patch.Category, id)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to rename item: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err := fillSeriesKeys(db); err != nil {
+		logger.WithContext(r.Context()).Error("Failed to fill series keys: %v", err)
+	}
+
+	item, err := queryLibraryItem(id)
+	if err != nil || item == nil {
+		logger.WithContext(r.Context()).Error("Query failed: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(item)
+}
+
+// catalogColumns lists the library columns of a CatalogEntry, in scan order
+const catalogColumns = `path, category, title, cover, lastModified, series, issue_number, year, writer,
+	publisher, summary, page_count, file_size, status, reading_direction, double_page, user_edited, cover_page`
+
+// handleExport streams the library table as a JSON array of CatalogEntry.
+// ?covers=1 adds the cached thumbnails, without generating missing ones.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	covers := r.URL.Query().Get("covers") == "1"
+
+	rows, err := db.Query("SELECT " + catalogColumns + ", COALESCE(created_at, ''), COALESCE(thumbnail, '') FROM library ORDER BY path")
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to query catalog: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="magz-catalog.json"`)
+
+	// Rows are written as they are read; an error midway leaves the array unterminated
+	enc := json.NewEncoder(w)
+	io.WriteString(w, "[")
+	for n := 0; rows.Next(); n++ {
+		var e CatalogEntry
+		var thumbnail string
+		err := rows.Scan(&e.Path, &e.Category, &e.Title, &e.Cover, &e.LastMod, &e.Series, &e.IssueNumber, &e.Year, &e.Writer,
+			&e.Publisher, &e.Summary, &e.PageCount, &e.SizeBytes, &e.Status, &e.ReadingDirection, &e.DoublePage, &e.UserEdited, &e.CoverPage, &e.Added, &thumbnail)
+		if err != nil {
+			logger.WithContext(r.Context()).Error("Failed to export catalog: %v", err)
+			return
+		}
+		if covers {
+			e.CoverData = thumbnailDataURI(thumbnail)
+		}
+		if n > 0 {
+			io.WriteString(w, ",")
+		}
+		if err := enc.Encode(e); err != nil {
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logger.WithContext(r.Context()).Error("Failed to export catalog: %v", err)
+		return
+	}
+	io.WriteString(w, "]\n")
+}
+
+// maxImportBytes caps the body of /api/import, which may carry covers
+const maxImportBytes = 1 << 30
+
+// handleImport upserts a JSON array of CatalogEntry by path. Entries whose file
+// is unchanged since the export are kept by the next scan instead of being read again.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// A large catalog may take longer to upload than the server's read timeout allows
+	if err := http.NewResponseController(w).SetReadDeadline(time.Time{}); err != nil {
+		logger.Debug("Cannot lift read deadline: %v", err)
+	}
+
+	// The body is spooled to disk first, so a slow upload doesn't hold up scans
+	spool, err := os.CreateTemp("", "magz-import-*.json")
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to import catalog: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	if _, err := io.Copy(spool, http.MaxBytesReader(w, r.Body, maxImportBytes)); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		logger.WithContext(r.Context()).Error("Failed to import catalog: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	dec := json.NewDecoder(spool)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	// Keep scans from seeing a half-imported catalog
+	scanMu.Lock()
+	defer scanMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to import catalog: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Thumbnails are regenerated on demand, from coverData where it is a JPEG
+	// Entries already in the library keep their created_at
+	stmt, err := tx.Prepare(`INSERT INTO library (` + catalogColumns + `, created_at, thumbnail, coverData)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, COALESCE(NULLIF(?, ''), CURRENT_TIMESTAMP), '', ?)
+		ON CONFLICT(path) DO UPDATE SET category=excluded.category, title=excluded.title, cover=excluded.cover,
+			lastModified=excluded.lastModified, series=excluded.series, issue_number=excluded.issue_number,
+			year=excluded.year, writer=excluded.writer, publisher=excluded.publisher, summary=excluded.summary,
+			page_count=excluded.page_count, file_size=excluded.file_size, status=excluded.status,
+			reading_direction=excluded.reading_direction, double_page=excluded.double_page, user_edited=excluded.user_edited,
+			cover_page=excluded.cover_page, thumbnail='', coverData=excluded.coverData, updated_at=CURRENT_TIMESTAMP`)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to import catalog: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer stmt.Close()
+
+	var result ImportResult
+	for dec.More() {
+		var e CatalogEntry
+		if err := dec.Decode(&e); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+
+		// Scans would drop these again
+		var excluded int
+		tx.QueryRow("SELECT COUNT(*) FROM excluded WHERE path=?", e.Path).Scan(&excluded)
+		if _, ok := libraryRoot(e.Path); !ok || !filepath.IsAbs(e.Path) || excluded > 0 {
+			result.Skipped++
+			continue
+		}
+
+		if e.Status != statusCorrupt && e.Status != statusUnreadable {
+			e.Status = statusOK
+		}
+		if e.ReadingDirection != "rtl" {
+			e.ReadingDirection = "ltr"
+		}
+		if !strings.HasPrefix(e.CoverData, "data:image/jpeg;base64,") {
+			e.CoverData = ""
+		}
+		// Anything but SQLite's timestamp format would sort wrongly in /api/recent
+		if _, err := time.Parse(time.DateTime, e.Added); err != nil {
+			e.Added = ""
+		}
+
+		_, err := stmt.Exec(e.Path, e.Category, e.Title, e.Cover, e.LastMod, e.Series, e.IssueNumber, e.Year, e.Writer,
+			e.Publisher, e.Summary, e.PageCount, e.SizeBytes, e.Status, e.ReadingDirection, e.DoublePage, e.UserEdited, e.CoverPage, e.Added, e.CoverData)
+		if err != nil {
+			logger.WithContext(r.Context()).Error("Failed to import %s: %v", e.Path, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		result.Imported++
+	}
+	if _, err := dec.Token(); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		logger.WithContext(r.Context()).Error("Failed to import catalog: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Imported %d catalog entries, skipped %d", result.Imported, result.Skipped)
+	if err := fillSeriesKeys(db); err != nil {
+		logger.WithContext(r.Context()).Error("Failed to fill series keys: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleFavorite stars (POST) or unstars (DELETE) an item
+func handleFavorite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM library WHERE id=?", id).Scan(&exists); err != nil || exists == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		_, err = db.Exec("INSERT OR IGNORE INTO favorites (item_id) VALUES (?)", id)
+	} else {
+		_, err = db.Exec("DELETE FROM favorites WHERE item_id=?", id)
+	}
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to save favorite: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleFavorites lists the starred items, most recently starred first
+func handleFavorites(w http.ResponseWriter, r *http.Request) {
+	items, err := queryLibraryItems("SELECT " + libraryColumns + " FROM " + libraryFrom +
+		" WHERE f.item_id IS NOT NULL ORDER BY f.created_at DESC, l.title")
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to query favorites: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if items == nil {
+		items = []LibraryItem{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(items)
+}
+
+// handleRecent returns the newest items of the library, most recently added first.
+// With sort=updated it orders them by their last change instead.
+func handleRecent(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	limit, offset, err := parsePaging(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	column := "l.created_at"
+	switch params.Get("sort") {
+	case "", "added":
+	case "updated":
+		column = "l.updated_at"
+	default:
+		http.Error(w, "invalid sort", http.StatusBadRequest)
+		return
+	}
+
+	// Items of one scan share a timestamp, so the later inserts come first among them
+	items, err := queryLibraryItems("SELECT "+libraryColumns+" FROM "+libraryFrom+
+		" ORDER BY "+column+" DESC, l.id DESC LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to query recent items: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if items == nil {
+		items = []LibraryItem{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(items)
+}
+
+// handleRandom returns one readable item picked at random, from one category
+// and those nested in it when category is given
+func handleRandom(w http.ResponseWriter, r *http.Request) {
+	where := "status = 'ok'"
+	var args []interface{}
+	if category := r.URL.Query().Get("category"); category != "" {
+		where += " AND (category = ? OR (category >= ? AND category < ?))"
+		args = append(args, category, category+"/", category+"0")
+	}
+
+	// Shuffling only the ids keeps the joins out of the sort
+	items, err := queryLibraryItems("SELECT "+libraryColumns+" FROM "+libraryFrom+
+		" WHERE l.id = (SELECT id FROM library WHERE "+where+" ORDER BY RANDOM() LIMIT 1)", args...)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to pick a random item: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if len(items) == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(items[0])
+}
+
+// handleVacuum checks the integrity of the database and, if it is sound, compacts it
+func handleVacuum(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// VACUUM fails while another connection is writing
+	scanMu.Lock()
+	defer scanMu.Unlock()
+
+	result := VacuumResult{Integrity: []string{}}
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Integrity check failed: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var line string
+		rows.Scan(&line)
+		result.Integrity = append(result.Integrity, line)
+	}
+	rows.Close()
+
+	if len(result.Integrity) == 1 && result.Integrity[0] == "ok" {
+		before, err := databaseSize()
+		if err == nil {
+			_, err = db.Exec("VACUUM")
+		}
+		if err != nil {
+			logger.WithContext(r.Context()).Error("Vacuum failed: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		after, _ := databaseSize()
+		result.Vacuumed = true
+		result.BytesFreed = before - after
+		logger.Info("Database vacuumed, %d bytes freed", result.BytesFreed)
+	} else {
+		logger.WithContext(r.Context()).Error("Database integrity check failed: %s", strings.Join(result.Integrity, "; "))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// databaseSize returns the size of the database file in bytes
+func databaseSize() (int64, error) {
+	var pages, pageSize int64
+	if err := db.QueryRow("PRAGMA page_count").Scan(&pages); err != nil {
+		return 0, err
+	}
+	if err := db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, err
+	}
+	return pages * pageSize, nil
+}
+
+// deleteItem removes an entry from the library but leaves its file alone. It comes
+// back with the next scan, unless ExcludeOnDelete keeps its path out of scans.
+func deleteItem(w http.ResponseWriter, r *http.Request, path string) {
+	if configManager.Get().ExcludeOnDelete {
+		if _, err := db.Exec("INSERT OR IGNORE INTO excluded (path) VALUES (?)", path); err != nil {
+			logger.WithContext(r.Context()).Error("Failed to exclude %s: %v", path, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := removeEntry(path); err != nil {
+		logger.WithContext(r.Context()).Error("Failed to delete entry: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Removed %s from the library", path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryLibraryItem looks up a library entry by ID, nil if there is none
+func queryLibraryItem(id int) (*LibraryItem, error) {
+	items, err := queryLibraryItems("SELECT "+libraryColumns+" FROM "+libraryFrom+" WHERE l.id = ?", id)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	return &items[0], nil
+}
+
+// ftsQuery turns free text into an FTS5 query matching every word as a prefix
+func ftsQuery(q string) string {
+	var terms []string
+	for _, word := range strings.Fields(q) {
+		word = strings.ReplaceAll(word, `"`, `""`)
+		terms = append(terms, `"`+word+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Paging defaults for list endpoints
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// parsePaging reads the limit and offset query parameters
+func parsePaging(params url.Values) (limit, offset int, err error) {
+	limit = defaultPageLimit
+	if v := params.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return 0, 0, errors.New("invalid limit")
+		}
+		limit = min(n, maxPageLimit)
+	}
+
+	if v := params.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+// handleSearch searches the library by text, category (with the categories nested in it), year and writer
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	limit, offset, err := parsePaging(params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := "SELECT " + libraryColumns + " FROM " + libraryFrom
+	var (
+		where []string
+		args  []interface{}
+	)
+
+	q := ftsQuery(params.Get("q"))
+	if q != "" {
+		query += " JOIN library_fts ON library_fts.rowid = l.id"
+		where = append(where, "library_fts MATCH ?")
+		args = append(args, q)
+	}
+	if category := params.Get("category"); category != "" {
+		// The same range as /api/library, so nested categories are included
+		where = append(where, "(l.category = ? OR (l.category >= ? AND l.category < ?))")
+		args = append(args, category, category+"/", category+"0")
+	}
+	if v := params.Get("year"); v != "" {
+		year, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid year", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "l.year = ?")
+		args = append(args, year)
+	}
+	if writer := params.Get("writer"); writer != "" {
+		where = append(where, "l.writer LIKE ?")
+		args = append(args, "%"+writer+"%")
+	}
+
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if q != "" {
+		query += " ORDER BY library_fts.rank, l.title"
+	} else {
+		query += " ORDER BY l.title"
+	}
+	query += " LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	items, err := queryLibraryItems(query, args...)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Search failed: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if items == nil {
+		items = []LibraryItem{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(items)
+}
+
+// handleProgress reads (GET) or saves (POST/PUT) the reading position of an item.
+// POST takes id, page and total as query parameters, PUT takes a JSON Progress.
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "missing id", http.StatusBadRequest)
+			return
+		}
+
+		p := Progress{ID: id}
+		err = db.QueryRow("SELECT page_index, total_pages, updated_at FROM progress WHERE item_id=?", id).
+			Scan(&p.Page, &p.TotalPages, &p.UpdatedAt)
+		if err != nil && err != sql.ErrNoRows {
+			logger.WithContext(r.Context()).Error("Failed to read progress: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		json.NewEncoder(w).Encode(p)
+
+	case http.MethodPost, http.MethodPut:
+		var p Progress
+		if r.Method == http.MethodPost {
+			q := r.URL.Query()
+			var err error
+			if p.ID, err = strconv.Atoi(q.Get("id")); err != nil {
+				http.Error(w, "missing id", http.StatusBadRequest)
+				return
+			}
+			if p.Page, err = strconv.Atoi(q.Get("page")); err != nil {
+				http.Error(w, "missing page", http.StatusBadRequest)
+				return
+			}
+			if t := q.Get("total"); t != "" {
+				if p.TotalPages, err = strconv.Atoi(t); err != nil {
+					http.Error(w, "invalid total", http.StatusBadRequest)
+					return
+				}
+			}
+		} else if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&p); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		if p.ID < 1 || p.Page < 0 || p.TotalPages < 0 {
+			http.Error(w, "invalid id or page", http.StatusBadRequest)
+			return
+		}
+
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM library WHERE id=?", p.ID).Scan(&exists); err != nil || exists == 0 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		_, err := db.Exec(`INSERT OR REPLACE INTO progress (item_id, page_index, total_pages, updated_at)
+			VALUES (?, ?, ?, CURRENT_TIMESTAMP)`, p.ID, p.Page, p.TotalPages)
+		if err != nil {
+			logger.WithContext(r.Context()).Error("Failed to save progress: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// maxEventSeconds caps the reading time of one event, so a reader left open doesn't count
+const maxEventSeconds = 600
+
+// statsFlushInterval is how often buffered reading statistics are written to the database
+const statsFlushInterval = 30 * time.Second
+
+// pendingStat is the reading activity of one item not yet written to the database
+type pendingStat struct {
+	pageViews int
+	seconds   int
+	lastRead  time.Time
+}
+
+var (
+	statsMu      sync.Mutex
+	pendingStats = make(map[int]*pendingStat)
+)
+
+// recordStatsEvent buffers a page view until the next flushStats
+func recordStatsEvent(e StatsEvent) {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+
+	p := pendingStats[e.ID]
+	if p == nil {
+		p = &pendingStat{}
+		pendingStats[e.ID] = p
+	}
+	p.pageViews++
+	p.seconds += e.Seconds
+	p.lastRead = time.Now()
+}
+
+// flushStats writes the buffered reading statistics to the database
+func flushStats() error {
+	statsMu.Lock()
+	pending := pendingStats
+	pendingStats = make(map[int]*pendingStat)
+	statsMu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for id, p := range pending {
+		_, err := tx.Exec(`INSERT INTO stats (item_id, page_views, total_seconds, last_read) VALUES (?, ?, ?, ?)
+			ON CONFLICT(item_id) DO UPDATE SET page_views = page_views + excluded.page_views,
+			total_seconds = total_seconds + excluded.total_seconds, last_read = excluded.last_read`,
+			id, p.pageViews, p.seconds, p.lastRead.UTC().Format("2006-01-02 15:04:05"))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// flushStatsPeriodically flushes the reading statistics until the process exits
+func flushStatsPeriodically() {
+	ticker := time.NewTicker(statsFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := flushStats(); err != nil {
+			logger.Error("Failed to save reading stats: %v", err)
+		}
+	}
+}
+
+// handleStatsEvent records a page view and reading time for an item
+func handleStatsEvent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var e StatsEvent
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&e); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if e.ID < 1 || e.Seconds < 0 {
+		http.Error(w, "invalid id or seconds", http.StatusBadRequest)
+		return
+	}
+	if e.Seconds > maxEventSeconds {
+		e.Seconds = maxEventSeconds
+	}
+
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM library WHERE id=?", e.ID).Scan(&exists); err != nil || exists == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	recordStatsEvent(e)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleStats returns the most viewed and longest read items
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	// Include events still waiting in the buffer
+	if err := flushStats(); err != nil {
+		logger.WithContext(r.Context()).Error("Failed to save reading stats: %v", err)
+	}
+
+	var stats ReadingStats
+	var err error
+	query := "SELECT " + libraryColumns + " FROM " + libraryFrom
+	stats.MostViewed, err = queryLibraryItems(query + " WHERE s.page_views > 0 ORDER BY s.page_views DESC, l.title LIMIT 10")
+	if err == nil {
+		stats.MostRead, err = queryLibraryItems(query + " WHERE s.total_seconds > 0 ORDER BY s.total_seconds DESC, l.title LIMIT 10")
+	}
+	if err == nil {
+		stats.Library, err = queryLibraryStats()
+	}
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to query stats: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if stats.MostViewed == nil {
+		stats.MostViewed = []LibraryItem{}
+	}
+	if stats.MostRead == nil {
+		stats.MostRead = []LibraryItem{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleLibraryStats returns only the library totals of /api/stats, without
+// flushing and ranking the reading statistics
+func handleLibraryStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := queryLibraryStats()
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to query library stats: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// itemFormatExpr classifies a library path the same way processPath dispatches it
+const itemFormatExpr = `CASE
+	WHEN lower(path) LIKE '%.cbz' THEN 'cbz'
+	WHEN lower(path) LIKE '%.cbr' THEN 'cbr'
+	WHEN lower(path) LIKE '%.cb7' THEN 'cb7'
+	WHEN lower(path) LIKE '%.cbt' THEN 'cbt'
+	WHEN lower(path) LIKE '%.pdf' THEN 'pdf'
+	WHEN lower(path) LIKE '%.epub' THEN 'epub'
+	ELSE 'directory' END`
+
+// hasCoverExpr tells whether an item has a cover: a page set through PUT /api/item/cover,
+// or the cover page a scan picked. Archives without pages keep their "(cbz internal)"
+// placeholder but have nothing to show.
+const hasCoverExpr = `(COALESCE(cover_page, '') != '' OR (COALESCE(cover, '') != '' AND page_count > 0))`
+
+// queryLibraryStats totals the library from the columns the scanner stores and
+// the sizes of the files on disk
+func queryLibraryStats() (LibraryStats, error) {
+	stats := LibraryStats{
+		Categories: map[string]int{},
+		Formats:    map[string]int{},
+	}
+	if timing := lastScan.Load(); timing != nil {
+		ms := timing.Duration.Milliseconds()
+		stats.LastScanFinishedAt, stats.LastScanDurationMs = &timing.FinishedAt, &ms
+	}
+	err := db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(page_count), 0), COALESCE(SUM(`+hasCoverExpr+`), 0) FROM library`).
+		Scan(&stats.TotalItems, &stats.TotalPages, &stats.ItemsWithCover)
+	stats.ItemsWithoutCover = stats.TotalItems - stats.ItemsWithCover
+	if err == nil {
+		stats.TotalSizeBytes, err = librarySize.get()
+	}
+	if err == nil {
+		err = countLibraryBy("COALESCE(category, '')", stats.Categories)
+		stats.TotalCategories = len(stats.Categories)
+	}
+	if err == nil {
+		err = countLibraryBy(itemFormatExpr, stats.Formats)
+	}
+	return stats, err
+}
+
+// librarySizeTTL is how long the library size on disk is reused before the files are statted again
+const librarySizeTTL = 60 * time.Second
+
+// diskSize caches the total size of the library files for the stats endpoints,
+// so polling them doesn't stat every item each time
+type diskSize struct {
+	mu      sync.Mutex // held while the files are statted, so concurrent requests share one pass
+	bytes   int64
+	statted time.Time
+}
+
+var librarySize diskSize
+
+// get returns the size on disk of the library items: archive and PDF sizes, and for
+// image folders the sum of their files. Items missing on disk count as 0.
+func (d *diskSize) get() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.statted.IsZero() && time.Since(d.statted) < librarySizeTTL {
+		return d.bytes, nil
+	}
+
+	rows, err := db.Query("SELECT path FROM library")
+	if err != nil {
+		return 0, err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir() {
+			total += info.Size()
+			continue
+		}
+		entries, _ := os.ReadDir(path)
+		for _, e := range entries {
+			if fi, err := e.Info(); err == nil && fi.Mode().IsRegular() {
+				total += fi.Size()
+			}
+		}
+	}
+	d.bytes, d.statted = total, time.Now()
+	return total, nil
+}
+
+// countLibraryBy fills counts with the number of library items per value of expr
+func countLibraryBy(expr string, counts map[string]int) error {
+	rows, err := db.Query("SELECT " + expr + ", COUNT(*) FROM library GROUP BY 1")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var n int
+		if err := rows.Scan(&key, &n); err != nil {
+			return err
+		}
+		counts[key] = n
+	}
+	return rows.Err()
+}
+
+// handleThumbnail serves the cover thumbnail of an item from the thumbnail cache
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	size := 0
+	if v := r.URL.Query().Get("size"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size < 1 {
+			http.Error(w, "invalid size", http.StatusBadRequest)
+			return
+		}
+		size = thumbnailSize(size)
+		if size == configManager.Get().MaxThumbnailSize {
+			size = 0
+		}
+	}
+
+	base, err := ensureThumbnail(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	name := base
+	if size != 0 {
+		name = sizedThumbnailName(base, size)
+	}
+	data, ok := thumbnailBytes.Get(name)
+	if !ok && err == nil {
+		data, err = loadThumbnail(id, base, size)
+		if err == nil {
+			thumbnailBytes.Add(name, data)
+		}
+	}
+	if err != nil {
+		logger.Debug("No cover for item %d: %v", id, err)
+		http.Error(w, "cover not available", http.StatusNotFound)
+		return
+	}
+
+	// The file name hashes the item path and modification time, so it doubles as a strong ETag
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(name, filepath.Ext(name))+`"`)
+	w.Header().Set("Content-Type", thumbnailType(name))
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(data))
+}
+
+// thumbnailCacheMaxBytes bounds thumbnailBytes
+const thumbnailCacheMaxBytes = 16 << 20
+
+// thumbnailBytes holds the thumbnails served by /api/thumbnail by file name, so
+// repeat requests don't read ThumbnailDir. A changed item gets a new file name,
+// and the old one is evicted once it's the least recently used.
+var thumbnailBytes = newPageCache(thumbnailCacheMaxBytes)
+
+// loadThumbnail reads the thumbnail base of item id, or its variant scaled to size
+func loadThumbnail(id int, base string, size int) ([]byte, error) {
+	name := base
+	if size != 0 {
+		var err error
+		if name, err = sizedThumbnail(id, base, size); err != nil {
+			return nil, err
+		}
+	}
+	return os.ReadFile(filepath.Join(configManager.Get().ThumbnailDir, name))
+}
+
+// handleCategories lists the categories with their item count and the cover of their first item
+func handleCategories(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT category, COUNT(*),
+		(SELECT id FROM library first WHERE first.category = l.category ORDER BY first.title LIMIT 1)
+		FROM library l GROUP BY category ORDER BY category`)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Query failed: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		categories []Category
+		coverIDs   []int
+	)
+	for rows.Next() {
+		var c Category
+		var id int
+		if err := rows.Scan(&c.Name, &c.Count, &id); err != nil {
+			logger.WithContext(r.Context()).Error("Scan error: %v", err)
+			continue
+		}
+		categories = append(categories, c)
+		coverIDs = append(coverIDs, id)
+	}
+	rows.Close()
+
+	// Covers are read after the rows are closed, as ensureThumbnail may write to the database
+	for i := range categories {
+		categories[i].Cover = inlineThumbnail(coverIDs[i])
+	}
+	if categories == nil {
+		categories = []Category{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(categories)
+}
+
+var (
+	// titleNoise matches bracketed years, scan groups and editions, as in "Saga 001 (2012) (Digital)"
+	titleNoise = regexp.MustCompile(`\s*[(\[][^)\]]*[)\]]`)
+
+	// titleIssue splits a title ending in an issue number, such as "Amazing Stories 001",
+	// "Batman #12", "Saga Vol 2" or "Time 2024-05", into series and issue
+	titleIssue = regexp.MustCompile(`(?i)^(.*?)[\s_.-]*(?:#|\bno\.?\s*|\bissue\s*|\bvol(?:ume)?\.?\s*)?(\d{4}-\d{2}(?:-\d{2})?|\d+(?:\.\d+)?)$`)
+)
+
+// itemSeries returns the series of an item and its issue in it: those of its
+// ComicInfo.xml, or else those read from its title. Titles without an issue
+// number belong to no series; titles that are only one, like "Vol 1", belong to
+// the series named by their folder.
+func itemSeries(item *LibraryItem) (name, issue string) {
+	if item.Series != "" {
+		return item.Series, item.IssueNumber
+	}
+	m := titleIssue.FindStringSubmatch(strings.TrimSpace(titleNoise.ReplaceAllString(item.Title, "")))
+	if m == nil {
+		return "", ""
+	}
+	name = strings.TrimSpace(strings.ReplaceAll(strings.Trim(m[1], " _.-"), "_", " "))
+	if name == "" {
+		name = item.Subcategory
+	}
+	return name, m[2]
+}
+
+// seriesKey folds the spellings of a series name that differ in case, spacing or underscores
+func seriesKey(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(strings.ReplaceAll(name, "_", " ")), " "))
+}
+
+// itemSeriesKey is the series_key scans store for an item with the given category, title
+// and ComicInfo series
+func itemSeriesKey(category, title, series string) string {
+	item := LibraryItem{Category: category, Subcategory: category[strings.LastIndex(category, "/")+1:], Title: title, Series: series}
+	name, _ := itemSeries(&item)
+	return seriesKey(name)
+}
+
+// fillSeriesKeys computes the series keys left NULL: those of items from before
+// migration 20, renamed, moved or imported ones, and rescanned items with a user-edited title
+func fillSeriesKeys(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, category, title, series FROM library WHERE series_key IS NULL")
+	if err != nil {
+		return err
+	}
+	keys := make(map[int]string)
+	for rows.Next() {
+		var (
+			id                      int
+			category, title, series string
+		)
+		if err := rows.Scan(&id, &category, &title, &series); err != nil {
+			rows.Close()
+			return err
+		}
+		keys[id] = itemSeriesKey(category, title, series)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(keys) == 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for id, key := range keys {
+		if _, err := tx.Exec("UPDATE library SET series_key=? WHERE id=?", key, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// handleSeries groups the library into series across categories, sorted by name.
+// With name it returns only that series, or 404 when no item belongs to it.
+func handleSeries(w http.ResponseWriter, r *http.Request) {
+	want := seriesKey(r.URL.Query().Get("name"))
+	where := " WHERE l.series_key != ''"
+	var args []interface{}
+	if want != "" {
+		where += " AND l.series_key = ?"
+		args = append(args, want)
+	}
+
+	rows, err := db.Query("SELECT l.series_key, COUNT(*) FROM library l"+where+" GROUP BY l.series_key ORDER BY l.series_key", args...)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to query series: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	var keys []string
+	counts := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			logger.WithContext(r.Context()).Error("Scan error: %v", err)
+			continue
+		}
+		keys = append(keys, key)
+		counts[key] = count
+	}
+	rows.Close()
+
+	if want != "" && len(keys) == 0 {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	items, err := queryLibraryItems("SELECT "+libraryColumns+" FROM "+libraryFrom+where+" ORDER BY l.title", args...)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to query series: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	type issue struct {
+		number string
+		item   LibraryItem
+	}
+	names := make(map[string]string)
+	shelves := make(map[string][]issue)
+	for _, item := range items {
+		name, number := itemSeries(&item)
+		if _, ok := names[item.seriesKey]; !ok {
+			names[item.seriesKey] = name
+		}
+		shelves[item.seriesKey] = append(shelves[item.seriesKey], issue{number, item})
+	}
+
+	series := []Series{}
+	for _, key := range keys {
+		issues := shelves[key]
+		if len(issues) == 0 {
+			continue // removed since the count was taken
+		}
+		sort.SliceStable(issues, func(i, j int) bool { return naturalLess(issues[i].number, issues[j].number) })
+		s := Series{Name: names[key], Count: counts[key], Issues: make([]LibraryItem, len(issues))}
+		for i, is := range issues {
+			s.Issues[i] = is.item
+		}
+		series = append(series, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(series)
+}
+
+// RefreshProgress is sent as a server-sent event while /api/refresh scans
+type RefreshProgress struct {
+	Scanned int64 `json:"scanned"`
+	Total   int64 `json:"total"`
+}
+
+// ScanSummary counts what a scan changed in the library
+type ScanSummary struct {
+	New     int `json:"new"`
+	Updated int `json:"updated"`
+	Removed int `json:"removed"`
+
+	// Library paths that couldn't be read; their entries were kept as they were
+	Unavailable []string `json:"unavailable,omitempty"`
+}
+
+// RefreshDone is the last event of /api/refresh
+type RefreshDone struct {
+	Done bool `json:"done"`
+	ScanSummary
+}
+
+// ConvertProgress is sent as a server-sent event while /api/convert writes a CBZ
+type ConvertProgress struct {
+	Converted int64 `json:"converted"`
+	Total     int64 `json:"total"`
+}
+
+// ConvertDone is the last event of /api/convert
+type ConvertDone struct {
+	Done  bool   `json:"done"`
+	Path  string `json:"path,omitempty"`  // the new CBZ
+	Error string `json:"error,omitempty"` // set instead of Path when the conversion failed
+}
+
+// startRefresh claims the refreshing flag, reporting false if a refresh already runs
+func startRefresh() bool {
+	refreshMu.Lock()
+	defer refreshMu.Unlock()
+	if refreshing {
+		return false
+	}
+	refreshing = true
+	return true
+}
+
+func endRefresh() {
+	refreshMu.Lock()
+	refreshing = false
+	refreshMu.Unlock()
+}
+
+// handleRefresh rescans the library now and streams its progress as server-sent events
+func handleRefresh(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !startRefresh() {
+		http.Error(w, "refresh already in progress", http.StatusConflict)
+		return
+	}
+
+	// The stream only observes the scan: a client disconnecting leaves it running
+	progress := newProgressReporter()
+	go func() {
+		defer endRefresh()
+		buildCacheWithProgress(serverCtx, progress)
+	}()
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		logger.Debug("Cannot lift write deadline: %v", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	send := func(v interface{}) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		rc.Flush()
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-progress.done:
+			send(RefreshDone{Done: true, ScanSummary: progress.summary})
+			return
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			send(RefreshProgress{Scanned: progress.scanned.Load(), Total: progress.total.Load()})
+		}
+	}
+}
+
+// handleRescan rescans the library, or with id only that item, and returns a ScanSummary.
+// A single item is reprocessed even when unchanged, which regenerates its cover.
+func handleRescan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var path string
+	if v := r.URL.Query().Get("id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		if err := db.QueryRow("SELECT path FROM library WHERE id=?", id).Scan(&path); err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	if !startRefresh() {
+		http.Error(w, "refresh already in progress", http.StatusConflict)
+		return
+	}
+	defer endRefresh()
+
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logger.Debug("Cannot lift write deadline: %v", err)
+	}
+
+	var summary ScanSummary
+	if path != "" {
+		summary = rescanItem(path)
+	} else {
+		progress := newProgressReporter()
+		buildCacheWithProgress(r.Context(), progress)
+		summary = progress.summary
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// rescanItem reprocesses one library entry, or removes it if it is gone
+func rescanItem(path string) ScanSummary {
+	scanMu.Lock()
+	defer scanMu.Unlock()
+
+	// An empty previous lastModified makes the processors treat the entry as changed
+	scan := newScanState(map[string]string{path: ""})
+	result := processPath(path, scan)
+	scan.commit()
+	if result == scanUpdated {
+		return ScanSummary{Updated: 1}
+	}
+	if !scan.seen[path] {
+		if err := removeEntry(path); err != nil {
+			logger.Error("Failed to delete entry: %v", err)
+			return ScanSummary{}
+		}
+		pruneThumbnails()
+		return ScanSummary{Removed: 1}
+	}
+	return ScanSummary{}
+}
+
+// converting holds the IDs of the items /api/convert is working on
+var converting sync.Map
+
+// handleConvert repackages a CBR item as a CBZ next to it and streams its progress as
+// server-sent events. The entry then points at the CBZ, keeping its reading progress,
+// statistics and favorite; the CBR stays on disk but is excluded from scans.
+func handleConvert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	var path string
+	if err := db.QueryRow("SELECT path FROM library WHERE id=?", id).Scan(&path); err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if !isPathAllowed(path) {
+		logger.WithContext(r.Context()).Error("Unauthorized convert attempt: %s", path)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !strings.EqualFold(filepath.Ext(path), ".cbr") {
+		http.Error(w, "only cbr items can be converted", http.StatusBadRequest)
+		return
+	}
+	target := strings.TrimSuffix(path, filepath.Ext(path)) + ".cbz"
+	if _, err := os.Stat(target); err == nil {
+		http.Error(w, "cbz already exists", http.StatusConflict)
+		return
+	}
+	if _, busy := converting.LoadOrStore(id, struct{}{}); busy {
+		http.Error(w, "conversion already in progress", http.StatusConflict)
+		return
+	}
+	defer converting.Delete(id)
+
+	var total int64
+	if _, pages, err := cachedItemPages(path, false); err == nil {
+		total = int64(len(pages))
+	}
+
+	// Disconnecting cancels the conversion, and the handler returns only once it has stopped
+	var converted atomic.Int64
+	done := make(chan error, 1)
+	go func() { done <- convertCBR(r.Context(), path, target, &converted) }()
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		logger.Debug("Cannot lift write deadline: %v", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	send := func(v interface{}) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		rc.Flush()
+	}
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				logger.WithContext(r.Context()).Error("Failed to convert %s: %v", path, err)
+				send(ConvertDone{Done: true, Error: "conversion failed"})
+				return
+			}
+			logger.Info("Converted %s to CBZ", path)
+			rescanItem(target)
+			send(ConvertDone{Done: true, Path: target})
+			return
+		case <-ticker.C:
+			send(ConvertProgress{Converted: converted.Load(), Total: total})
+		}
+	}
+}
+
+// convertCBR writes the pages of the CBR at src to a new CBZ at dst and moves the
+// library entry over to it. The CBZ is written under a temporary name scans ignore.
+func convertCBR(ctx context.Context, src, dst string, converted *atomic.Int64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	zw := zip.NewWriter(tmp)
+	err = zipFromCBR(ctx, zw, src, converted)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Hold off scans until the entry points at the CBZ, so they don't add it as a new item
+	scanMu.Lock()
+	defer scanMu.Unlock()
+
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT OR IGNORE INTO excluded (path) VALUES (?)", src); err != nil {
+		return err
+	}
+	// An empty lastModified makes the next scan of the CBZ read it in full
+	if _, err := tx.Exec("UPDATE library SET path=?, lastModified='' WHERE path=?", dst, src); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// archiveTypes maps the extensions of downloadable files to their content type
+var archiveTypes = map[string]string{
+	".cbz":  "application/vnd.comicbook+zip",
+	".cbr":  "application/vnd.comicbook-rar",
+	".cb7":  "application/x-cb7",
+	".cbt":  "application/x-cbt",
+	".pdf":  "application/pdf",
+	".epub": "application/epub+zip",
+}
+
+// handleDownload sends an item for offline reading: the file itself, or the pages of an image folder zipped into a CBZ
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	var path, title string
+	if err := db.QueryRow("SELECT path, title FROM library WHERE id=?", id).Scan(&path, &title); err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if !isPathAllowed(path) {
+		logger.WithContext(r.Context()).Error("Unauthorized download attempt: %s", path)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Large archives take longer than the server's write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logger.Debug("Cannot lift write deadline: %v", err)
+	}
+
+	// Archives are sent as they are; ServeFile answers Range requests, so these downloads can be resumed
+	ext := strings.ToLower(filepath.Ext(path))
+	if contentType, ok := archiveTypes[ext]; ok {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": title + ext}))
+		http.ServeFile(w, r, path)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": title + ".cbz"}))
+
+	zw := zip.NewWriter(w)
+	err = zipFromDirectory(zw, path)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		// The headers are already sent; the client gets a truncated archive
+		logger.WithContext(r.Context()).Error("Download of %s failed: %v", path, err)
+	}
+}
+
+// zipFromCBR recompresses the entries of a CBR, counting them in written if it isn't nil.
+// Cancelling ctx stops it between entries.
+func zipFromCBR(ctx context.Context, zw *zip.Writer, cbrPath string, written *atomic.Int64) error {
+	f, err := os.Open(cbrPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rr, err := rardecode.NewReader(f, resolvePassword(cbrPath))
+	if err != nil {
+		return err
+	}
+	for {
+		h, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.IsDir || isJunkEntry(h.Name) || !isSafeEntryName(h.Name) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := addZipEntry(zw, h.Name, h.ModificationTime, rr); err != nil {
+			return err
+		}
+		if written != nil {
+			written.Add(1)
+		}
+	}
+}
+
+// zipFromDirectory compresses the page images of a directory item
+func zipFromDirectory(zw *zip.Writer, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") || !isImageFile(strings.ToLower(e.Name())) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		err = addZipEntry(zw, e.Name(), info.ModTime(), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addZipEntry compresses one file into zw
+func addZipEntry(zw *zip.Writer, name string, modTime time.Time, r io.Reader) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// inlineThumbnail returns the thumbnail of an item as a data URI, or "" if it has none
+func inlineThumbnail(id int) string {
+	name, err := ensureThumbnail(id)
+	if err != nil {
+		return ""
+	}
+	return thumbnailDataURI(name)
+}
+
+// thumbnailDataURI reads a file of the thumbnail cache as a data URI, "" if it isn't there
+func thumbnailDataURI(name string) string {
+	if name == "" {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(configManager.Get().ThumbnailDir, name))
+	if err != nil {
+		return ""
+	}
+	return "data:" + thumbnailType(name) + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// ensureThumbnail returns the thumbnail file name of an item, creating the file if needed.
+// Rows from older versions that still hold an inline coverData are moved to the cache here.
+func ensureThumbnail(id int) (string, error) {
+	var path, cover, thumbnail, coverData, lastMod string
+	err := db.QueryRow("SELECT path, cover, COALESCE(thumbnail, ''), COALESCE(coverData, ''), lastModified FROM library WHERE id=?", id).
+		Scan(&path, &cover, &thumbnail, &coverData, &lastMod)
+	if err != nil {
+		return "", err
+	}
+
+	// Thumbnails written in another format than the configured one are regenerated
+	format := configManager.Get().ThumbnailFormat
+	if thumbnail != "" && filepath.Ext(thumbnail) == thumbnailFormats[format].ext {
+		if _, err := os.Stat(filepath.Join(configManager.Get().ThumbnailDir, thumbnail)); err == nil {
+			return thumbnail, nil
+		}
+	}
+
+	// Inline covers of older versions are JPEG, so they are only reused for JPEG thumbnails
+	name := thumbnailName(path, lastMod, ".jpg")
+	if _, data, ok := strings.Cut(coverData, "base64,"); ok && format == "jpeg" {
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return "", fmt.Errorf("invalid inline cover: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(configManager.Get().ThumbnailDir, name), raw, 0o644); err != nil {
+			return "", fmt.Errorf("failed to write thumbnail: %w", err)
+		}
+	} else {
+		thumbSemaphore <- struct{}{}
+		img, err := loadCoverImage(path, cover)
+		if err == nil {
+			name, err = saveThumbnail(path, lastMod, img)
+		}
+		<-thumbSemaphore
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := db.Exec("UPDATE library SET thumbnail=?, coverData='' WHERE id=?", name, id); err != nil {
+		logger.Error("Failed to store thumbnail: %v", err)
+	}
+	return name, nil
+}
+
+// prewarmThumbnails generates the thumbnails of items with pages that are missing or
+// in another format than ThumbnailFormat, such as after an upgrade, until ctx is done
+func prewarmThumbnails(ctx context.Context) {
+	ext := thumbnailFormats[configManager.Get().ThumbnailFormat].ext
+	rows, err := db.QueryContext(ctx, "SELECT id FROM library WHERE page_count > 0 AND (COALESCE(thumbnail, '') = '' OR thumbnail NOT LIKE ?)", "%"+ext)
+	if err != nil {
+		logger.Error("Failed to query missing thumbnails: %v", err)
+		return
+	}
+	var ids []int
 	for rows.Next() {
-		var path, mod string
-		rows.Scan(&path, &mod)
-		existing[path] = mod
+		var id int
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return
+	}
+
+	logger.Info("🖼️ Generating %d missing thumbnails", len(ids))
+	failed := 0
+	for i, id := range ids {
+		if ctx.Err() != nil {
+			logger.Info("Thumbnail generation stopped after %d of %d", i, len(ids))
+			return
+		}
+		if _, err := ensureThumbnail(id); err != nil {
+			logger.Debug("No cover for item %d: %v", id, err)
+			failed++
+		}
+		if (i+1)%50 == 0 {
+			logger.Info("Generated thumbnails: %d/%d", i+1, len(ids))
+		}
+	}
+	logger.Info("✅ Thumbnails generated — %d without a cover", failed)
+}
+
+// thumbnailSizes are the sizes /api/thumbnail generates, so each item has at most
+// this many variants on disk whatever sizes clients ask for
+var thumbnailSizes = []int{50, 100, 200, 300, 400, 600, 800, 1200}
+
+// thumbnailSize rounds a requested thumbnail size up to the next of thumbnailSizes,
+// or down to the largest
+func thumbnailSize(size int) int {
+	for _, s := range thumbnailSizes {
+		if size <= s {
+			return s
+		}
+	}
+	return thumbnailSizes[len(thumbnailSizes)-1]
+}
+
+// sizedThumbnailName is the file name of the variant of thumbnail name scaled to size
+func sizedThumbnailName(name string, size int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), size, ext)
+}
+
+// sizedThumbnail returns the cached variant of an item's thumbnail scaled to size,
+// generating it from the cover on first use. It is named after the thumbnail, so
+// it is replaced and pruned along with it.
+func sizedThumbnail(id int, name string, size int) (string, error) {
+	sized := sizedThumbnailName(name, size)
+	cfg := configManager.Get()
+	if _, err := os.Stat(filepath.Join(cfg.ThumbnailDir, sized)); err == nil {
+		return sized, nil
+	}
+
+	var path, cover string
+	if err := db.QueryRow("SELECT path, cover FROM library WHERE id=?", id).Scan(&path, &cover); err != nil {
+		return "", err
+	}
+
+	thumbSemaphore <- struct{}{}
+	defer func() { <-thumbSemaphore }()
+
+	img, err := loadCoverImage(path, cover)
+	if err != nil {
+		return "", err
+	}
+	data, err := imageToThumbnail(img, size, cfg.ThumbnailScaleMode, thumbnailBackground(), cfg.ThumbnailFormat, cfg.ThumbnailQuality)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(cfg.ThumbnailDir, sized), data, 0o644); err != nil {
+		return "", fmt.Errorf("failed to write thumbnail: %w", err)
+	}
+	return sized, nil
+}
+
+// pruneThumbnails removes cached thumbnails no library item refers to anymore
+func pruneThumbnails() {
+	dir := configManager.Get().ThumbnailDir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Error("Failed to read thumbnail directory: %v", err)
+		return
+	}
+
+	used := make(map[string]bool)
+	rows, err := db.Query("SELECT thumbnail FROM library WHERE thumbnail != ''")
+	if err != nil {
+		logger.Error("Failed to query thumbnails: %v", err)
+		return
+	}
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		used[name] = true
+	}
+	rows.Close()
+
+	for _, e := range entries {
+		// Sized variants are kept as long as their thumbnail is, unless their size
+		// isn't one of thumbnailSizes anymore
+		name, keep := e.Name(), true
+		if base, size, ok := strings.Cut(strings.TrimSuffix(name, filepath.Ext(name)), "-"); ok {
+			name = base + filepath.Ext(name)
+			n, err := strconv.Atoi(size)
+			keep = err == nil && slices.Contains(thumbnailSizes, n)
+		}
+
+		info, err := e.Info()
+		// Skip fresh files that may belong to a cover being generated right now
+		if err != nil || used[name] && keep || time.Since(info.ModTime()) < time.Minute {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			logger.Debug("Failed to remove thumbnail %s: %v", e.Name(), err)
+		}
+	}
+}
+
+// PageInfo is a page of /api/pages?metadata=1. The size is 0x0 when the image header can't be read.
+type PageInfo struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// PageSize is the pixel size of a page, as stored in the pages table
+type PageSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// PagesError is the body of a failed /api/pages request
+type PagesError struct {
+	Error  string `json:"error"`
+	Status string `json:"status"` // corrupt or unreadable, as in LibraryItem
+	Reason string `json:"reason"`
+}
+
+// pagesError explains why an item's pages can't be listed
+func pagesError(w http.ResponseWriter, err error) {
+	body := PagesError{Error: "cannot read pages", Status: archiveStatus(err), Reason: err.Error()}
+	code := http.StatusUnprocessableEntity
+	switch {
+	case isPasswordError(err):
+		body.Reason = errArchiveLocked.Error()
+		code = http.StatusForbidden
+	case body.Status == statusUnreadable:
+		code = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// handlePages returns the page URLs of an item; nocache=1 rereads the archive and
+// metadata=1 adds the size of each page
+func handlePages(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	id, err := strconv.Atoi(params.Get("id"))
+	if err != nil {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+
+	var path string
+	err = db.QueryRow("SELECT path FROM library WHERE id=?", id).Scan(&path)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Failed to find library item: %v", err)
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	param, pages, err := cachedItemPages(path, params.Get("nocache") == "1")
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Cannot read pages of %s: %v", path, err)
+		pagesError(w, err)
+		return
+	}
+
+	// Image folders list the files themselves, archives link to /media
+	urls := pages
+	if param != "path" {
+		urls = nil
+		for _, p := range pages {
+			urls = append(urls, fmt.Sprintf("/media?%s=%s&page=%s",
+				param, url.QueryEscape(path), url.QueryEscape(p)))
+		}
+	}
+
+	var body interface{} = urls
+	if params.Get("metadata") == "1" {
+		sizes, err := cachedPageSizes(path, param, pages)
+		if err != nil {
+			logger.WithContext(r.Context()).Error("Cannot read page sizes of %s: %v", path, err)
+			pagesError(w, err)
+			return
+		}
+		infos := make([]PageInfo, len(urls))
+		for i, u := range urls {
+			infos[i] = PageInfo{URL: u, Width: sizes[i].Width, Height: sizes[i].Height}
+		}
+		body = infos
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	json.NewEncoder(w).Encode(body)
+}
+
+// getImagesFromDirectory lists the image files of a directory in reading order
+func getImagesFromDirectory(dirPath string) ([]string, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var pages []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := strings.ToLower(e.Name())
+		if isImageFile(name) && !strings.HasPrefix(e.Name(), ".") && !isCoverSidecar(name) {
+			pages = append(pages, filepath.Join(dirPath, e.Name()))
+		}
+	}
+
+	sort.Slice(pages, func(i, j int) bool {
+		return naturalLess(filepath.Base(pages[i]), filepath.Base(pages[j]))
+	})
+	return pages, nil
+}
+
+// OPDS 1.2 catalog, see https://specs.opds.io/opds-1.2
+const (
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+)
+
+// OPDSFeed is an Atom feed of the OPDS catalog
+type OPDSFeed struct {
+	XMLName   xml.Name    `xml:"feed"`
+	Xmlns     string      `xml:"xmlns,attr"`
+	XmlnsOPDS string      `xml:"xmlns:opds,attr"`
+	XmlnsPSE  string      `xml:"xmlns:pse,attr"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Links     []OPDSLink  `xml:"link"`
+	Entries   []OPDSEntry `xml:"entry"`
+}
+
+// OPDSEntry is a category or a library item in an OPDS feed
+type OPDSEntry struct {
+	ID      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Author  *OPDSAuthor  `xml:"author,omitempty"`
+	Content *OPDSContent `xml:"content,omitempty"`
+	Links   []OPDSLink   `xml:"link"`
+}
+
+// OPDSAuthor names the writer of an item
+type OPDSAuthor struct {
+	Name string `xml:"name"`
+}
+
+// OPDSContent is the text shown with an entry
+type OPDSContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// OPDSLink points from a feed or entry to another resource
+type OPDSLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr,omitempty"`
+
+	// Page count of an OPDS-PSE stream link
+	Count int `xml:"pse:count,attr,omitempty"`
+}
+
+// newOPDSFeed creates a feed with the links every catalog page carries
+func newOPDSFeed(id, title, self, selfType string) OPDSFeed {
+	return OPDSFeed{
+		Xmlns:     "http://www.w3.org/2005/Atom",
+		XmlnsOPDS: "http://opds-spec.org/2010/catalog",
+		XmlnsPSE:  "http://vaemendis.net/opds-pse/ns",
+		ID:        id,
+		Title:     title,
+		Updated:   time.Now().UTC().Format(time.RFC3339),
+		Links: []OPDSLink{
+			{Rel: "self", Href: self, Type: selfType},
+			{Rel: "start", Href: "/opds", Type: opdsNavigationType},
+		},
+	}
+}
+
+// writeOPDS sends an OPDS feed with the given catalog kind
+func writeOPDS(w http.ResponseWriter, r *http.Request, feed OPDSFeed, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		logger.WithContext(r.Context()).Error("Failed to write OPDS feed: %v", err)
+	}
+}
+
+// handleOPDS serves the root navigation feed: all items, then one entry per category
+func handleOPDS(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/opds" {
+		http.NotFound(w, r)
+		return
+	}
+
+	feed := newOPDSFeed("urn:magz:root", "Magz", "/opds", opdsNavigationType)
+	feed.Entries = append(feed.Entries, OPDSEntry{
+		ID:      "urn:magz:all",
+		Title:   "All items",
+		Updated: feed.Updated,
+		Links:   []OPDSLink{{Rel: "subsection", Href: "/opds/items", Type: opdsAcquisitionType}},
+	})
+
+	rows, err := db.Query("SELECT category, COUNT(*) FROM library GROUP BY category ORDER BY category")
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Query failed: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var count int
+		if err := rows.Scan(&name, &count); err != nil {
+			logger.WithContext(r.Context()).Error("Scan error: %v", err)
+			continue
+		}
+		feed.Entries = append(feed.Entries, OPDSEntry{
+			ID:      "urn:magz:category:" + url.PathEscape(name),
+			Title:   name,
+			Updated: feed.Updated,
+			Content: &OPDSContent{Type: "text", Text: fmt.Sprintf("%d items", count)},
+			Links: []OPDSLink{{Rel: "subsection", Href: "/opds/items?category=" + url.QueryEscape(name),
+				Type: opdsAcquisitionType}},
+		})
+	}
+
+	writeOPDS(w, r, feed, opdsNavigationType)
+}
+
+// handleOPDSItems serves a paginated acquisition feed of all items, or those of one category
+func handleOPDSItems(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	page, ok := opdsPage(params)
+	if !ok {
+		http.Error(w, "invalid page", http.StatusBadRequest)
+		return
+	}
+
+	id, title := "urn:magz:all", "All items"
+	category := params.Get("category")
+	if params.Has("category") {
+		id, title = "urn:magz:category:"+url.PathEscape(category), category
+	}
+
+	items, total, err := queryOPDSItems(category, params.Has("category"), page)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Query failed: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
 	}
-	rows.Close()
 
-	newCount := 0
-	updatedCount := 0
-	seen := make(map[string]bool)
-	mu := sync.Mutex{}
+	pageURL := func(p int) string {
+		q := url.Values{}
+		if params.Has("category") {
+			q.Set("category", category)
+		}
+		if p > 1 {
+			q.Set("page", strconv.Itoa(p))
+		}
+		if len(q) == 0 {
+			return "/opds/items"
+		}
+		return "/opds/items?" + q.Encode()
+	}
 
-	// Use worker pool for parallel processing
-	var wg sync.WaitGroup
-	workChan := make(chan string, 100)
+	feed := newOPDSFeed(id, title, pageURL(page), opdsAcquisitionType)
+	feed.Links = append(feed.Links, OPDSLink{Rel: "up", Href: "/opds", Type: opdsNavigationType})
+	if page > 1 {
+		feed.Links = append(feed.Links, OPDSLink{Rel: "previous", Href: pageURL(page - 1), Type: opdsAcquisitionType})
+	}
+	if page*defaultPageLimit < total {
+		feed.Links = append(feed.Links, OPDSLink{Rel: "next", Href: pageURL(page + 1), Type: opdsAcquisitionType})
+	}
 
-	// Start workers
-	numWorkers := 4
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for path := range workChan {
-				processPath(path, existing, seen, &newCount, &updatedCount, &mu)
-			}
-		}()
+	imageType := thumbnailFormats[configManager.Get().ThumbnailFormat].mime
+	for _, item := range items {
+		feed.Entries = append(feed.Entries, opdsItemEntry(item, imageType))
 	}
 
-	// Walk directories and send to workers
-	for _, base := range config.LibraryPaths {
-		filepath.WalkDir(base, func(path string, d os.DirEntry, err error) error {
-			if err != nil {
-				return nil
-			}
-			workChan <- path
-			return nil
-		})
+	writeOPDS(w, r, feed, opdsAcquisitionType)
+}
+
+// opdsPage reads the one-based page number of a paginated feed
+func opdsPage(params url.Values) (int, bool) {
+	v := params.Get("page")
+	if v == "" {
+		return 1, true
 	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n >= 1
+}
 
-	close(workChan)
-	wg.Wait()
+// queryOPDSItems returns one page of all items, or of those in one category, and
+// how many there are in total
+func queryOPDSItems(category string, filter bool, page int) ([]LibraryItem, int, error) {
+	var (
+		where string
+		args  []interface{}
+	)
+	if filter {
+		where = " WHERE l.category = ?"
+		args = append(args, category)
+	}
 
-	// Remove deleted entries
-	deletedCount := 0
-	for path := range existing {
-		if !seen[path] {
-			_, err := db.Exec("DELETE FROM library WHERE path=?", path)
-			if err != nil {
-				logger.Error("Failed to delete entry: %v", err)
-			} else {
-				deletedCount++
-			}
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM library l"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	items, err := queryLibraryItems("SELECT "+libraryColumns+" FROM "+libraryFrom+where+" ORDER BY l.title LIMIT ? OFFSET ?",
+		append(args, defaultPageLimit, (page-1)*defaultPageLimit)...)
+	return items, total, err
+}
+
+// opdsItemEntry describes a library item with its cover, download and page streaming links
+func opdsItemEntry(item LibraryItem, imageType string) OPDSEntry {
+	entry := OPDSEntry{
+		ID:      fmt.Sprintf("urn:magz:item:%d", item.ID),
+		Title:   item.Title,
+		Updated: item.LastMod,
+		Links: []OPDSLink{
+			{Rel: "http://opds-spec.org/image", Href: item.CoverURL, Type: imageType},
+			{Rel: "http://opds-spec.org/image/thumbnail", Href: item.CoverURL, Type: imageType},
+		},
+	}
+	if item.Series != "" {
+		entry.Title = item.Series
+		if item.IssueNumber != "" {
+			entry.Title += " #" + item.IssueNumber
 		}
 	}
+	if item.Writer != "" {
+		entry.Author = &OPDSAuthor{Name: item.Writer}
+	}
+	if item.Summary != "" {
+		entry.Content = &OPDSContent{Type: "text", Text: item.Summary}
+	}
 
-	duration := time.Since(startTime)
-	logger.Info("✅ Cache updated in %v — %d new, %d updated, %d removed", duration, newCount, updatedCount, deletedCount)
+	entry.Links = append(entry.Links, OPDSLink{Rel: "http://opds-spec.org/acquisition",
+		Href: fmt.Sprintf("/api/download?id=%d", item.ID), Type: acquisitionType(item.Path)})
+
+	// OPDS-PSE lets readers fetch single pages; the client fills in {pageNumber}
+	if item.PageCount > 0 {
+		entry.Links = append(entry.Links, OPDSLink{Rel: "http://vaemendis.net/opds-pse/stream",
+			Href: fmt.Sprintf("/opds/pse?id=%d&page={pageNumber}", item.ID), Type: "image/jpeg", Count: item.PageCount})
+	}
+
+	return entry
 }
 
-// processPath handles individual path processing
-func processPath(path string, existing map[string]string, seen map[string]bool, newCount, updatedCount *int, mu *sync.Mutex) {
-	info, err := os.Stat(path)
+// OPDS 2.0 catalog, see https://drafts.opds.io/opds-2.0
+const (
+	opds2FeedType        = "application/opds+json"
+	opds2PublicationType = "application/opds-publication+json"
+)
+
+// OPDS2Feed is a JSON feed of the OPDS 2.0 catalog
+type OPDS2Feed struct {
+	Metadata     OPDS2Metadata      `json:"metadata"`
+	Links        []OPDS2Link        `json:"links"`
+	Navigation   []OPDS2Link        `json:"navigation,omitempty"`
+	Publications []OPDS2Publication `json:"publications,omitempty"`
+}
+
+// OPDS2Metadata describes a feed or a publication
+type OPDS2Metadata struct {
+	Type          string `json:"@type,omitempty"`
+	Identifier    string `json:"identifier,omitempty"`
+	Title         string `json:"title"`
+	Author        string `json:"author,omitempty"`
+	Publisher     string `json:"publisher,omitempty"`
+	Description   string `json:"description,omitempty"`
+	Modified      string `json:"modified,omitempty"`
+	NumberOfPages int    `json:"numberOfPages,omitempty"`
+
+	// Pagination of a feed
+	NumberOfItems int `json:"numberOfItems,omitempty"`
+	ItemsPerPage  int `json:"itemsPerPage,omitempty"`
+	CurrentPage   int `json:"currentPage,omitempty"`
+}
+
+// OPDS2Link points from a feed or publication to another resource
+type OPDS2Link struct {
+	Rel        string               `json:"rel,omitempty"`
+	Href       string               `json:"href"`
+	Type       string               `json:"type,omitempty"`
+	Title      string               `json:"title,omitempty"`
+	Properties *OPDS2LinkProperties `json:"properties,omitempty"`
+}
+
+// OPDS2LinkProperties tells how many items a navigation link leads to
+type OPDS2LinkProperties struct {
+	NumberOfItems int `json:"numberOfItems"`
+}
+
+// OPDS2Publication is a library item, with its pages as reading order in a full manifest
+type OPDS2Publication struct {
+	Metadata     OPDS2Metadata `json:"metadata"`
+	Links        []OPDS2Link   `json:"links"`
+	Images       []OPDS2Link   `json:"images,omitempty"`
+	ReadingOrder []OPDS2Link   `json:"readingOrder,omitempty"`
+}
+
+// writeOPDS2 sends an OPDS 2.0 feed or publication
+func writeOPDS2(w http.ResponseWriter, r *http.Request, v interface{}, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.WithContext(r.Context()).Error("Failed to write OPDS feed: %v", err)
+	}
+}
+
+// handleOPDS2 serves the root feed, navigating to all items and to each category
+func handleOPDS2(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query("SELECT category, COUNT(*) FROM library GROUP BY category ORDER BY category")
 	if err != nil {
+		logger.WithContext(r.Context()).Error("Query failed: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
+	defer rows.Close()
 
-	lower := strings.ToLower(info.Name())
+	feed := OPDS2Feed{
+		Metadata: OPDS2Metadata{Title: "Magz"},
+		Links: []OPDS2Link{
+			{Rel: "self", Href: "/opds/v2", Type: opds2FeedType},
+			{Rel: "start", Href: "/opds/v2", Type: opds2FeedType},
+		},
+	}
 
-	// Handle CBZ files
-	if strings.HasSuffix(lower, ".cbz") {
-		mu.Lock()
-		n, u := processCBZ(path, existing, seen, *newCount, *updatedCount)
-		*newCount = n
-		*updatedCount = u
-		mu.Unlock()
-		return
+	var total int
+	for rows.Next() {
+		var name string
+		var count int
+		if err := rows.Scan(&name, &count); err != nil {
+			logger.WithContext(r.Context()).Error("Scan error: %v", err)
+			continue
+		}
+		total += count
+		feed.Navigation = append(feed.Navigation, OPDS2Link{Rel: "subsection", Title: name, Type: opds2FeedType,
+			Href: "/opds/v2/category?name=" + url.QueryEscape(name), Properties: &OPDS2LinkProperties{NumberOfItems: count}})
 	}
+	feed.Navigation = append([]OPDS2Link{{Rel: "subsection", Title: "All items", Href: "/opds/v2/category",
+		Type: opds2FeedType, Properties: &OPDS2LinkProperties{NumberOfItems: total}}}, feed.Navigation...)
 
-	// Handle CBR files
-	if strings.HasSuffix(lower, ".cbr") {
-		mu.Lock()
-		n, u := processCBR(path, existing, seen, *newCount, *updatedCount)
-		*newCount = n
-		*updatedCount = u
-		mu.Unlock()
+	writeOPDS2(w, r, feed, opds2FeedType)
+}
+
+// handleOPDS2Category serves a paginated feed of all publications, or those of one category
+func handleOPDS2Category(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	page, ok := opdsPage(params)
+	if !ok {
+		http.Error(w, "invalid page", http.StatusBadRequest)
 		return
 	}
 
-	// Handle directories with images
-	if !info.IsDir() {
-		return
+	title := "All items"
+	name := params.Get("name")
+	if params.Has("name") {
+		title = name
 	}
 
-	entries, err := os.ReadDir(path)
+	items, total, err := queryOPDSItems(name, params.Has("name"), page)
 	if err != nil {
+		logger.WithContext(r.Context()).Error("Query failed: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	var pages []string
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
+	pageURL := func(p int) string {
+		q := url.Values{}
+		if params.Has("name") {
+			q.Set("name", name)
 		}
-		name := strings.ToLower(e.Name())
-		if isImageFile(name) && !strings.HasPrefix(e.Name(), ".") {
-			pages = append(pages, e.Name())
+		if p > 1 {
+			q.Set("page", strconv.Itoa(p))
 		}
+		if len(q) == 0 {
+			return "/opds/v2/category"
+		}
+		return "/opds/v2/category?" + q.Encode()
 	}
 
-	if len(pages) == 0 {
+	feed := OPDS2Feed{
+		Metadata: OPDS2Metadata{Title: title, NumberOfItems: total, ItemsPerPage: defaultPageLimit, CurrentPage: page},
+		Links: []OPDS2Link{
+			{Rel: "self", Href: pageURL(page), Type: opds2FeedType},
+			{Rel: "start", Href: "/opds/v2", Type: opds2FeedType},
+			{Rel: "up", Href: "/opds/v2", Type: opds2FeedType},
+		},
+		Publications: []OPDS2Publication{},
+	}
+	if page > 1 {
+		feed.Links = append(feed.Links, OPDS2Link{Rel: "previous", Href: pageURL(page - 1), Type: opds2FeedType})
+	}
+	if page*defaultPageLimit < total {
+		feed.Links = append(feed.Links, OPDS2Link{Rel: "next", Href: pageURL(page + 1), Type: opds2FeedType})
+	}
+
+	imageType := thumbnailFormats[configManager.Get().ThumbnailFormat].mime
+	for _, item := range items {
+		feed.Publications = append(feed.Publications, opds2Publication(item, imageType))
+	}
+
+	writeOPDS2(w, r, feed, opds2FeedType)
+}
+
+// handleOPDS2Item serves the manifest of a publication, listing its pages in reading order
+func handleOPDS2Item(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "missing id", http.StatusBadRequest)
 		return
 	}
 
-	sort.Slice(pages, func(i, j int) bool { return naturalLess(pages[i], pages[j]) })
+	item, err := queryLibraryItem(id)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Query failed: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if item == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
 
-	cover := selectCoverImage(pages)
-	coverPath := filepath.Join(path, cover)
-	lastMod := info.ModTime().Format(time.RFC3339)
+	_, pages, err := cachedItemPages(item.Path, false)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Cannot read pages of %s: %v", item.Path, err)
+		pagesError(w, err)
+		return
+	}
 
-	mu.Lock()
-	prevMod, exists := existing[path]
-	seen[path] = true
-	mu.Unlock()
+	publication := opds2Publication(*item, thumbnailFormats[configManager.Get().ThumbnailFormat].mime)
+	publication.ReadingOrder = []OPDS2Link{}
+	for i, page := range pages {
+		publication.ReadingOrder = append(publication.ReadingOrder, OPDS2Link{
+			Href: fmt.Sprintf("/opds/pse?id=%d&page=%d", item.ID, i), Type: imageContentType(page)})
+	}
+	publication.Metadata.NumberOfPages = len(pages)
 
-	category := filepath.Base(filepath.Dir(path))
-	title := filepath.Base(path)
+	writeOPDS2(w, r, publication, opds2PublicationType)
+}
 
-	coverData := ""
-	if !exists || prevMod != lastMod {
-		// Use semaphore to limit concurrent thumbnail generation
-		thumbSemaphore <- struct{}{}
-		if data, err := generateThumbnailBase64(coverPath); err == nil {
-			coverData = data
-		} else {
-			logger.Debug("Failed to generate thumbnail for %s: %v", coverPath, err)
+// opds2Publication describes a library item with its cover, manifest and download links
+func opds2Publication(item LibraryItem, imageType string) OPDS2Publication {
+	publication := OPDS2Publication{
+		Metadata: OPDS2Metadata{
+			Type:          "http://schema.org/Book",
+			Identifier:    fmt.Sprintf("urn:magz:item:%d", item.ID),
+			Title:         item.Title,
+			Author:        item.Writer,
+			Publisher:     item.Publisher,
+			Description:   item.Summary,
+			Modified:      item.LastMod,
+			NumberOfPages: item.PageCount,
+		},
+		Links: []OPDS2Link{
+			{Rel: "self", Href: fmt.Sprintf("/opds/v2/item?id=%d", item.ID), Type: opds2PublicationType},
+		},
+		Images: []OPDS2Link{{Href: item.CoverURL, Type: imageType}},
+	}
+	if item.Series != "" {
+		publication.Metadata.Title = item.Series
+		if item.IssueNumber != "" {
+			publication.Metadata.Title += " #" + item.IssueNumber
 		}
-		<-thumbSemaphore
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	publication.Links = append(publication.Links, OPDS2Link{Rel: "http://opds-spec.org/acquisition",
+		Href: fmt.Sprintf("/api/download?id=%d", item.ID), Type: acquisitionType(item.Path)})
 
-	if exists {
-		if prevMod != lastMod {
-			_, err := db.Exec(`UPDATE library SET category=?, title=?, cover=?, coverData=?, lastModified=?, updated_at=CURRENT_TIMESTAMP WHERE path=?`,
-				category, title, cover, coverData, lastMod, path)
+	return publication
+}
+
+// acquisitionType is the content type /api/download sends an item as: that of
+// its archive, or CBZ for image folders
+func acquisitionType(path string) string {
+	if contentType, ok := archiveTypes[strings.ToLower(filepath.Ext(path))]; ok {
+		return contentType
+	}
+	return "application/vnd.comicbook+zip"
+}
+
+// mediaParam returns the /media parameter for an item's format, "path" for image folders
+func mediaParam(path string) string {
+	lower := strings.ToLower(path)
+	for _, ext := range []string{"cbz", "cbr", "cb7", "cbt", "pdf", "epub"} {
+		if strings.HasSuffix(lower, "."+ext) {
+			return ext
+		}
+	}
+	return "path"
+}
+
+// itemPages returns the /media parameter naming an item's format and its page names
+func itemPages(path string) (string, []string, error) {
+	var (
+		pages []string
+		err   error
+	)
+	param := mediaParam(path)
+	switch param {
+	case "cbz":
+		pages, err = getImagesFromCBZ(path)
+	case "cbr":
+		pages, err = getImagesFromCBR(path)
+	case "cb7":
+		pages, err = getImagesFromCB7(path)
+	case "cbt":
+		pages, err = getImagesFromCBT(path)
+	case "pdf":
+		pages, err = getImagesFromPDF(path)
+	case "epub":
+		pages, err = getImagesFromEPUB(path)
+	default:
+		pages, err = getImagesFromDirectory(path)
+	}
+	return param, pages, err
+}
+
+// cachedItemPages is itemPages using the page lists stored in the pages table.
+// Image folders are cheap to list and always read from disk.
+func cachedItemPages(path string, refresh bool) (string, []string, error) {
+	param := mediaParam(path)
+	if param != "path" && !refresh {
+		var data, modTime string
+		err := db.QueryRow("SELECT pages_json, mod_time FROM pages WHERE item_id = (SELECT id FROM library WHERE path=?)", path).Scan(&data, &modTime)
+		// A list read before the archive last changed is stale
+		if err == nil && modTime == archiveModTime(path) {
+			var pages []string
+			if err := json.Unmarshal([]byte(data), &pages); err == nil {
+				pageListCacheLookups.WithLabelValues("hit").Inc()
+				return param, pages, nil
+			}
+		}
+		pageListCacheLookups.WithLabelValues("miss").Inc()
+	}
+
+	param, pages, err := itemPages(path)
+	if err == nil && param != "path" {
+		storePageList(path, pages)
+	}
+	return param, pages, err
+}
+
+// cachedPageSizes returns the sizes of an item's pages, in the order of pages. Archive
+// sizes are stored next to their page list, so they are read again whenever the list is.
+func cachedPageSizes(path, param string, pages []string) ([]PageSize, error) {
+	if param == "path" {
+		return readPageSizes(path, param, pages)
+	}
+
+	modTime := archiveModTime(path)
+	var data, storedModTime string
+	err := db.QueryRow("SELECT COALESCE(sizes_json, ''), mod_time FROM pages WHERE item_id = (SELECT id FROM library WHERE path=?)", path).Scan(&data, &storedModTime)
+	if err == nil && storedModTime == modTime && data != "" {
+		var sizes []PageSize
+		if err := json.Unmarshal([]byte(data), &sizes); err == nil && len(sizes) == len(pages) {
+			return sizes, nil
+		}
+	}
+
+	sizes, err := readPageSizes(path, param, pages)
+	if err != nil {
+		return nil, err
+	}
+	encoded, _ := json.Marshal(sizes)
+	if _, err := db.Exec("UPDATE pages SET sizes_json=? WHERE item_id = (SELECT id FROM library WHERE path=?) AND mod_time=?",
+		string(encoded), path, modTime); err != nil {
+		logger.Error("Failed to store page sizes: %v", err)
+	}
+	return sizes, nil
+}
+
+// readPageSizes reads the size of each page from its image header without decoding
+// the pixels. Archives are read in one pass, in the order their entries are stored.
+func readPageSizes(path, param string, pages []string) ([]PageSize, error) {
+	index := make(map[string]int, len(pages))
+	for i, p := range pages {
+		index[p] = i
+	}
+	sizes := make([]PageSize, len(pages))
+	decode := func(name string, r io.Reader) {
+		i, ok := index[name]
+		if !ok {
+			return
+		}
+		if cfg, _, err := image.DecodeConfig(r); err == nil {
+			sizes[i] = PageSize{Width: cfg.Width, Height: cfg.Height}
+		}
+	}
+
+	switch param {
+	case "cbz", "epub":
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if _, ok := index[f.Name]; !ok {
+				continue
+			}
+			rc, err := f.Open()
 			if err != nil {
-				logger.Error("Failed to update directory entry: %v", err)
-			} else {
-				*updatedCount++
+				continue
 			}
+			decode(f.Name, rc)
+			rc.Close()
 		}
-	} else {
-		_, err := db.Exec(`INSERT INTO library (category, title, path, cover, coverData, lastModified)
-			VALUES (?, ?, ?, ?, ?, ?)`,
-			category, title, path, cover, coverData, lastMod)
+	case "cbr":
+		f, err := os.Open(path)
 		if err != nil {
-			logger.Error("Failed to insert directory entry: %v", err)
-		} else {
-			*newCount++
+			return nil, err
+		}
+		defer f.Close()
+		rr, err := rardecode.NewReader(f, resolvePassword(path))
+		if err != nil {
+			return nil, err
+		}
+		for {
+			h, err := rr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			decode(h.Name, rr)
+		}
+	case "cb7":
+		if err := readCB7Headers(path, index, decode); err != nil {
+			return nil, err
+		}
+	case "cbt":
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		tr, _, err := newCBTReader(f)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			decode(h.Name, tr)
+		}
+	case "pdf":
+		if err := readPDFPageSizes(path, index, sizes); err != nil {
+			return nil, err
+		}
+	default:
+		for _, p := range pages {
+			f, err := os.Open(p)
+			if err != nil {
+				continue
+			}
+			decode(p, f)
+			f.Close()
 		}
 	}
+	return sizes, nil
 }
 
-// HTTP Handlers
+// readCB7Headers calls decode with each page of a CB7 archive listed in index
+func readCB7Headers(cb7Path string, index map[string]int, decode func(string, io.Reader)) (err error) {
+	defer recoverCB7(&err)
 
-// handleMedia serves media files with security checks
-func handleMedia(w http.ResponseWriter, r *http.Request) {
-	cbrPath := r.URL.Query().Get("cbr")
-	cbzPath := r.URL.Query().Get("cbz")
-	pageName := r.URL.Query().Get("page")
+	a, err := openCB7Archive(cb7Path)
+	if err != nil {
+		return err
+	}
+	defer a.mu.Unlock()
 
-	// Serve CBZ pages
-	if cbzPath != "" && pageName != "" {
-		if !isPathAllowed(cbzPath) {
-			logger.Error("Unauthorized CBZ access attempt: %s", cbzPath)
-			http.Error(w, "forbidden", http.StatusForbidden)
-			return
+	for _, f := range a.r.File {
+		if _, ok := index[f.Name]; !ok {
+			continue
 		}
-		serveCBZPage(w, cbzPath, pageName)
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		decode(f.Name, rc)
+		rc.Close()
+	}
+	return nil
+}
+
+// storePageList caches the page list of an archive entry; nil drops the cached list
+func storePageList(path string, pages []string) {
+	query, args := pageListQuery(path, pages)
+	if _, err := db.Exec(query, args...); err != nil {
+		logger.Error("Failed to store page list: %v", err)
+	}
+}
+
+// pageListQuery builds the statement behind storePageList
+func pageListQuery(path string, pages []string) (string, []interface{}) {
+	if pages == nil {
+		return "DELETE FROM pages WHERE item_id IN (SELECT id FROM library WHERE path=?)", []interface{}{path}
+	}
+	data, _ := json.Marshal(pages)
+	return `INSERT OR REPLACE INTO pages (item_id, pages_json, mod_time, created_at)
+		SELECT id, ?, ?, CURRENT_TIMESTAMP FROM library WHERE path=?`, []interface{}{string(data), archiveModTime(path), path}
+}
+
+// archiveModTime is the modification time a cached page list is checked against
+func archiveModTime(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return info.ModTime().UTC().Format(time.RFC3339Nano)
+}
+
+// handleOPDSPage serves the page of an item by its zero-based index, for OPDS-PSE
+func handleOPDSPage(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	id, err := strconv.Atoi(params.Get("id"))
+	if err != nil {
+		http.Error(w, "missing id", http.StatusBadRequest)
+		return
+	}
+	index, err := strconv.Atoi(params.Get("page"))
+	if err != nil || index < 0 {
+		http.Error(w, "invalid page", http.StatusBadRequest)
 		return
 	}
 
-	// Serve CBR pages
-	if cbrPath != "" && pageName != "" {
-		if !isPathAllowed(cbrPath) {
-			logger.Error("Unauthorized CBR access attempt: %s", cbrPath)
-			http.Error(w, "forbidden", http.StatusForbidden)
+	var path string
+	if err := db.QueryRow("SELECT path FROM library WHERE id=?", id).Scan(&path); err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	param, pages, err := cachedItemPages(path, false)
+	if err != nil {
+		logger.WithContext(r.Context()).Error("Cannot list pages of %s: %v", path, err)
+		http.Error(w, "cannot read pages", http.StatusInternalServerError)
+		return
+	}
+	if index >= len(pages) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	// Hand over to /media, which checks the path and handles caching
+	media := url.Values{}
+	if param == "path" {
+		media.Set("path", pages[index])
+	} else {
+		media.Set(param, path)
+		media.Set("page", pages[index])
+	}
+	mr := r.Clone(r.Context())
+	mr.URL.RawQuery = media.Encode()
+	handleMedia(w, mr)
+}
+
+// authCache remembers verified credentials, as bcrypt is too slow to run for
+// every page request. Keys are hashes of username, password and stored hash.
+var authCache sync.Map
+
+// authDummyHash is compared against for unknown users so they take as long as known ones
+var authDummyHash, _ = bcrypt.GenerateFromPassword([]byte("magz"), bcrypt.DefaultCost)
+
+// authMiddleware requires HTTP Basic Authentication when Auth is enabled
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := configManager.Get().Auth
+		// Admin endpoints check their own token
+		if !auth.Enabled || r.URL.Path == "/api/health" || strings.HasPrefix(r.URL.Path, "/api/admin/") {
+			next.ServeHTTP(w, r)
 			return
 		}
-		serveCBRPage(w, cbrPath, pageName)
-		return
+
+		if user, pass, ok := r.BasicAuth(); ok && checkCredentials(auth.Users, user, pass) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="Magz", charset="UTF-8"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// mediaWriteTimeout gives a handler MediaWriteTimeout seconds to send its
+// response, so large pages reach slow clients
+func mediaWriteTimeout(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := time.Duration(configManager.Get().MediaWriteTimeout) * time.Second
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			logger.Debug("Cannot extend write deadline: %v", err)
+		}
+		next(w, r)
 	}
+}
 
-	// Serve normal filesystem file
-	path := r.URL.Query().Get("path")
-	if path == "" {
-		http.Error(w, "missing path", http.StatusBadRequest)
-		return
-	}
+// rateLimiterIdle is how long a client's limiter is kept after its last request
+const rateLimiterIdle = 10 * time.Minute
 
-	// Security: ensure file is inside library dirs
-	if !isPathAllowed(path) {
-		logger.Error("Unauthorized path access attempt: %s", path)
-		http.Error(w, "forbidden", http.StatusForbidden)
-		return
+// mediaLimiter limits the page requests of each client IP, to /media and /opds/pse alike
+var mediaLimiter = &IPRateLimiter{}
+
+// IPRateLimiter holds a token bucket per client IP
+type IPRateLimiter struct {
+	limiters sync.Map // IP -> *clientLimiter
+}
+
+// clientLimiter is the token bucket of one IP and when it was last used
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen atomic.Int64 // unix seconds
+}
+
+// reserve takes a token for ip and returns how long the request must wait for it;
+// the token is returned when the wait isn't zero
+func (l *IPRateLimiter) reserve(ip string, rps float64, burst int) time.Duration {
+	v, ok := l.limiters.Load(ip)
+	if !ok {
+		v, _ = l.limiters.LoadOrStore(ip, &clientLimiter{limiter: rate.NewLimiter(rate.Limit(rps), burst)})
 	}
+	c := v.(*clientLimiter)
+	c.lastSeen.Store(time.Now().Unix())
 
-	// Check if file exists
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		http.Error(w, "not found", http.StatusNotFound)
-		return
+	// Follow config reloads
+	if c.limiter.Limit() != rate.Limit(rps) {
+		c.limiter.SetLimit(rate.Limit(rps))
+	}
+	if c.limiter.Burst() != burst {
+		c.limiter.SetBurst(burst)
 	}
 
-	http.ServeFile(w, r, path)
+	res := c.limiter.Reserve()
+	delay := res.Delay()
+	if delay > 0 {
+		res.Cancel()
+	}
+	return delay
 }
 
-// serveCBZPage serves a single page from CBZ archive
-func serveCBZPage(w http.ResponseWriter, cbzPath, pageName string) {
-	rzip, err := zip.OpenReader(cbzPath)
-	if err != nil {
-		logger.Error("Cannot open CBZ: %v", err)
-		http.Error(w, "cannot open cbz", http.StatusInternalServerError)
-		return
+// evictStale drops the limiters of clients idle for rateLimiterIdle, every rateLimiterIdle
+func (l *IPRateLimiter) evictStale() {
+	ticker := time.NewTicker(rateLimiterIdle)
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-rateLimiterIdle).Unix()
+		l.limiters.Range(func(ip, v any) bool {
+			if v.(*clientLimiter).lastSeen.Load() < cutoff {
+				l.limiters.Delete(ip)
+			}
+			return true
+		})
 	}
-	defer rzip.Close()
+}
 
-	for _, f := range rzip.File {
-		if f.Name == pageName {
-			rc, err := f.Open()
+// rateLimit answers 429 Too Many Requests to clients exceeding RateLimitRPS.
+// Clients are told by IP, so those behind one proxy share a limit.
+func rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := configManager.Get()
+		if cfg.RateLimitRPS > 0 {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
 			if err != nil {
-				logger.Error("Cannot read page: %v", err)
-				http.Error(w, "cannot read page", http.StatusInternalServerError)
+				ip = r.RemoteAddr
+			}
+			if delay := mediaLimiter.reserve(ip, cfg.RateLimitRPS, cfg.RateLimitBurst); delay > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
 				return
 			}
-			defer rc.Close()
+		}
+		next(w, r)
+	}
+}
 
-			setImageContentType(w, f.Name)
-			io.Copy(w, rc)
+// requireAdminToken guards an /api/admin endpoint with the AdminToken bearer token
+func requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := configManager.Get().AdminToken
+		if token == "" {
+			http.Error(w, "admin endpoints are disabled", http.StatusNotImplemented)
 			return
 		}
-	}
 
-	http.Error(w, "page not found", http.StatusNotFound)
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="Magz admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
 }
 
-// serveCBRPage serves a single page from CBR archive
-func serveCBRPage(w http.ResponseWriter, cbrPath, pageName string) {
-	f, err := os.Open(cbrPath)
-	if err != nil {
-		logger.Error("Cannot open CBR: %v", err)
-		http.Error(w, "cannot open cbr", http.StatusInternalServerError)
-		return
+// checkCredentials reports whether pass matches the bcrypt hash stored for user
+func checkCredentials(users map[string]string, user, pass string) bool {
+	hash, known := users[user]
+	if !known {
+		bcrypt.CompareHashAndPassword(authDummyHash, []byte(pass))
+		return false
 	}
-	defer f.Close()
 
-	rr, err := rardecode.NewReader(f, "")
-	if err != nil {
-		logger.Error("Cannot read CBR: %v", err)
-		http.Error(w, "cannot read cbr", http.StatusInternalServerError)
-		return
+	sum := sha256.Sum256([]byte(user + "\x00" + pass + "\x00" + hash))
+	if _, ok := authCache.Load(sum); ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
 	}
+	authCache.Store(sum, struct{}{})
+	return true
+}
 
-	for {
-		h, err := rr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			logger.Error("Error reading CBR: %v", err)
-			http.Error(w, "error reading cbr", http.StatusInternalServerError)
+// gzipWriters recycles the compressors of gzipMiddleware
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+
+// gzipMiddleware compresses text responses (JSON, OPDS feeds, the frontend) for
+// clients accepting gzip. Images and archives are already compressed and pass through,
+// as do partial content and server-sent events, which must reach the client unbuffered.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
 			return
 		}
-		if h.Name == pageName {
-			img, _, err := image.Decode(rr)
-			if err != nil {
-				logger.Error("Cannot decode image: %v", err)
-				http.Error(w, "cannot decode image", http.StatusInternalServerError)
-				return
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			// "gzip;q=0" refuses it
+			q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+			if !ok {
+				return true
 			}
-			w.Header().Set("Content-Type", "image/jpeg")
-			w.Header().Set("Cache-Control", "public, max-age=86400")
-			jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
-			return
+			v, err := strconv.ParseFloat(q, 64)
+			return err == nil && v > 0
 		}
 	}
-
-	http.Error(w, "page not found", http.StatusNotFound)
+	return false
 }
 
-// setImageContentType sets appropriate content type for images
-func setImageContentType(w http.ResponseWriter, filename string) {
-	ext := strings.ToLower(filepath.Ext(filename))
-	contentType := "image/jpeg"
-	switch ext {
-	case ".png":
-		contentType = "image/png"
-	case ".webp":
-		contentType = "image/webp"
-	case ".gif":
-		contentType = "image/gif"
-	case ".avif":
-		contentType = "image/avif"
+// isCompressible reports whether a response of this content type is worth compressing
+func isCompressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"), mediaType == "image/svg+xml",
+		mediaType == "application/javascript", mediaType == "application/json", mediaType == "application/xml",
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
 	}
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", "public, max-age=86400")
+	return false
 }
 
-// handleLibrary returns all library items
-func handleLibrary(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, category, title, path, cover, coverData, lastModified FROM library ORDER BY title")
-	if err != nil {
-		logger.Error("Query failed: %v", err)
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+// gzipMinSize is the smallest body worth compressing; below it gzip's framing eats the savings
+const gzipMinSize = 1024
+
+// gzipResponseWriter compresses the body once its headers show it is compressible
+// and its first gzipMinSize bytes have been written
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer // nil when the body passes through
+	pending     []byte       // start of a compressible body, held back with its headers
+	holding     bool         // headers wait until the body is known to be large enough
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
 		return
 	}
-	defer rows.Close()
-
-	var items []LibraryItem
+	w.wroteHeader = true
 
-	for rows.Next() {
-		var item LibraryItem
-		err := rows.Scan(&item.ID, &item.Category, &item.Title, &item.Path, &item.Cover, &item.CoverData, &item.LastMod)
-		if err != nil {
-			logger.Error("Scan error: %v", err)
-			continue
+	h := w.Header()
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		if n, err := strconv.Atoi(h.Get("Content-Length")); err != nil || n >= gzipMinSize {
+			w.holding = true
+			return
 		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
 
-		// If coverData is missing, try to generate on demand
-		if item.CoverData == "" && item.Cover != "" && item.Cover != "(cbz internal)" && item.Cover != "(cbr internal)" {
-			coverPath := filepath.Join(item.Path, item.Cover)
-			if data, err := generateThumbnailBase64(coverPath); err == nil {
-				item.CoverData = data
-				// Update database asynchronously
-				go db.Exec("UPDATE library SET coverData=? WHERE id=?", data, item.ID)
-			} else {
-				logger.Debug("Failed to generate cover for %s: %v", coverPath, err)
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		// Sniff the type like net/http would, so it is known before deciding
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.holding {
+		w.pending = append(w.pending, b...)
+		if len(w.pending) >= gzipMinSize {
+			if err := w.startGzip(); err != nil {
+				return 0, err
 			}
 		}
-
-		items = append(items, item)
+		return len(b), nil
 	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "no-cache")
-	json.NewEncoder(w).Encode(items)
+// startGzip sends the held back headers as gzip-encoded, followed by the pending body
+func (w *gzipResponseWriter) startGzip() error {
+	w.holding = false
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+
+	w.gz = gzipWriters.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+	_, err := w.gz.Write(w.pending)
+	w.pending = nil
+	return err
 }
 
-// handlePages returns pages for a specific item
-func handlePages(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	if id == "" {
-		http.Error(w, "missing id", http.StatusBadRequest)
-		return
+// Flush sends what has been compressed so far, for http.ResponseController.
+// A body still held back is compressed, as more of it is on the way.
+func (w *gzipResponseWriter) Flush() {
+	if w.holding {
+		w.startGzip()
 	}
-
-	var path string
-	err := db.QueryRow("SELECT path FROM library WHERE id=?", id).Scan(&path)
-	if err != nil {
-		logger.Error("Failed to find library item: %v", err)
-		http.Error(w, "not found", http.StatusNotFound)
-		return
+	if w.gz != nil {
+		w.gz.Flush()
 	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
 
-	lower := strings.ToLower(path)
+// Unwrap lets http.ResponseController reach the connection, e.g. to lift write deadlines
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
 
-	if strings.HasSuffix(lower, ".cbz") {
-		handleCBZPages(w, path)
+func (w *gzipResponseWriter) close() {
+	// The whole body was smaller than gzipMinSize
+	if w.holding {
+		w.holding = false
+		w.Header().Set("Content-Length", strconv.Itoa(len(w.pending)))
+		w.ResponseWriter.WriteHeader(http.StatusOK)
+		w.ResponseWriter.Write(w.pending)
 		return
 	}
-
-	if strings.HasSuffix(lower, ".cbr") {
-		handleCBRPages(w, path)
+	if w.gz == nil {
 		return
 	}
+	w.gz.Close()
+	w.gz.Reset(io.Discard)
+	gzipWriters.Put(w.gz)
+}
+
+// Prometheus metrics, served at /metrics
+var (
+	scansTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "magz_scans_total",
+		Help: "Full library scans by result: ok, failed or cancelled.",
+	}, []string{"result"})
+	scanDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "magz_scan_duration_seconds",
+		Help: "Duration of the last completed full library scan.",
+	})
+	scanItems = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "magz_scan_items_total",
+		Help: "Library items scans and rescans found new, updated or removed.",
+	}, []string{"change"})
+	thumbnailsGenerated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "magz_thumbnails_generated_total",
+		Help: "Thumbnails written to the thumbnail cache.",
+	})
+	thumbnailErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "magz_thumbnail_errors_total",
+		Help: "Thumbnails that failed to encode or write.",
+	})
+	pageCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "magz_page_cache_lookups_total",
+		Help: "Lookups in the in-memory page cache by result: hit or miss.",
+	}, []string{"result"})
+	pageListCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "magz_page_list_cache_lookups_total",
+		Help: "Lookups of stored archive page lists by result: hit or miss.",
+	}, []string{"result"})
+	zipReaderLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "magz_zip_reader_cache_lookups_total",
+		Help: "Lookups of open CBZ archives by result: hit or miss.",
+	}, []string{"result"})
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "magz_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"handler", "method", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "magz_http_request_duration_seconds",
+		Help:    "HTTP request latencies by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler"})
+)
 
-	handleDirectoryPages(w, path)
+// registerMetrics registers the Magz collectors with the default Prometheus registry
+func registerMetrics() {
+	libraryItems := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "magz_library_items",
+		Help: "Items in the library.",
+	}, func() float64 {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM library").Scan(&n)
+		return float64(n)
+	})
+	prometheus.MustRegister(libraryItems, scansTotal, scanDuration, scanItems, thumbnailsGenerated, thumbnailErrors,
+		pageCacheLookups, pageListCacheLookups, zipReaderLookups, httpRequests, httpDuration)
 }
 
-// handleCBZPages returns page URLs for CBZ file
-func handleCBZPages(w http.ResponseWriter, path string) {
-	pages, err := getImagesFromCBZ(path)
-	if err != nil {
-		logger.Error("Cannot read CBZ: %v", err)
-		http.Error(w, "cannot read cbz", http.StatusInternalServerError)
-		return
-	}
+// countScanChanges adds the outcome of a scan or rescan to magz_scan_items_total
+func countScanChanges(added, updated, removed int) {
+	scanItems.WithLabelValues("new").Add(float64(added))
+	scanItems.WithLabelValues("updated").Add(float64(updated))
+	scanItems.WithLabelValues("removed").Add(float64(removed))
+}
 
-	var urls []string
-	for _, p := range pages {
-		urls = append(urls, fmt.Sprintf("/media?cbz=%s&page=%s",
-			url.QueryEscape(path), url.QueryEscape(p)))
+// cacheResult is the result label of a cache lookup
+func cacheResult(hit bool) string {
+	if hit {
+		return "hit"
 	}
+	return "miss"
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "public, max-age=3600")
-	json.NewEncoder(w).Encode(urls)
+// metricsMiddleware counts requests and their latency per mux route. It wraps
+// the mux directly, which sets r.Pattern while routing.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		handler := r.Pattern
+		if handler == "" {
+			handler = "unmatched"
+		}
+		httpRequests.WithLabelValues(handler, r.Method, strconv.Itoa(sw.code)).Inc()
+		httpDuration.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+	})
 }
 
-// handleCBRPages returns page URLs for CBR file
-func handleCBRPages(w http.ResponseWriter, path string) {
-	pages, err := getImagesFromCBR(path)
-	if err != nil {
-		logger.Error("Cannot read CBR: %v", err)
-		http.Error(w, "cannot read cbr", http.StatusInternalServerError)
-		return
-	}
+// statusResponseWriter remembers the status code of a response
+type statusResponseWriter struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+}
 
-	var urls []string
-	for _, p := range pages {
-		urls = append(urls, fmt.Sprintf("/media?cbr=%s&page=%s",
-			url.QueryEscape(path), url.QueryEscape(p)))
+func (w *statusResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.code, w.wroteHeader = code, true
 	}
+	w.ResponseWriter.WriteHeader(code)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "public, max-age=3600")
-	json.NewEncoder(w).Encode(urls)
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
 }
 
-// handleDirectoryPages returns page URLs for directory
-func handleDirectoryPages(w http.ResponseWriter, path string) {
-	entries, err := os.ReadDir(path)
-	if err != nil {
-		logger.Error("Cannot read directory: %v", err)
-		http.Error(w, "cannot read directory", http.StatusInternalServerError)
-		return
-	}
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
 
-	var pages []string
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
+// requestIDKey is the context key of the request ID set by requestIDMiddleware
+type requestIDKey struct{}
+
+// requestIDMiddleware tags each request with an ID, sent back in X-Request-ID and
+// logged with its errors. An ID sent by a client or proxy is kept, so logs can be
+// matched across both.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			b := make([]byte, 12)
+			rand.Read(b)
+			id = base64.RawURLEncoding.EncodeToString(b)
 		}
-		name := strings.ToLower(e.Name())
-		if isImageFile(name) && !strings.HasPrefix(e.Name(), ".") {
-			pages = append(pages, filepath.Join(path, e.Name()))
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID accepts IDs of up to 128 printable ASCII characters without spaces,
+// which keeps them from breaking up log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
 		}
 	}
+	return true
+}
 
-	sort.Slice(pages, func(i, j int) bool {
-		return naturalLess(filepath.Base(pages[i]), filepath.Base(pages[j]))
-	})
+// corsMiddleware answers preflight requests and adds CORS headers for the
+// allowed origins. The frontend itself is only served same-origin.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		p := r.URL.Path
+		if origin == "" || !(strings.HasPrefix(p, "/api/") || p == "/media" || p == "/opds" || strings.HasPrefix(p, "/opds/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Cache-Control", "public, max-age=3600")
-	json.NewEncoder(w).Encode(pages)
+		cfg := configManager.Get()
+		allowed := ""
+		for _, o := range cfg.CORSAllowedOrigins {
+			if o == "*" && allowed == "" {
+				allowed = "*"
+			} else if strings.TrimSuffix(o, "/") == origin {
+				allowed = origin
+			}
+		}
+
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if allowed == "" {
+			if preflight {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		// Browsers never send credentials to a wildcard origin
+		if allowed != "*" && cfg.Auth.Enabled {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, ETag, X-Request-ID")
+
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-None-Match, Range")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // handleHealth provides health check endpoint
@@ -974,85 +8058,259 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// runPasswd implements "magz passwd <username>": it reads a password from
+// stdin and prints the Auth config snippet with its bcrypt hash.
+func runPasswd(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: magz passwd <username>")
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return errors.New("empty password")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	snippet, _ := json.MarshalIndent(map[string]AuthConfig{
+		"Auth": {Enabled: true, Users: map[string]string{args[0]: string(hash)}},
+	}, "", "    ")
+	fmt.Println(string(snippet))
+	return nil
+}
+
+// newRouter registers the routes of the web app, the API, OPDS and /media.
+// Only /api/ responses are gzip-compressed; pages, static files and metrics pass through.
+func newRouter() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Static files
+	frontendFS, _ := fs.Sub(frontendContent, "frontend")
+	mux.Handle("/", http.FileServer(http.FS(frontendFS)))
+
+	// API endpoints
+	api := http.NewServeMux()
+	api.HandleFunc("/api/library", handleLibrary)
+	api.HandleFunc("/api/item", handleItem)
+	api.HandleFunc("/api/item/meta", handleItemMeta)
+	api.HandleFunc("/api/item/cover", handleItemCover)
+	api.HandleFunc("/api/favorite", handleFavorite)
+	api.HandleFunc("/api/favorites", handleFavorites)
+	api.HandleFunc("/api/recent", handleRecent)
+	api.HandleFunc("/api/random", handleRandom)
+	api.HandleFunc("/api/categories", handleCategories)
+	api.HandleFunc("/api/series", handleSeries)
+	api.HandleFunc("/api/download", handleDownload)
+	api.HandleFunc("/api/export", handleExport)
+	api.HandleFunc("/api/import", handleImport)
+	api.HandleFunc("/api/pages", handlePages)
+	api.HandleFunc("/api/search", handleSearch)
+	api.HandleFunc("/api/progress", handleProgress)
+	api.HandleFunc("/api/refresh", handleRefresh)
+	api.HandleFunc("/api/rescan", handleRescan)
+	api.HandleFunc("/api/convert", handleConvert)
+	api.HandleFunc("/api/stats", handleStats)
+	api.HandleFunc("/api/stats/library", handleLibraryStats)
+	api.HandleFunc("/api/stats/event", handleStatsEvent)
+	api.HandleFunc("/api/thumbnail", handleThumbnail)
+	api.HandleFunc("/api/cover", handleCover)
+	api.HandleFunc("/api/health", handleHealth)
+	api.HandleFunc("/api/admin/vacuum", requireAdminToken(handleVacuum))
+	mux.Handle("/api/", gzipMiddleware(api))
+
+	mux.HandleFunc("/opds", handleOPDS)
+	mux.HandleFunc("/opds/items", handleOPDSItems)
+	mux.HandleFunc("/opds/pse", rateLimit(mediaWriteTimeout(handleOPDSPage)))
+	mux.HandleFunc("/opds/v2", handleOPDS2)
+	mux.HandleFunc("/opds/v2/category", handleOPDS2Category)
+	mux.HandleFunc("/opds/v2/item", handleOPDS2Item)
+	mux.HandleFunc("/media", rateLimit(mediaWriteTimeout(handleMedia)))
+	mux.Handle("/metrics", promhttp.Handler())
+	return mux
+}
+
+// newServer creates the server for the routes of newRouter, with timeouts and the
+// TLS settings of cfg
+func newServer(cfg *Config) *http.Server {
+	return &http.Server{
+		Addr:         net.JoinHostPort(cfg.BindAddress, strconv.Itoa(cfg.Port)),
+		Handler:      requestIDMiddleware(corsMiddleware(authMiddleware(metricsMiddleware(newRouter())))),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		IdleTimeout:  60 * time.Second,
+		TLSConfig:    &tls.Config{MinVersion: tlsVersions[cfg.TLSMinVersion]},
+	}
+}
+
 var startTime time.Time
 
 func main() {
 	startTime = time.Now()
 
+	if len(os.Args) > 1 && os.Args[1] == "passwd" {
+		if err := runPasswd(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	flag.StringVar(&configPath, "config", defaultConfigPath, "path of the configuration file")
+	flag.Parse()
+
 	// Load configuration
-	cfg, err := loadConfig("magz.config.json")
+	cfg, err := loadConfig(configPath)
 	if err != nil {
 		fmt.Printf("❌ Configuration error: %v\n", err)
 		fmt.Println("💡 Tip: Copy magz.config.example.json to magz.config.json and edit it")
 		os.Exit(1)
 	}
-	config = *cfg
+	configManager = NewConfigManager(*cfg)
 
 	// Initialize logger
-	logger = &Logger{level: config.LogLevel}
+	logger = NewLogger(cfg.LogLevel, cfg.LogFormat)
 	logger.Info("Starting Magz")
 
 	// Initialize database
-	db, err = initDatabase(config.CacheDB)
+	db, err = initDatabase(cfg.CacheDB)
 	if err != nil {
 		logger.Error("Database error: %v", err)
 		os.Exit(1)
 	}
 	defer db.Close()
 
+	// Keep pdfcpu from creating its own config directory
+	model.ConfigPath = "disable"
+
+	// Thumbnails are cached on disk next to the database
+	if err := os.MkdirAll(cfg.ThumbnailDir, 0o755); err != nil {
+		logger.Error("Thumbnail directory error: %v", err)
+		os.Exit(1)
+	}
+
+	// Pages read ahead and rendered PDF pages share one memory budget
+	cachedPages = newPageCache(cfg.PageCacheMaxMB << 20)
+	transcodedPages = newPageCacheEntries(cfg.MaxThumbnailSize * 100)
+
+	configurePDFRenderer(*cfg)
+
+	registerMetrics()
+
 	// Initialize thumbnail generation semaphore
-	thumbSemaphore = make(chan struct{}, 4)
+	thumbSemaphore = make(chan struct{}, cfg.ThumbnailConcurrency)
+
+	// SIGINT or SIGTERM cancels running scans and starts the graceful shutdown
+	shutdownCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serverCtx = shutdownCtx
 
 	// Initial cache build
-	buildCache()
+	buildCache(shutdownCtx)
+	if shutdownCtx.Err() != nil {
+		logger.Info("Interrupted during the initial scan, exiting")
+		return
+	}
+
+	// Generate missing thumbnails now instead of when each cover is first shown
+	go prewarmThumbnails(shutdownCtx)
+
+	// Rescan on file changes; the ticker below stays as a fallback for
+	// network mounts that don't emit change events
+	if cfg.WatchEnabled {
+		go watchLibraries(shutdownCtx)
+	}
+
+	// Reading statistics are buffered in memory and written in batches
+	go flushStatsPeriodically()
+	go mediaLimiter.evictStale()
 
 	// Start background cache refresh
 	go func() {
-		ticker := time.NewTicker(time.Duration(config.AutoRefreshInterval) * time.Minute)
+		interval := time.Duration(cfg.AutoRefreshInterval) * time.Minute
+		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 		for range ticker.C {
-			buildCache()
+			buildCache(shutdownCtx)
+
+			// Pick up interval changes from a config reload
+			if next := time.Duration(configManager.Get().AutoRefreshInterval) * time.Minute; next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
 		}
 	}()
 
-	// Setup HTTP routes
-	mux := http.NewServeMux()
-
-	// Static files
-	frontendFS, _ := fs.Sub(frontendContent, "frontend")
-	fs := http.FileServer(http.FS(frontendFS))
-	mux.Handle("/", fs)
-
-	// API endpoints
-	mux.HandleFunc("/api/library", handleLibrary)
-	mux.HandleFunc("/api/pages", handlePages)
-	mux.HandleFunc("/api/health", handleHealth)
-	mux.HandleFunc("/media", handleMedia)
-
-	// Create server with timeouts
-	addr := fmt.Sprintf(":%d", config.Port)
-	server := &http.Server{
-		Addr:         addr,
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  60 * time.Second,
-	}
+	// Reload the configuration on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			oldPaths := configManager.Get().LibraryPaths
+			if err := configManager.Reload(configPath); err != nil {
+				logger.Error("Config reload failed, keeping current config: %v", err)
+				continue
+			}
+			logger.SetLevel(configManager.Get().LogLevel)
+			logger.SetFormat(configManager.Get().LogFormat)
+			configurePDFRenderer(configManager.Get())
+			logger.Info("🔁 Configuration reloaded")
+
+			// Pick up added libraries and drop removed ones now, not at the next refresh
+			if !slices.Equal(oldPaths, configManager.Get().LibraryPaths) {
+				select {
+				case libraryPathsChanged <- struct{}{}:
+				default:
+				}
+				go buildCache(shutdownCtx)
+			}
+		}
+	}()
 
-	// Graceful shutdown
-	shutdown := make(chan os.Signal, 1)
-	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	server := newServer(cfg)
 
 	go func() {
-		logger.Info("🚀 Magz running at http://localhost%s", addr)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Info("🚀 Magz running at %s", serverURL(cfg))
+		var err error
+		if cfg.TLSCert != "" {
+			err = server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			logger.Error("Server error: %v", err)
 			os.Exit(1)
 		}
 	}()
 
-	// Wait for interrupt signal
-	<-shutdown
+	// Plain HTTP requests are only redirected to HTTPS
+	var redirectServer *http.Server
+	if cfg.HTTPSRedirectPort != 0 {
+		redirectServer = &http.Server{
+			Addr:         net.JoinHostPort(cfg.BindAddress, strconv.Itoa(cfg.HTTPSRedirectPort)),
+			Handler:      httpsRedirect(cfg.Port),
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second,
+		}
+		go func() {
+			logger.Info("↪️ Redirecting HTTP port %d to HTTPS", cfg.HTTPSRedirectPort)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("Redirect server error: %v", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Wait for interrupt signal; a second one kills the process
+	<-shutdownCtx.Done()
+	stop()
 	logger.Info("Shutting down gracefully...")
 
 	// Create shutdown context with timeout
@@ -1062,6 +8320,16 @@ func main() {
 	if err := server.Shutdown(ctx); err != nil {
 		logger.Error("Shutdown error: %v", err)
 	}
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+
+	// Let a cancelled scan store what it has before the database closes
+	scanMu.Lock()
+
+	if err := flushStats(); err != nil {
+		logger.Error("Failed to save reading stats: %v", err)
+	}
 
 	logger.Info("Server stopped")
 }
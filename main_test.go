@@ -0,0 +1,3038 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"maps"
+	"math"
+	"math/big"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gen2brain/webp"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	logger = NewLogger("error", "text")
+	thumbSemaphore = make(chan struct{}, 4)
+	// Keep pdfcpu from creating its own config directory
+	model.ConfigPath = "disable"
+	os.Exit(m.Run())
+}
+
+// setupLibrary points the globals at a fresh database and thumbnail directory and
+// returns the empty library directory. edit adjusts the configuration before it is validated.
+func setupLibrary(t testing.TB, edit ...func(*Config)) string {
+	t.Helper()
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "library")
+	if err := os.Mkdir(lib, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-ahead goroutines would outlive the test and race with the next one's globals
+	prefetch := false
+	cfg := Config{
+		LibraryPaths: []string{lib},
+		CacheDB:      filepath.Join(dir, "cache.db"),
+		ThumbnailDir: filepath.Join(dir, "thumbs"),
+		Prefetch:     &prefetch,
+	}
+	for _, f := range edit {
+		f(&cfg)
+	}
+	if err := validateConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(cfg.ThumbnailDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	configManager = NewConfigManager(cfg)
+	cachedPages = newPageCache(cfg.PageCacheMaxMB << 20)
+	transcodedPages = newPageCacheEntries(cfg.MaxThumbnailSize * 100)
+	thumbnailBytes = newPageCache(thumbnailCacheMaxBytes)
+	librarySize = diskSize{}
+
+	var err error
+	if db, err = initDatabase(cfg.CacheDB); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return lib
+}
+
+// captureLogs sends log lines of level and above to the returned buffer for the rest of the test
+func captureLogs(t testing.TB, level string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := logger
+	logger = &Logger{state: &loggerState{out: &buf}}
+	logger.SetLevel(level)
+	logger.SetFormat("text")
+	t.Cleanup(func() { logger = old })
+	return &buf
+}
+
+// testImage is a w×h gradient, which cover selection takes for a content page
+func testImage(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / w), uint8(y * 255 / h), 128, 255})
+		}
+	}
+	return img
+}
+
+func jpegPage(t testing.TB, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(w, h), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func pngPage(t testing.TB, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(w, h)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// webpPage encodes a lossless WebP of one color. Every prefix code has a single
+// symbol, so the pixels themselves take no bits.
+func webpPage(w, h int, c color.RGBA) []byte {
+	var bits []byte
+	var acc, n uint
+	put := func(v, width uint) {
+		acc |= v << n
+		for n += width; n >= 8; n -= 8 {
+			bits = append(bits, byte(acc))
+			acc >>= 8
+		}
+	}
+	put(0x2f, 8)
+	put(uint(w-1), 14)
+	put(uint(h-1), 14)
+	put(0, 1+3) // no alpha, version 0
+	put(0, 3)   // no transform, color cache or meta prefix codes
+	for _, symbol := range []uint8{c.G, c.R, c.B, c.A} {
+		put(1, 1) // simple code
+		put(0, 1) // of one symbol
+		put(1, 1) // eight bits long
+		put(uint(symbol), 8)
+	}
+	put(1, 1) // distance code of the one symbol 0
+	put(0, 1)
+	put(0, 1)
+	put(0, 1)
+	if n > 0 {
+		bits = append(bits, byte(acc))
+	}
+	if len(bits)%2 == 1 {
+		bits = append(bits, 0)
+	}
+
+	data := []byte("RIFF\x00\x00\x00\x00WEBPVP8L\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(data[4:], uint32(12+len(bits)))
+	binary.LittleEndian.PutUint32(data[16:], uint32(len(bits)))
+	return append(data, bits...)
+}
+
+// archiveEntry is one file of a test archive
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+func writeCBZ(t testing.TB, path string, entries ...archiveEntry) {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeCBR writes a RAR 4 archive storing the entries uncompressed
+func writeCBR(t testing.TB, path string, entries ...archiveEntry) {
+	t.Helper()
+	var out bytes.Buffer
+	block := func(typ byte, flags uint16, body []byte) {
+		var h bytes.Buffer
+		h.WriteByte(typ)
+		binary.Write(&h, binary.LittleEndian, flags)
+		binary.Write(&h, binary.LittleEndian, uint16(7+len(body)))
+		h.Write(body)
+		binary.Write(&out, binary.LittleEndian, uint16(crc32.ChecksumIEEE(h.Bytes())))
+		out.Write(h.Bytes())
+	}
+
+	out.WriteString("Rar!\x1a\x07\x00")
+	block(0x73, 0, make([]byte, 6)) // archive header
+	for _, e := range entries {
+		var body bytes.Buffer
+		binary.Write(&body, binary.LittleEndian, struct {
+			PackSize, UnpSize uint32
+			HostOS            uint8
+			FileCRC, FileTime uint32
+			UnpVer, Method    uint8
+			NameSize          uint16
+			Attr              uint32
+		}{uint32(len(e.data)), uint32(len(e.data)), 0, crc32.ChecksumIEEE(e.data), 0x21, 20, 0x30, uint16(len(e.name)), 0x20})
+		body.WriteString(e.name)
+		block(0x74, 0x8000, body.Bytes()) // file header, followed by the stored data
+		out.Write(e.data)
+	}
+	block(0x7b, 0x4000, nil) // end of archive
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeCB7 writes a 7z archive storing the entries uncompressed, in one folder
+// using the Copy method
+func writeCB7(t testing.TB, path string, entries ...archiveEntry) {
+	t.Helper()
+	var packed bytes.Buffer
+	for _, e := range entries {
+		packed.Write(e.data)
+	}
+	// Numbers are written in their 9 byte form: 0xff and 8 bytes little endian
+	var h bytes.Buffer
+	num := func(v int) {
+		h.WriteByte(0xff)
+		binary.Write(&h, binary.LittleEndian, uint64(v))
+	}
+
+	h.Write([]byte{0x01, 0x04, 0x06}) // Header, MainStreamsInfo, PackInfo
+	num(0)
+	num(1)
+	h.WriteByte(0x09) // Size
+	num(packed.Len())
+	h.Write([]byte{0x00, 0x07, 0x0b}) // End, UnpackInfo, Folder
+	num(1)
+	h.WriteByte(0x00) // not external
+	num(1)
+	h.Write([]byte{0x01, 0x00, 0x0c}) // one Copy coder, CodersUnpackSize
+	num(packed.Len())
+	h.Write([]byte{0x00, 0x08, 0x0d}) // End, SubStreamsInfo, NumUnpackStream
+	num(len(entries))
+	h.WriteByte(0x09)
+	for _, e := range entries[:len(entries)-1] {
+		num(len(e.data))
+	}
+	h.Write([]byte{0x00, 0x00, 0x05}) // End, End, FilesInfo
+	num(len(entries))
+	var names bytes.Buffer
+	names.WriteByte(0x00) // not external
+	for _, e := range entries {
+		binary.Write(&names, binary.LittleEndian, append(utf16.Encode([]rune(e.name)), 0))
+	}
+	h.WriteByte(0x11) // Name
+	num(names.Len())
+	h.Write(names.Bytes())
+	h.Write([]byte{0x00, 0x00})
+
+	var start [20]byte
+	binary.LittleEndian.PutUint64(start[0:], uint64(packed.Len()))
+	binary.LittleEndian.PutUint64(start[8:], uint64(h.Len()))
+	binary.LittleEndian.PutUint32(start[16:], crc32.ChecksumIEEE(h.Bytes()))
+
+	var out bytes.Buffer
+	out.Write([]byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c, 0, 4})
+	binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(start[:]))
+	out.Write(start[:])
+	out.Write(packed.Bytes())
+	out.Write(h.Bytes())
+	if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writePDF writes a PDF of 300×450 JPEG scans, as pdfcpu imports images
+func writePDF(t testing.TB, path string, pages int) {
+	t.Helper()
+	var scans [][]byte
+	for i := 0; i < pages; i++ {
+		scans = append(scans, jpegPage(t, 300, 450))
+	}
+	writePDFScans(t, path, scans...)
+}
+
+// writePDFScans writes a PDF with one of the images per page
+func writePDFScans(t testing.TB, path string, scans ...[]byte) {
+	t.Helper()
+	var imgs []io.Reader
+	for _, scan := range scans {
+		imgs = append(imgs, bytes.NewReader(scan))
+	}
+	var buf bytes.Buffer
+	if err := api.ImportImages(nil, &buf, imgs, pdfcpu.DefaultImportConfig(), model.NewDefaultConfiguration()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// itemID returns the ID of the library item titled title
+func itemID(t testing.TB, title string) int {
+	t.Helper()
+	var id int
+	if err := db.QueryRow("SELECT id FROM library WHERE title=?", title).Scan(&id); err != nil {
+		t.Fatalf("item %q: %v", title, err)
+	}
+	return id
+}
+
+// addItem inserts a library row without a file behind it and returns its ID.
+// cols are further column and value pairs.
+func addItem(t testing.TB, category, title string, cols ...interface{}) int {
+	t.Helper()
+	names := []string{"category", "title", "path", "cover", "coverData", "lastModified"}
+	args := []interface{}{category, title, "/library/" + category + "/" + title + ".cbz", "(cbz internal)", "", "2024-01-01T00:00:00Z"}
+	for i := 0; i+1 < len(cols); i += 2 {
+		names = append(names, cols[i].(string))
+		args = append(args, cols[i+1])
+	}
+	res, err := db.Exec("INSERT INTO library ("+strings.Join(names, ", ")+") VALUES (?"+strings.Repeat(", ?", len(names)-1)+")", args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return int(id)
+}
+
+// titles decodes a []LibraryItem response into its titles
+func titles(t *testing.T, w *httptest.ResponseRecorder) []string {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var items []LibraryItem
+	if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+		t.Fatal(err)
+	}
+	list := []string{}
+	for _, item := range items {
+		list = append(list, item.Title)
+	}
+	return list
+}
+
+// serve runs one request through handler
+func serve(handler http.HandlerFunc, method, target string, header ...string) *httptest.ResponseRecorder {
+	return serveBody(handler, method, target, "", header...)
+}
+
+// serveBody runs one request with a body through handler
+func serveBody(handler http.HandlerFunc, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestPDF(t *testing.T) {
+	lib := setupLibrary(t)
+	logs := captureLogs(t, "warn")
+
+	pdfPath := filepath.Join(lib, "Scan.pdf")
+	writePDF(t, pdfPath, 3)
+	plain := filepath.Join(lib, "plain.pdf")
+	writePDF(t, plain, 1)
+	conf := model.NewAESConfiguration("user", "owner", 256)
+	if err := api.EncryptFile(plain, filepath.Join(lib, "Locked.pdf"), conf); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(plain)
+
+	buildCache(context.Background())
+
+	var thumbnail string
+	if err := db.QueryRow("SELECT thumbnail FROM library WHERE path=?", pdfPath).Scan(&thumbnail); err != nil {
+		t.Fatal(err)
+	}
+	if thumbnail == "" {
+		t.Error("no cover thumbnail")
+	}
+	if pages, err := getImagesFromPDF(pdfPath); err != nil || len(pages) != 3 {
+		t.Errorf("pages %v, %v; want 3", pages, err)
+	}
+
+	t.Run("encrypted", func(t *testing.T) {
+		var n int
+		db.QueryRow("SELECT COUNT(*) FROM library WHERE title='Locked'").Scan(&n)
+		if n != 0 {
+			t.Error("encrypted PDF was listed")
+		}
+		if !strings.Contains(logs.String(), "Skipping encrypted PDF") {
+			t.Errorf("no warning logged, got %q", logs.String())
+		}
+
+		w := serve(handleMedia, "GET", "/media?pdf="+url.QueryEscape(filepath.Join(lib, "Locked.pdf"))+"&page=1")
+		if w.Code != http.StatusForbidden {
+			t.Errorf("page of encrypted PDF: status %d, want 403", w.Code)
+		}
+	})
+
+	t.Run("page", func(t *testing.T) {
+		w := serve(handleMedia, "GET", "/media?pdf="+url.QueryEscape(pdfPath)+"&page=2", "Accept", "image/jpeg")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		img, _, err := image.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != 300 || b.Dy() != 450 {
+			t.Errorf("page is %v, want 300x450", b.Size())
+		}
+	})
+
+	t.Run("out of range", func(t *testing.T) {
+		w := serve(handleMedia, "GET", "/media?pdf="+url.QueryEscape(pdfPath)+"&page=4")
+		if w.Code != http.StatusNotFound {
+			t.Errorf("status %d, want 404", w.Code)
+		}
+	})
+}
+
+// fakePDFRenderer renders every page as a PNG as wide as its number times 100 pixels
+type fakePDFRenderer struct {
+	mu    sync.Mutex
+	pages []int
+	err   error
+}
+
+func (f *fakePDFRenderer) RenderPage(ctx context.Context, pdfPath string, n int) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pages = append(f.pages, n)
+	if f.err != nil {
+		return nil, f.err
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 100*n, 450)))
+	return buf.Bytes(), nil
+}
+
+func (f *fakePDFRenderer) rendered() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.pages)
+}
+
+func TestPDFRenderer(t *testing.T) {
+	lib := setupLibrary(t)
+	logs := captureLogs(t, "warn")
+
+	// Page 1 is blank, with no image to stand in for it
+	scans := filepath.Join(t.TempDir(), "scans.pdf")
+	writePDF(t, scans, 2)
+	pdfPath := filepath.Join(lib, "Text.pdf")
+	if err := api.InsertPagesFile(scans, pdfPath, []string{"1"}, true, nil, model.NewDefaultConfiguration()); err != nil {
+		t.Fatal(err)
+	}
+	page := func(n int) *httptest.ResponseRecorder {
+		return serve(handleMedia, "GET", fmt.Sprintf("/media?pdf=%s&page=%d", url.QueryEscape(pdfPath), n))
+	}
+	if w := page(1); w.Code != http.StatusNotFound {
+		t.Errorf("blank page without a renderer: status %d, want 404", w.Code)
+	}
+
+	renderer := &fakePDFRenderer{}
+	setPDFRenderer(renderer)
+	t.Cleanup(func() { setPDFRenderer(nil) })
+
+	cfg := configManager.Get()
+	cfg.CoverSelection = "first"
+	configManager = NewConfigManager(cfg)
+	buildCache(context.Background())
+	var pageCount int
+	var thumbnail string
+	if err := db.QueryRow("SELECT page_count, thumbnail FROM library WHERE path=?", pdfPath).Scan(&pageCount, &thumbnail); err != nil {
+		t.Fatal(err)
+	}
+	if pageCount != 3 || thumbnail == "" || !slices.Equal(renderer.rendered(), []int{1}) {
+		t.Errorf("page count %d, thumbnail %q, pages rendered %v; want 3 pages and a cover from page 1", pageCount, thumbnail, renderer.rendered())
+	}
+
+	for _, n := range []int{1, 3, 3} {
+		w := page(n)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("page %d: status %d, Content-Type %q", n, w.Code, w.Header().Get("Content-Type"))
+		}
+		if cfg, _, err := image.DecodeConfig(w.Body); err != nil || cfg.Width != 100*n {
+			t.Errorf("page %d: %v wide, %v; want %d", n, cfg.Width, err, 100*n)
+		}
+	}
+	// The second request for page 3 came from the page cache
+	if got := renderer.rendered(); !slices.Equal(got, []int{1, 1, 3}) {
+		t.Errorf("pages rendered %v, want [1 1 3]", got)
+	}
+
+	// Sizes come from the media box at PDFRenderDPI
+	f, err := os.Open(pdfPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdfCtx, err := api.ReadValidateAndOptimize(f, model.NewDefaultConfiguration())
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dims, err := pdfCtx.PageDims()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes, err := readPageSizes(pdfPath, "pdf", []string{"1", "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PageSize{Width: int(math.Ceil(dims[0].Width * 150 / 72)), Height: int(math.Ceil(dims[0].Height * 150 / 72))}
+	if sizes[0] != want || sizes[1] != (PageSize{}) {
+		t.Errorf("sizes %v, want %v and none", sizes, want)
+	}
+
+	// Renderer errors are told apart by what pdfcpu finds
+	renderer.err = errors.New("render failed")
+	if w := page(4); w.Code != http.StatusNotFound {
+		t.Errorf("page out of range: status %d, want 404", w.Code)
+	}
+	if w := page(2); w.Code != http.StatusNotFound {
+		t.Errorf("failed render: status %d, want 404", w.Code)
+	}
+	if !strings.Contains(logs.String(), "render failed") {
+		t.Errorf("render error not logged: %q", logs.String())
+	}
+	locked := filepath.Join(lib, "Locked.pdf")
+	if err := api.EncryptFile(scans, locked, model.NewAESConfiguration("user", "owner", 256)); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(handleMedia, "GET", "/media?pdf="+url.QueryEscape(locked)+"&page=1"); w.Code != http.StatusForbidden {
+		t.Errorf("page of encrypted PDF: status %d, want 403", w.Code)
+	}
+}
+
+func TestCommandRenderer(t *testing.T) {
+	setupLibrary(t)
+	bin := t.TempDir()
+	args := filepath.Join(bin, "args")
+	page := jpegPage(t, 120, 180)
+	if err := os.WriteFile(filepath.Join(bin, "page.jpg"), page, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// The fake programs record their arguments and copy page.jpg where the real ones write the page
+	programs := map[string]string{
+		"pdftoppm": `for a; do out=$a; done; cp "$(dirname "$0")/page.jpg" "$out.jpg"`,
+		"mutool":   `while [ "$1" != -o ]; do shift; done; cp "$(dirname "$0")/page.jpg" "$2"`,
+	}
+	for name, script := range programs {
+		script = "#!/bin/sh\necho \"$@\" > \"$(dirname \"$0\")/args\"\n" + script + "\n"
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		program string
+		args    string
+	}{
+		{"pdftoppm", "-f 3 -l 3 -r 120 -jpeg -jpegopt quality=90 -singlefile in.pdf"},
+		{"mutool", "draw -F png -r 120 -o"},
+	}
+	for _, tt := range tests {
+		data, err := commandRenderer{path: filepath.Join(bin, tt.program), dpi: 120}.RenderPage(context.Background(), "in.pdf", 3)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.program, err)
+		}
+		if !bytes.Equal(data, page) {
+			t.Errorf("%s: got %d bytes, want the page written", tt.program, len(data))
+		}
+		got, _ := os.ReadFile(args)
+		if !strings.HasPrefix(string(got), tt.args) {
+			t.Errorf("%s: arguments %q, want them to start with %q", tt.program, got, tt.args)
+		}
+	}
+	if _, err := (commandRenderer{path: filepath.Join(bin, "missing"), dpi: 120}).RenderPage(context.Background(), "in.pdf", 1); err == nil {
+		t.Error("missing program: no error")
+	}
+
+	// "auto" takes pdftoppm first, and names are checked when the configuration is loaded
+	t.Setenv("PATH", bin)
+	for _, tt := range []struct {
+		renderer string
+		want     string
+	}{
+		{"auto", filepath.Join(bin, "pdftoppm")},
+		{"mutool", filepath.Join(bin, "mutool")},
+		{"off", ""},
+	} {
+		cfg := Config{Port: 8082, AutoRefreshInterval: 5, LibraryPaths: []string{bin}, PDFRenderer: tt.renderer}
+		if err := validateConfig(&cfg); err != nil {
+			t.Fatalf("%s: %v", tt.renderer, err)
+		}
+		configurePDFRenderer(cfg)
+		got := ""
+		if r, ok := currentPDFRenderer().(commandRenderer); ok {
+			got = r.path
+		}
+		if got != tt.want || cfg.PDFRenderDPI != 150 {
+			t.Errorf("%s: renderer %q at %d dpi, want %q at 150", tt.renderer, got, cfg.PDFRenderDPI, tt.want)
+		}
+	}
+	setPDFRenderer(nil)
+	for _, renderer := range []string{"gs", filepath.Join(t.TempDir(), "pdftoppm")} {
+		cfg := Config{Port: 8082, AutoRefreshInterval: 5, LibraryPaths: []string{bin}, PDFRenderer: renderer}
+		if err := validateConfig(&cfg); err == nil {
+			t.Errorf("PDFRenderer %q: no error", renderer)
+		}
+	}
+	cfg := Config{Port: 8082, AutoRefreshInterval: 5, LibraryPaths: []string{bin}, PDFRenderDPI: 10}
+	if err := validateConfig(&cfg); err == nil {
+		t.Error("PDFRenderDPI 10: no error")
+	}
+}
+
+func TestCB7(t *testing.T) {
+	lib := setupLibrary(t)
+	cb7Path := filepath.Join(lib, "Seven 001.cb7")
+	pages := []archiveEntry{
+		{"002.png", pngPage(t, 320, 480)},
+		{"001.png", pngPage(t, 300, 450)},
+		{"010.png", pngPage(t, 310, 460)},
+		{"notes.txt", []byte("not a page")},
+	}
+	writeCB7(t, cb7Path, pages...)
+
+	buildCache(context.Background())
+	id := itemID(t, "Seven 001")
+
+	w := serve(handlePages, "GET", "/api/pages?id="+strconv.Itoa(id))
+	if w.Code != http.StatusOK {
+		t.Fatalf("pages: status %d: %s", w.Code, w.Body)
+	}
+	var urls []string
+	if err := json.Unmarshal(w.Body.Bytes(), &urls); err != nil {
+		t.Fatal(err)
+	}
+	// Pages are the images in natural order
+	var names []string
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, parsed.Query().Get("page"))
+	}
+	if want := []string{"001.png", "002.png", "010.png"}; !slices.Equal(names, want) {
+		t.Fatalf("pages %v, want %v", names, want)
+	}
+
+	w = serve(handleMedia, "GET", urls[1])
+	if w.Code != http.StatusOK {
+		t.Fatalf("media: status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type %q, want image/png", got)
+	}
+	if !bytes.Equal(w.Body.Bytes(), pages[0].data) {
+		t.Error("page 2 differs from the archived 002.png")
+	}
+
+	w = serve(handleMedia, "GET", "/media?cb7="+url.QueryEscape(cb7Path)+"&page=missing.png")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing page: status %d, want 404", w.Code)
+	}
+}
+
+func TestComicInfo(t *testing.T) {
+	lib := setupLibrary(t)
+	comicInfo := []byte(`<?xml version="1.0"?>
+<ComicInfo>
+  <Series>Saga</Series>
+  <Number>12</Number>
+  <Year>2013</Year>
+  <Writer>Brian K. Vaughan</Writer>
+  <Summary>The war comes home.</Summary>
+  <PageCount>2</PageCount>
+</ComicInfo>`)
+	page := jpegPage(t, 300, 450)
+	writeCBZ(t, filepath.Join(lib, "saga-012.cbz"), archiveEntry{"ComicInfo.xml", comicInfo}, archiveEntry{"01.jpg", page}, archiveEntry{"02.jpg", page})
+	writeCBR(t, filepath.Join(lib, "saga-013.cbr"), archiveEntry{"01.jpg", page}, archiveEntry{"ComicInfo.xml", bytes.ReplaceAll(comicInfo, []byte("12"), []byte("13"))})
+	writeCBZ(t, filepath.Join(lib, "plain.cbz"), archiveEntry{"01.jpg", page})
+
+	buildCache(context.Background())
+
+	tests := []struct {
+		title  string
+		series string
+		number string
+		year   int
+		writer string
+	}{
+		{"saga-012", "Saga", "12", 2013, "Brian K. Vaughan"},
+		{"saga-013", "Saga", "13", 2013, "Brian K. Vaughan"},
+		{"plain", "", "", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.title, func(t *testing.T) {
+			var series, number, writer, summary string
+			var year int
+			err := db.QueryRow("SELECT series, issue_number, year, writer, summary FROM library WHERE title=?", tt.title).
+				Scan(&series, &number, &year, &writer, &summary)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if series != tt.series || number != tt.number || year != tt.year || writer != tt.writer {
+				t.Errorf("got %q #%q (%d) by %q, want %q #%q (%d) by %q", series, number, year, writer, tt.series, tt.number, tt.year, tt.writer)
+			}
+			if tt.series != "" && summary != "The war comes home." {
+				t.Errorf("summary %q", summary)
+			}
+
+			// The API carries the same values
+			var items []LibraryItem
+			if err := json.Unmarshal(serve(handleLibrary, "GET", "/api/library").Body.Bytes(), &items); err != nil {
+				t.Fatal(err)
+			}
+			i := slices.IndexFunc(items, func(item LibraryItem) bool { return item.Title == tt.title })
+			if i < 0 {
+				t.Fatal("not listed by /api/library")
+			}
+			if item := items[i]; item.Series != tt.series || item.IssueNumber != tt.number || item.Year != tt.year || item.Writer != tt.writer {
+				t.Errorf("LibraryItem %+v", item)
+			}
+		})
+	}
+}
+
+func TestSearch(t *testing.T) {
+	setupLibrary(t)
+	addItem(t, "Comics", "Amazing Spider-Man 001", "writer", "Stan Lee", "year", 1963, "summary", "Peter Parker is bitten")
+	addItem(t, "Comics", "Batman 404", "writer", "Frank Miller", "year", 1987, "summary", "Year One")
+	addItem(t, "Magazines", "National Geographic 2024-05", "year", 2024, "summary", "Spiders of the Amazon")
+	addItem(t, "Comics/Marvel", "X-Men 001", "writer", "Stan Lee", "year", 1963)
+	addItem(t, "Comics Extra", "Spider-Man Annual", "year", 1964)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"partial word", "q=spid", []string{"Amazing Spider-Man 001", "National Geographic 2024-05", "Spider-Man Annual"}},
+		{"partial words", "q=amaz+spi", []string{"Amazing Spider-Man 001", "National Geographic 2024-05"}},
+		{"writer text", "q=mill", []string{"Batman 404"}},
+		{"category", "q=spid&category=Comics", []string{"Amazing Spider-Man 001"}},
+		{"category only", "category=Magazines", []string{"National Geographic 2024-05"}},
+		{"nested category", "category=Comics", []string{"Amazing Spider-Man 001", "Batman 404", "X-Men 001"}},
+		{"inner category", "category=Comics/Marvel", []string{"X-Men 001"}},
+		{"year", "year=1987", []string{"Batman 404"}},
+		{"writer", "writer=lee", []string{"Amazing Spider-Man 001", "X-Men 001"}},
+		{"limit", "limit=1", []string{"Amazing Spider-Man 001"}},
+		{"offset", "limit=1&offset=1", []string{"Batman 404"}},
+		{"no match", "q=superman", []string{}},
+		{"no match in category", "q=batman&category=Magazines", []string{}},
+		{"quotes", "q=%22batman", []string{"Batman 404"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := titles(t, serve(handleSearch, "GET", "/api/search?"+tt.query))
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Empty results are an empty array, not null
+	if body := serve(handleSearch, "GET", "/api/search?q=superman").Body.String(); strings.TrimSpace(body) != "[]" {
+		t.Errorf("empty result %q", body)
+	}
+	for _, query := range []string{"year=abc", "limit=0", "offset=-1"} {
+		if w := serve(handleSearch, "GET", "/api/search?"+query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	setupLibrary(t)
+	first := addItem(t, "Comics", "First")
+	second := addItem(t, "Comics", "Second")
+
+	put := func(body string) int {
+		return serveBody(handleProgress, "PUT", "/api/progress", body).Code
+	}
+	if code := put(fmt.Sprintf(`{"id": %d, "page": 4}`, first)); code != http.StatusNoContent {
+		t.Fatalf("PUT: status %d", code)
+	}
+	// Saving again replaces the earlier position
+	if code := put(fmt.Sprintf(`{"id": %d, "page": 7}`, first)); code != http.StatusNoContent {
+		t.Fatalf("second PUT: status %d", code)
+	}
+
+	var p Progress
+	if err := json.Unmarshal(serve(handleProgress, "GET", fmt.Sprintf("/api/progress?id=%d", first)).Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Page != 7 {
+		t.Errorf("GET: %+v, want page 7", p)
+	}
+
+	w := serve(handleLibrary, "GET", "/api/library")
+	var items []LibraryItem
+	if err := json.Unmarshal(w.Body.Bytes(), &items); err != nil {
+		t.Fatal(err)
+	}
+	lastPages := map[int]int{}
+	for _, item := range items {
+		lastPages[item.ID] = item.LastPage
+	}
+	if lastPages[first] != 7 || lastPages[second] != 0 {
+		t.Errorf("library lastPage %v, want %d: 7 and %d: 0", lastPages, first, second)
+	}
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"id": 999, "page": 1}`, http.StatusNotFound},
+		{fmt.Sprintf(`{"id": %d, "page": -1}`, first), http.StatusBadRequest},
+		{`{"id": `, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code := put(tt.body); code != tt.want {
+			t.Errorf("PUT %s: status %d, want %d", tt.body, code, tt.want)
+		}
+	}
+}
+
+func TestWatchLibraries(t *testing.T) {
+	lib := setupLibrary(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go watchLibraries(ctx)
+	// Give the watcher time to add the library before the file appears
+	time.Sleep(200 * time.Millisecond)
+
+	// Creating and writing the file fire several events that settle into one rescan
+	path := filepath.Join(lib, "Dropped.cbz")
+	writeCBZ(t, path, archiveEntry{"01.jpg", jpegPage(t, 300, 450)})
+	if err := os.Chtimes(path, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// The rescan may hold the database while it writes; poll again then
+		var n int
+		err := db.QueryRow("SELECT COUNT(*) FROM library WHERE path=?", path).Scan(&n)
+		if err == nil && n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the new CBZ wasn't scanned within 5 seconds (%v)", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestMediaConditional(t *testing.T) {
+	lib := setupLibrary(t)
+	page := jpegPage(t, 300, 450)
+	writeCBZ(t, filepath.Join(lib, "Zip.cbz"), archiveEntry{"01.jpg", page})
+	writeCBR(t, filepath.Join(lib, "Rar.cbr"), archiveEntry{"01.jpg", page})
+	if err := os.WriteFile(filepath.Join(lib, "loose.jpg"), page, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	targets := map[string]string{
+		"cbz":  "/media?cbz=" + url.QueryEscape(filepath.Join(lib, "Zip.cbz")) + "&page=01.jpg",
+		"cbr":  "/media?cbr=" + url.QueryEscape(filepath.Join(lib, "Rar.cbr")) + "&page=01.jpg",
+		"file": "/media?path=" + url.QueryEscape(filepath.Join(lib, "loose.jpg")),
+	}
+	for name, target := range targets {
+		t.Run(name, func(t *testing.T) {
+			first := serve(handleMedia, "GET", target)
+			if first.Code != http.StatusOK || !bytes.Equal(first.Body.Bytes(), page) {
+				t.Fatalf("first request: status %d, %d bytes", first.Code, first.Body.Len())
+			}
+			etag := first.Header().Get("ETag")
+			modified := first.Header().Get("Last-Modified")
+			if etag == "" || modified == "" {
+				t.Fatalf("ETag %q, Last-Modified %q; want both", etag, modified)
+			}
+
+			for _, header := range [][]string{{"If-None-Match", etag}, {"If-Modified-Since", modified}} {
+				w := serve(handleMedia, "GET", target, header...)
+				if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+					t.Errorf("%s: status %d with %d bytes, want an empty 304", header[0], w.Code, w.Body.Len())
+				}
+			}
+
+			w := serve(handleMedia, "GET", target, "If-None-Match", `"stale"`)
+			if w.Code != http.StatusOK || w.Body.Len() == 0 {
+				t.Errorf("stale ETag: status %d with %d bytes, want the page", w.Code, w.Body.Len())
+			}
+		})
+	}
+
+	// Touching the archive changes the tag even though the cached one is still in pageETags
+	target := targets["cbz"]
+	etag := serve(handleMedia, "GET", target).Header().Get("ETag")
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(lib, "Zip.cbz"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(handleMedia, "GET", target, "If-None-Match", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after touching the archive: status %d, ETag %q; want 200 and a new tag", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestIsPathAllowed(t *testing.T) {
+	configManager = NewConfigManager(Config{LibraryPaths: []string{"/data/comics", "/data/manga/"}})
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/data/comics", true},
+		{"/data/manga", true},
+		{"/data/comics/Saga/001.cbz", true},
+		{"/data/comics-secret/x.cbz", false},
+		{"/data/comics2", false},
+		{"/data/comics/../comics-secret/x.cbz", false},
+		{"/data/comics/../../etc/passwd", false},
+		{"/data/comics/Saga/../002.cbz", true},
+		{"/data", false},
+		{"data/comics/x.cbz", false},
+	}
+	for _, tt := range tests {
+		if got := isPathAllowed(tt.path); got != tt.want {
+			t.Errorf("isPathAllowed(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestZipSlip(t *testing.T) {
+	lib := setupLibrary(t)
+	logs := captureLogs(t, "warn")
+	cbzPath := filepath.Join(lib, "Evil.cbz")
+	page := jpegPage(t, 300, 450)
+	writeCBZ(t, cbzPath,
+		archiveEntry{"../../etc/passwd", []byte("root:x:0:0")},
+		archiveEntry{"../../tmp/escape.jpg", page},
+		archiveEntry{"/abs.jpg", page},
+		archiveEntry{`..\..\windows.jpg`, page},
+		archiveEntry{"pages/../../up.jpg", page},
+		archiveEntry{"01.jpg", page},
+	)
+
+	pages, err := getImagesFromCBZ(cbzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"01.jpg"}; !slices.Equal(pages, want) {
+		t.Errorf("pages %q, want %q", pages, want)
+	}
+	if !strings.Contains(logs.String(), `Skipping unsafe entry "../../etc/passwd"`) {
+		t.Errorf("unsafe entry not logged, got %q", logs.String())
+	}
+
+	buildCache(context.Background())
+	var urls []string
+	if err := json.Unmarshal(serve(handlePages, "GET", "/api/pages?id="+strconv.Itoa(itemID(t, "Evil"))).Body.Bytes(), &urls); err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 1 {
+		t.Errorf("listed %d pages, want 1", len(urls))
+	}
+
+	for _, name := range []string{"../../etc/passwd", "../../tmp/escape.jpg", "/abs.jpg"} {
+		w := serve(handleMedia, "GET", "/media?cbz="+url.QueryEscape(cbzPath)+"&page="+url.QueryEscape(name))
+		if w.Code == http.StatusOK {
+			t.Errorf("page %q was served", name)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	comics, manga := filepath.Join(dir, "comics"), filepath.Join(dir, "manga")
+	for _, lib := range []string{comics, manga} {
+		if err := os.Mkdir(lib, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := write("first.json", fmt.Sprintf(`{"LibraryPaths": [%q], "LogLevel": "info", "Port": 8080, "AutoRefreshInterval": 5}`, comics))
+	second := write("second.json", fmt.Sprintf(`{"LibraryPaths": [%q, %q], "LogLevel": "debug", "Port": 9090, "AutoRefreshInterval": 5}`, comics, manga))
+	broken := write("broken.json", `{"LibraryPaths": [`)
+
+	cfg, err := loadConfig(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewConfigManager(*cfg)
+
+	// Run under -race: readers must never see a half-swapped Config
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for ctx.Err() == nil {
+				c := m.Get()
+				if len(c.LibraryPaths) == 0 || c.Port != 8080 {
+					t.Errorf("Get returned %v on port %d", c.LibraryPaths, c.Port)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; ctx.Err() == nil; i++ {
+		path := first
+		if i%2 == 1 {
+			path = second
+		}
+		if err := m.Reload(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	if err := m.Reload(second); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(broken); err == nil {
+		t.Error("reloading a broken file succeeded")
+	}
+	// A failed reload keeps the last good configuration, and the port is kept until a restart
+	if c := m.Get(); len(c.LibraryPaths) != 2 || c.LogLevel != "debug" || c.Port != 8080 {
+		t.Errorf("after reloads: paths %v, log level %q, port %d", c.LibraryPaths, c.LogLevel, c.Port)
+	}
+}
+
+func TestTranscode(t *testing.T) {
+	lib := setupLibrary(t, func(cfg *Config) { cfg.TranscodeUnsupported = true })
+	page := webpPage(300, 450, color.RGBA{200, 40, 40, 255})
+	// isAnimatedWebP only looks at the chunks, so two empty frames will do
+	animated := []byte("RIFF\x24\x00\x00\x00WEBPANMF\x00\x00\x00\x00ANMF\x00\x00\x00\x00VP8X\x00\x00\x00\x00")
+	cbzPath := filepath.Join(lib, "Web.cbz")
+	writeCBZ(t, cbzPath, archiveEntry{"01.webp", page}, archiveEntry{"02.webp", animated})
+	target := "/media?cbz=" + url.QueryEscape(cbzPath) + "&page=01.webp"
+
+	w := serve(handleMedia, "GET", target, "Accept", "image/jpeg,image/*;q=0.8")
+	if got := w.Header().Get("Content-Type"); w.Code != http.StatusOK || got != "image/jpeg" {
+		t.Fatalf("without WebP support: status %d, Content-Type %q", w.Code, got)
+	}
+	img, err := jpeg.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 300 || b.Dy() != 450 {
+		t.Errorf("JPEG is %v, want 300x450", b.Size())
+	}
+	if r, g, b, _ := img.At(150, 225).RGBA(); r>>8 < 180 || g>>8 > 70 || b>>8 > 70 {
+		t.Errorf("JPEG color %d,%d,%d, want about 200,40,40", r>>8, g>>8, b>>8)
+	}
+	if transcodedPages.order.Len() != 1 {
+		t.Errorf("%d transcoded pages cached, want 1", transcodedPages.order.Len())
+	}
+
+	// The same page again comes from the cache
+	info, err := os.Stat(cbzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcodedPages.Add(pageKey(cbzPath, "01.webp", info.ModTime())+":jpg", []byte("cached"))
+	if w := serve(handleMedia, "GET", target, "Accept", "image/jpeg"); w.Body.String() != "cached" {
+		t.Error("second request missed the transcode cache")
+	}
+
+	w = serve(handleMedia, "GET", target, "Accept", "image/avif,image/webp,*/*")
+	if w.Header().Get("Content-Type") != "image/webp" || !bytes.Equal(w.Body.Bytes(), page) {
+		t.Errorf("with WebP support: Content-Type %q, want the stored page", w.Header().Get("Content-Type"))
+	}
+
+	w = serve(handleMedia, "GET", "/media?cbz="+url.QueryEscape(cbzPath)+"&page=02.webp", "Accept", "image/jpeg")
+	if !bytes.Equal(w.Body.Bytes(), animated) {
+		t.Error("animated WebP was transcoded")
+	}
+
+	cfg := configManager.Get()
+	cfg.TranscodeUnsupported = false
+	configManager = NewConfigManager(cfg)
+	w = serve(handleMedia, "GET", target, "Accept", "image/jpeg")
+	if !bytes.Equal(w.Body.Bytes(), page) {
+		t.Error("page was transcoded with TranscodeUnsupported off")
+	}
+}
+
+// animatedWebP encodes frames of the given colors as an animated WebP
+func animatedWebP(t testing.TB, w, h int, colors ...color.RGBA) []byte {
+	t.Helper()
+	anim := &webp.WEBP{}
+	for _, c := range colors {
+		frame := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.Draw(frame, frame.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 100)
+	}
+	var buf bytes.Buffer
+	if err := webp.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAnimatedWebP(t *testing.T) {
+	lib := setupLibrary(t, func(cfg *Config) { cfg.TranscodeUnsupported = true })
+	red, blue := color.RGBA{200, 40, 40, 255}, color.RGBA{40, 40, 200, 255}
+	var lossy bytes.Buffer
+	if err := webp.Encode(&lossy, testImage(64, 96)); err != nil {
+		t.Fatal(err)
+	}
+	animated := animatedWebP(t, 64, 96, red, blue, red)
+	oneFrame := animatedWebP(t, 64, 96, red)
+
+	// An odd-sized chunk is padded; the ANMF chunks after it must still be found
+	padded := []byte("RIFF\x00\x00\x00\x00WEBPXMP \x03\x00\x00\x00abc\x00ANMF\x00\x00\x00\x00ANMF\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(padded[4:], uint32(len(padded)-8))
+
+	for name, tt := range map[string]struct {
+		data []byte
+		want bool
+	}{
+		"animated":       {animated, true},
+		"padded chunk":   {padded, true},
+		"single frame":   {oneFrame, false},
+		"lossy":          {lossy.Bytes(), false},
+		"lossless":       {webpPage(64, 96, red), false},
+		"jpeg":           {jpegPage(t, 64, 96), false},
+		"truncated":      {animated[:20], false},
+		"chunk past end": {[]byte("RIFF\x00\x00\x00\x00WEBPANMF\xff\xff\xff\x7f"), false},
+		"empty":          {nil, false},
+	} {
+		if got := isAnimatedWebP(tt.data); got != tt.want {
+			t.Errorf("%s: isAnimatedWebP = %v, want %v", name, got, tt.want)
+		}
+	}
+
+	cbzPath := filepath.Join(lib, "Anim.cbz")
+	writeCBZ(t, cbzPath, archiveEntry{"01.webp", lossy.Bytes()}, archiveEntry{"02.webp", animated}, archiveEntry{"03.webp", oneFrame})
+	page := func(name string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := serve(handleMedia, "GET", "/media?cbz="+url.QueryEscape(cbzPath)+"&page="+name, "Accept", "image/jpeg,image/*;q=0.8")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", name, w.Code)
+		}
+		return w
+	}
+
+	// Static pages, including one-frame animations, become JPEGs; animations are kept whole
+	for _, name := range []string{"01.webp", "03.webp"} {
+		w := page(name)
+		if w.Header().Get("Content-Type") != "image/jpeg" {
+			t.Errorf("%s: Content-Type %q, want image/jpeg", name, w.Header().Get("Content-Type"))
+		} else if _, err := jpeg.Decode(w.Body); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	w := page("02.webp")
+	if w.Header().Get("Content-Type") != "image/webp" || !bytes.Equal(w.Body.Bytes(), animated) {
+		t.Errorf("animated page: Content-Type %q, %d bytes; want the stored %d byte WebP", w.Header().Get("Content-Type"), w.Body.Len(), len(animated))
+	}
+	anim, err := webp.DecodeAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(anim.Image) != 3 {
+		t.Errorf("served animation has %d frames, want 3", len(anim.Image))
+	}
+}
+
+func TestPageCacheEntries(t *testing.T) {
+	c := newPageCacheEntries(2)
+	c.Add("a", make([]byte, 1<<20))
+	c.Add("b", []byte("b"))
+	c.Get("a")
+	c.Add("c", []byte("c"))
+	if !c.Has("a") || c.Has("b") || !c.Has("c") {
+		t.Errorf("cached a %v, b %v, c %v; want the least recently used b evicted", c.Has("a"), c.Has("b"), c.Has("c"))
+	}
+}
+
+// decodedTestPages records the pages of the "magzpage" test format that were fully decoded
+var decodedTestPages []string
+
+// A "magzpage" test page is "MAGZPAGE <name> <width>x<height> <blank|content>". Reading its
+// config is free, decoding it is recorded in decodedTestPages.
+func init() {
+	parse := func(r io.Reader) (name string, w, h int, blank bool, err error) {
+		var kind string
+		_, err = fmt.Fscanf(r, "MAGZPAGE %s %dx%d %s", &name, &w, &h, &kind)
+		return name, w, h, kind == "blank", err
+	}
+	image.RegisterFormat("magzpage", "MAGZPAGE ", func(r io.Reader) (image.Image, error) {
+		name, w, h, blank, err := parse(r)
+		if err != nil {
+			return nil, err
+		}
+		decodedTestPages = append(decodedTestPages, name)
+		if blank {
+			return image.NewGray(image.Rect(0, 0, w, h)), nil
+		}
+		return testImage(w, h), nil
+	}, func(r io.Reader) (image.Config, error) {
+		_, w, h, _, err := parse(r)
+		return image.Config{ColorModel: color.RGBAModel, Width: w, Height: h}, err
+	})
+}
+
+func TestPickCover(t *testing.T) {
+	lib := setupLibrary(t)
+	readPage := func(_, name string) ([]byte, error) {
+		if strings.HasPrefix(name, "missing") {
+			return nil, os.ErrNotExist
+		}
+		size, kind, _ := strings.Cut(strings.TrimSuffix(name, ".page"), "-")
+		return []byte("MAGZPAGE " + name + " " + size + " " + kind), nil
+	}
+
+	tests := []struct {
+		name    string
+		pages   []string
+		want    string
+		decoded []string
+	}{
+		{"logo skipped from its header", []string{"100x100-content.page", "600x900-content.page"},
+			"600x900-content.page", []string{"600x900-content.page"}},
+		{"blank page skipped", []string{"100x100-content.page", "600x900-blank.page", "600x900-content.page"},
+			"600x900-content.page", []string{"600x900-blank.page", "600x900-content.page"}},
+		{"only logos", []string{"100x100-content.page", "200x200-content.page"},
+			"100x100-content.page", []string{"100x100-content.page"}},
+		{"blank fallback decoded once", []string{"600x900-blank.page", "700x900-blank.page"},
+			"600x900-blank.page", []string{"600x900-blank.page", "700x900-blank.page"}},
+		{"unreadable pages", []string{"missing.page", "100x100-content.page"},
+			"100x100-content.page", []string{"100x100-content.page"}},
+		{"named cover", []string{"100x100-content.page", "600x900-content.page", "5x5-cover.page"},
+			"5x5-cover.page", []string{"5x5-cover.page"}},
+		{"beyond the candidates", []string{"1x1-blank.page", "2x2-blank.page", "3x3-blank.page", "600x900-content.page"},
+			"1x1-blank.page", []string{"1x1-blank.page"}},
+	}
+	for _, tt := range tests {
+		decodedTestPages = nil
+		page, img, err := pickCover(lib, tt.pages, readPage)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if page != tt.want || img == nil {
+			t.Errorf("%s: picked %q, want %q", tt.name, page, tt.want)
+		}
+		if !slices.Equal(decodedTestPages, tt.decoded) {
+			t.Errorf("%s: decoded %q, want only %q", tt.name, decodedTestPages, tt.decoded)
+		}
+	}
+
+	decodedTestPages = nil
+	if _, _, err := pickCover(lib, []string{"missing.page"}, readPage); err == nil {
+		t.Error("no readable page: no error")
+	}
+
+	cfg := configManager.Get()
+	cfg.CoverSelection = "first"
+	configManager = NewConfigManager(cfg)
+	decodedTestPages = nil
+	if page, _, _ := pickCover(lib, []string{"100x100-content.page", "600x900-content.page"}, readPage); page != "100x100-content.page" || len(decodedTestPages) != 1 {
+		t.Errorf(`with "first": picked %q after decoding %q`, page, decodedTestPages)
+	}
+
+	// A folder whose first page is a small PNG logo gets its JPEG page as cover
+	cfg.CoverSelection = "smart"
+	configManager = NewConfigManager(cfg)
+	dir := filepath.Join(lib, "Folder")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{"01.png": pngPage(t, 120, 60), "02.jpg": jpegPage(t, 600, 900)} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buildCache(context.Background())
+	var cover string
+	if err := db.QueryRow("SELECT cover FROM library WHERE title='Folder'").Scan(&cover); err != nil || cover != "02.jpg" {
+		t.Errorf("folder cover %q (%v), want 02.jpg", cover, err)
+	}
+}
+
+func TestCategories(t *testing.T) {
+	lib := setupLibrary(t)
+	for _, file := range []struct {
+		path string
+		w, h int
+	}{
+		{"Marvel/Beta.cbz", 300, 450},
+		{"Marvel/Alpha.cbz", 320, 480},
+		{"DC/Zeta.cbz", 300, 450},
+		{"DC/Eta.cbz", 310, 460},
+		{"Image/Saga.cbz", 300, 450},
+	} {
+		path := filepath.Join(lib, file.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		writeCBZ(t, path, archiveEntry{"01.jpg", jpegPage(t, file.w, file.h)})
+	}
+	buildCache(context.Background())
+
+	w := serve(handleCategories, "GET", "/api/categories")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var categories []Category
+	if err := json.Unmarshal(w.Body.Bytes(), &categories); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		name  string
+		count int
+		first string
+	}{{"DC", 2, "Eta"}, {"Image", 1, "Saga"}, {"Marvel", 2, "Alpha"}}
+	if len(categories) != len(want) {
+		t.Fatalf("categories %+v, want %d", categories, len(want))
+	}
+	for i, c := range categories {
+		if c.Name != want[i].name || c.Count != want[i].count {
+			t.Errorf("category %d is %s with %d items, want %s with %d", i, c.Name, c.Count, want[i].name, want[i].count)
+		}
+		if !strings.HasPrefix(c.Cover, "data:image/") || c.Cover != inlineThumbnail(itemID(t, want[i].first)) {
+			t.Errorf("%s cover isn't the thumbnail of %s", c.Name, want[i].first)
+		}
+	}
+
+	got := titles(t, serve(handleLibrary, "GET", "/api/library?category=Marvel"))
+	slices.Sort(got)
+	if want := []string{"Alpha", "Beta"}; !slices.Equal(got, want) {
+		t.Errorf("Marvel items %v, want %v", got, want)
+	}
+	if got := titles(t, serve(handleLibrary, "GET", "/api/library?category=Nobody")); len(got) != 0 {
+		t.Errorf("unknown category lists %v", got)
+	}
+}
+
+// schemaOf lists the columns of every table, as "table.column type"
+func schemaOf(t *testing.T, conn *sql.DB) []string {
+	t.Helper()
+	rows, err := conn.Query(`SELECT m.name || '.' || p.name || ' ' || p.type FROM sqlite_master m, pragma_table_info(m.name) p
+		WHERE m.type='table' ORDER BY m.name, p.cid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			t.Fatal(err)
+		}
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+func TestMigrateDB(t *testing.T) {
+	open := func() *sql.DB {
+		conn, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "cache.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	version := func(conn *sql.DB) int {
+		var v int
+		if err := conn.QueryRow("SELECT version FROM schema_version").Scan(&v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	fresh := open()
+	if err := MigrateDB(fresh, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if v := version(fresh); v != len(migrations) {
+		t.Errorf("empty database is at version %d, want %d", v, len(migrations))
+	}
+	want := schemaOf(t, fresh)
+	for _, column := range []string{"library.series TEXT", "library.thumbnail TEXT", "stats.item_id INTEGER"} {
+		if !slices.Contains(want, column) {
+			t.Errorf("empty database lacks %s", column)
+		}
+	}
+
+	old := open()
+	if err := MigrateDB(old, migrations[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec("INSERT INTO library (category, title, path, lastModified) VALUES ('Comics', 'Saga', '/library/Saga.cbz', '2024-01-01T00:00:00Z')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := MigrateDB(old, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if v := version(old); v != len(migrations) {
+		t.Errorf("version 1 database is at version %d, want %d", v, len(migrations))
+	}
+	if got := schemaOf(t, old); !slices.Equal(got, want) {
+		t.Errorf("version 1 database migrated to\n%v\nwant\n%v", got, want)
+	}
+	// The row is kept and marked for a rescan to fill the new columns
+	var title, lastModified string
+	if err := old.QueryRow("SELECT title, lastModified FROM library").Scan(&title, &lastModified); err != nil {
+		t.Fatal(err)
+	}
+	if title != "Saga" || lastModified != "" {
+		t.Errorf("row after migration: title %q, lastModified %q", title, lastModified)
+	}
+
+	// Running again finds nothing to do
+	if err := MigrateDB(old, migrations); err != nil {
+		t.Fatal(err)
+	}
+	if v := version(old); v != len(migrations) {
+		t.Errorf("second run moved the version to %d", v)
+	}
+
+	// A failing migration leaves the version where it was
+	if err := MigrateDB(old, append(slices.Clip(migrations), "ALTER TABLE missing ADD COLUMN x TEXT")); err == nil {
+		t.Error("failing migration reported no error")
+	}
+	if v := version(old); v != len(migrations) {
+		t.Errorf("failed migration moved the version to %d", v)
+	}
+}
+
+// waitRefresh waits for the refresh started by a request to end
+func waitRefresh(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		refreshMu.Lock()
+		running := refreshing
+		refreshMu.Unlock()
+		if !running {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refresh still running after 5 seconds")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	lib := setupLibrary(t)
+	writeCBZ(t, filepath.Join(lib, "First.cbz"), archiveEntry{"01.jpg", jpegPage(t, 300, 450)})
+
+	w := serve(handleRefresh, "POST", "/api/refresh")
+	waitRefresh(t)
+	if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type %q", got)
+	}
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	var done RefreshDone
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(events[len(events)-1], "data: ")), &done); err != nil {
+		t.Fatalf("last event %q: %v", events[len(events)-1], err)
+	}
+	if !done.Done || done.New != 1 {
+		t.Errorf("last event %+v, want done with 1 new item", done)
+	}
+
+	if w := serve(handleRefresh, "GET", "/api/refresh"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", w.Code)
+	}
+
+	if !startRefresh() {
+		t.Fatal("refresh flag left set")
+	}
+	w = serve(handleRefresh, "POST", "/api/refresh")
+	endRefresh()
+	if w.Code != http.StatusConflict {
+		t.Errorf("concurrent refresh: status %d, want 409", w.Code)
+	}
+
+	// A client hanging up stops the stream but not the scan
+	writeCBZ(t, filepath.Join(lib, "Second.cbz"), archiveEntry{"01.jpg", jpegPage(t, 300, 450)})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("POST", "/api/refresh", nil).WithContext(ctx)
+	handleRefresh(httptest.NewRecorder(), r)
+	waitRefresh(t)
+	itemID(t, "Second")
+}
+
+func BenchmarkBuildCache(b *testing.B) {
+	lib := setupLibrary(b)
+	page := jpegPage(b, 200, 300)
+	for i := 0; i < 1000; i++ {
+		dir := filepath.Join(lib, fmt.Sprintf("Category %02d", i%20))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		writeCBZ(b, filepath.Join(dir, fmt.Sprintf("Issue %04d.cbz", i)), archiveEntry{"01.jpg", page}, archiveEntry{"02.jpg", page})
+	}
+
+	for _, workers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			cfg := configManager.Get()
+			cfg.ScanWorkers = workers
+			configManager = NewConfigManager(cfg)
+			for i := 0; i < b.N; i++ {
+				// Every file is new to each scan
+				b.StopTimer()
+				if _, err := db.Exec("DELETE FROM library; DELETE FROM pages"); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				buildCache(context.Background())
+			}
+		})
+	}
+}
+
+func TestCORS(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	tests := []struct {
+		name        string
+		origins     []string
+		method      string
+		path        string
+		origin      string
+		wantCode    int
+		wantAllowed string
+	}{
+		{"preflight", []string{"https://app.example"}, "OPTIONS", "/api/library", "https://app.example", http.StatusNoContent, "https://app.example"},
+		{"preflight blocked", []string{"https://app.example"}, "OPTIONS", "/api/library", "https://evil.example", http.StatusForbidden, ""},
+		{"allowed", []string{"https://app.example/"}, "GET", "/api/library", "https://app.example", http.StatusOK, "https://app.example"},
+		{"blocked", []string{"https://app.example"}, "GET", "/api/library", "https://evil.example", http.StatusOK, ""},
+		{"wildcard", []string{"*"}, "GET", "/media", "https://any.example", http.StatusOK, "*"},
+		{"opds", []string{"*"}, "GET", "/opds/items", "https://any.example", http.StatusOK, "*"},
+		{"static files", []string{"*"}, "GET", "/index.html", "https://any.example", http.StatusOK, ""},
+		{"no origin", []string{"*"}, "GET", "/api/library", "", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configManager = NewConfigManager(Config{CORSAllowedOrigins: tt.origins})
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.method == "OPTIONS" {
+				r.Header.Set("Access-Control-Request-Method", "PATCH")
+			}
+			w := httptest.NewRecorder()
+			corsMiddleware(ok).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllowed {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", got, tt.wantAllowed)
+			}
+			if tt.wantCode == http.StatusNoContent {
+				if methods := w.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(methods, "PATCH") {
+					t.Errorf("Access-Control-Allow-Methods %q lacks PATCH", methods)
+				}
+				if w.Header().Get("Access-Control-Allow-Headers") == "" {
+					t.Error("no Access-Control-Allow-Headers")
+				}
+			}
+		})
+	}
+}
+
+func TestPDFPages(t *testing.T) {
+	lib := setupLibrary(t)
+	pdfPath := filepath.Join(lib, "Magazine.pdf")
+	// A landscape first page tells the cover apart from the others
+	writePDFScans(t, pdfPath, jpegPage(t, 450, 300), jpegPage(t, 300, 450), jpegPage(t, 300, 450))
+	buildCache(context.Background())
+	id := itemID(t, "Magazine")
+
+	var pagesJSON, thumbnail string
+	var pageCount int
+	err := db.QueryRow("SELECT p.pages_json, l.page_count, l.thumbnail FROM pages p JOIN library l ON l.id = p.item_id WHERE l.id=?", id).
+		Scan(&pagesJSON, &pageCount, &thumbnail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []string
+	if err := json.Unmarshal([]byte(pagesJSON), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1", "2", "3"}; !slices.Equal(stored, want) || pageCount != 3 {
+		t.Errorf("stored pages %v and count %d, want %v", stored, pageCount, want)
+	}
+
+	f, err := os.Open(filepath.Join(configManager.Get().ThumbnailDir, thumbnail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cover, _, err := image.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cover.Width <= cover.Height {
+		t.Errorf("cover is %dx%d, want page 1 in landscape", cover.Width, cover.Height)
+	}
+
+	w := serve(handlePages, "GET", "/api/pages?id="+strconv.Itoa(id))
+	var urls []string
+	if err := json.Unmarshal(w.Body.Bytes(), &urls); err != nil {
+		t.Fatalf("pages: %v: %s", err, w.Body)
+	}
+	if len(urls) != 3 {
+		t.Fatalf("pages %v, want 3", urls)
+	}
+	w = serve(handleMedia, "GET", urls[0], "Accept", "image/jpeg")
+	img, _, err := image.DecodeConfig(w.Body)
+	if err != nil {
+		t.Fatalf("page 1: status %d: %v", w.Code, err)
+	}
+	if img.Width != 450 || img.Height != 300 {
+		t.Errorf("page 1 is %dx%d, want 450x300", img.Width, img.Height)
+	}
+}
+
+func TestPDFPageSizes(t *testing.T) {
+	lib := setupLibrary(t)
+	pdfPath := filepath.Join(lib, "Mixed.pdf")
+	writePDFScans(t, pdfPath, jpegPage(t, 640, 960), pngPage(t, 500, 320), jpegPage(t, 333, 444))
+	buildCache(context.Background())
+
+	want := []PageSize{{640, 960}, {500, 320}, {333, 444}}
+	sizes, err := readPageSizes(pdfPath, "pdf", []string{"1", "2", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(sizes, want) {
+		t.Errorf("sizes %v, want %v", sizes, want)
+	}
+
+	// Pages past the end and text-only names are left 0x0
+	sizes, err = readPageSizes(pdfPath, "pdf", []string{"3", "4", "cover"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []PageSize{{333, 444}, {}, {}}; !slices.Equal(sizes, want) {
+		t.Errorf("sizes %v, want %v", sizes, want)
+	}
+
+	w := serve(handlePages, "GET", "/api/pages?metadata=1&id="+strconv.Itoa(itemID(t, "Mixed")))
+	var pages []PageInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &pages); err != nil {
+		t.Fatalf("status %d: %v: %s", w.Code, err, w.Body)
+	}
+	if len(pages) != len(want) {
+		t.Fatalf("%d pages, want %d", len(pages), len(want))
+	}
+	for i, p := range pages {
+		if p.Width == 0 || p.Height == 0 || (PageSize{p.Width, p.Height}) != want[i] {
+			t.Errorf("page %d is %dx%d, want %v", i+1, p.Width, p.Height, want[i])
+		}
+	}
+
+	if _, err := readPageSizes(filepath.Join(lib, "missing.pdf"), "pdf", []string{"1"}); err == nil {
+		t.Error("missing PDF: no error")
+	}
+}
+
+// BenchmarkThumbnailFormat compares the payload of each ThumbnailFormat in B/thumb
+func BenchmarkThumbnailFormat(b *testing.B) {
+	// Grain keeps the gradient from compressing better than a real scan would
+	cover := testImage(900, 1350).(*image.RGBA)
+	grain := rand.New(rand.NewPCG(1, 2))
+	for i := range cover.Pix {
+		if i%4 != 3 {
+			cover.Pix[i] = uint8(max(0, min(255, int(cover.Pix[i])+grain.IntN(41)-20)))
+		}
+	}
+	bg := color.RGBA{255, 255, 255, 255}
+	for _, format := range []string{"jpeg", "webp", "png"} {
+		b.Run(format, func(b *testing.B) {
+			total := 0
+			for i := 0; i < b.N; i++ {
+				data, err := imageToThumbnail(cover, 400, "fit", bg, format, 85)
+				if err != nil {
+					b.Fatal(err)
+				}
+				total += len(data)
+			}
+			b.ReportMetric(float64(total)/float64(b.N), "B/thumb")
+		})
+	}
+}
+
+func TestLibrarySort(t *testing.T) {
+	setupLibrary(t)
+	for _, item := range []struct {
+		title, category string
+		year            int
+		modified, added string
+		views           int
+	}{
+		{"Alpha", "Zines", 2001, "2024-03-01T00:00:00Z", "2024-01-02 00:00:00", 5},
+		{"Beta", "Comics", 2010, "2024-01-01T00:00:00Z", "2024-01-03 00:00:00", 0},
+		{"Gamma", "Manga", 1999, "2024-02-01T00:00:00Z", "2024-01-01 00:00:00", 9},
+	} {
+		id := addItem(t, item.category, item.title, "year", item.year, "created_at", item.added)
+		if _, err := db.Exec("UPDATE library SET lastModified=? WHERE id=?", item.modified, id); err != nil {
+			t.Fatal(err)
+		}
+		if item.views > 0 {
+			if _, err := db.Exec("INSERT INTO stats (item_id, page_views) VALUES (?, ?)", id, item.views); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		sort string
+		want []string
+	}{
+		{"", []string{"Alpha", "Beta", "Gamma"}},
+		{"title", []string{"Alpha", "Beta", "Gamma"}},
+		{"category", []string{"Beta", "Gamma", "Alpha"}},
+		{"year", []string{"Gamma", "Alpha", "Beta"}},
+		{"lastModified", []string{"Beta", "Gamma", "Alpha"}},
+		{"added", []string{"Gamma", "Alpha", "Beta"}},
+		{"views", []string{"Beta", "Alpha", "Gamma"}},
+	}
+	for _, tt := range tests {
+		if got := titles(t, serve(handleLibrary, "GET", "/api/library?sort="+tt.sort)); !slices.Equal(got, tt.want) {
+			t.Errorf("sort=%s: %v, want %v", tt.sort, got, tt.want)
+		}
+		desc := slices.Clone(tt.want)
+		slices.Reverse(desc)
+		if got := titles(t, serve(handleLibrary, "GET", "/api/library?order=desc&sort="+tt.sort)); !slices.Equal(got, desc) {
+			t.Errorf("sort=%s&order=desc: %v, want %v", tt.sort, got, desc)
+		}
+	}
+
+	for _, query := range []string{"sort=path", "sort=" + url.QueryEscape("title; DROP TABLE library"), "sort=Title", "order=up"} {
+		if w := serve(handleLibrary, "GET", "/api/library?"+query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestDeleteItem(t *testing.T) {
+	for _, exclude := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ExcludeOnDelete=%v", exclude), func(t *testing.T) {
+			lib := setupLibrary(t, func(cfg *Config) { cfg.ExcludeOnDelete = exclude })
+			path := filepath.Join(lib, "Hidden.cbz")
+			writeCBZ(t, path, archiveEntry{"01.jpg", jpegPage(t, 300, 450)})
+			buildCache(context.Background())
+			id := itemID(t, "Hidden")
+			serveBody(handleProgress, "PUT", "/api/progress", fmt.Sprintf(`{"id": %d, "page": 1}`, id))
+			tables := []string{"library WHERE id", "pages WHERE item_id", "progress WHERE item_id"}
+			for _, table := range tables {
+				var n int
+				if db.QueryRow("SELECT COUNT(*) FROM "+table+"=?", id).Scan(&n); n != 1 {
+					t.Fatalf("%s=%d has no row to delete", table, id)
+				}
+			}
+
+			if w := serve(handleItem, "DELETE", "/api/item?id="+strconv.Itoa(id)); w.Code != http.StatusNoContent {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			if _, err := os.Stat(path); err != nil {
+				t.Errorf("file was touched: %v", err)
+			}
+			for _, table := range tables {
+				var n int
+				db.QueryRow("SELECT COUNT(*) FROM "+table+"=?", id).Scan(&n)
+				if n != 0 {
+					t.Errorf("%s=%d still has a row", table, id)
+				}
+			}
+
+			buildCache(context.Background())
+			var n int
+			db.QueryRow("SELECT COUNT(*) FROM library WHERE path=?", path).Scan(&n)
+			if reappeared := n == 1; reappeared == exclude {
+				t.Errorf("after a rescan the item is listed: %v", reappeared)
+			}
+		})
+	}
+
+	setupLibrary(t)
+	if w := serve(handleItem, "DELETE", "/api/item?id=999"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown id: status %d, want 404", w.Code)
+	}
+	if w := serve(handleItem, "DELETE", "/api/item"); w.Code != http.StatusBadRequest {
+		t.Errorf("missing id: status %d, want 400", w.Code)
+	}
+}
+
+// BenchmarkPageCache reads a 100-page CBZ front to back, with the pages read
+// ahead into the page cache and without, and reports the time to serve a page
+func BenchmarkPageCache(b *testing.B) {
+	lib := setupLibrary(b)
+	cbzPath := filepath.Join(lib, "Long.cbz")
+	page := jpegPage(b, 1200, 1800)
+	var entries []archiveEntry
+	for i := 1; i <= 100; i++ {
+		entries = append(entries, archiveEntry{fmt.Sprintf("%03d.jpg", i), page})
+	}
+	writeCBZ(b, cbzPath, entries...)
+	buildCache(context.Background())
+	info, err := os.Stat(cbzPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, prefetch := range []bool{false, true} {
+		b.Run(fmt.Sprintf("prefetch=%v", prefetch), func(b *testing.B) {
+			cfg := configManager.Get()
+			cfg.Prefetch = &prefetch
+			configManager = NewConfigManager(cfg)
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				// One byte holds no page, so without prefetching every page comes from the archive
+				cachedPages = newPageCache(1)
+				if prefetch {
+					cachedPages = newPageCache(cfg.PageCacheMaxMB << 20)
+				}
+				b.StartTimer()
+				for k, entry := range entries {
+					w := serve(handleMedia, "GET", "/media?cbz="+url.QueryEscape(cbzPath)+"&page="+entry.name)
+					if w.Code != http.StatusOK {
+						b.Fatalf("%s: status %d", entry.name, w.Code)
+					}
+					// A reader looks at the page long enough for the next one to be read ahead
+					if prefetch && k+1 < len(entries) {
+						b.StopTimer()
+						for !cachedPages.Has(pageKey(cbzPath, entries[k+1].name, info.ModTime())) {
+							time.Sleep(100 * time.Microsecond)
+						}
+						b.StartTimer()
+					}
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(entries)), "ns/page")
+		})
+	}
+}
+
+// Series folders need no detection: every folder of images is an item, in the
+// category of the folder above it
+func TestSeriesFolders(t *testing.T) {
+	lib := setupLibrary(t)
+	for _, volume := range []string{"Vol 1", "Vol 2"} {
+		dir := filepath.Join(lib, "Berserk", volume)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"001.jpg", "002.jpg"} {
+			if err := os.WriteFile(filepath.Join(dir, name), jpegPage(t, 300, 450), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	buildCache(context.Background())
+
+	rows, err := db.Query("SELECT category, title, page_count FROM library ORDER BY title")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var category, title string
+		var pages int
+		rows.Scan(&category, &title, &pages)
+		got = append(got, fmt.Sprintf("%s/%s (%d pages)", category, title, pages))
+	}
+	if want := []string{"Berserk/Vol 1 (2 pages)", "Berserk/Vol 2 (2 pages)"}; !slices.Equal(got, want) {
+		t.Errorf("items %q, want %q", got, want)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	lib := setupLibrary(t)
+	page := jpegPage(t, 300, 450)
+	for _, dir := range []string{"Comics", "Pulp", filepath.Join("Berserk", "Vol 1")} {
+		if err := os.MkdirAll(filepath.Join(lib, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCBZ(t, filepath.Join(lib, "Comics", "Amazing Stories 001 (2021).cbz"), archiveEntry{"01.jpg", page})
+	writeCBZ(t, filepath.Join(lib, "Pulp", "Amazing_Stories_002.cbz"), archiveEntry{"01.jpg", page})
+	writeCBZ(t, filepath.Join(lib, "saga-012.cbz"), archiveEntry{"ComicInfo.xml", []byte("<ComicInfo><Series>Saga</Series><Number>12</Number></ComicInfo>")}, archiveEntry{"01.jpg", page})
+	writeCBZ(t, filepath.Join(lib, "Oneshot.cbz"), archiveEntry{"01.jpg", page})
+	if err := os.WriteFile(filepath.Join(lib, "Berserk", "Vol 1", "01.jpg"), page, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	buildCache(context.Background())
+
+	keys := func() map[string]string {
+		t.Helper()
+		rows, err := db.Query("SELECT title, series_key FROM library")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		got := make(map[string]string)
+		for rows.Next() {
+			var title string
+			var key sql.NullString
+			rows.Scan(&title, &key)
+			got[title] = key.String
+			if !key.Valid {
+				t.Errorf("%s: series_key is NULL", title)
+			}
+		}
+		return got
+	}
+	scanned := keys()
+	want := map[string]string{
+		"Amazing Stories 001 (2021)": "amazing stories",
+		"Amazing_Stories_002":        "amazing stories",
+		"saga-012":                   "saga",
+		"Oneshot":                    "",
+		"Vol 1":                      "berserk",
+	}
+	if !maps.Equal(scanned, want) {
+		t.Errorf("series keys %q, want %q", scanned, want)
+	}
+
+	shelves := func(target string) []string {
+		t.Helper()
+		w := serve(handleSeries, "GET", target)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", target, w.Code)
+		}
+		var series []Series
+		if err := json.Unmarshal(w.Body.Bytes(), &series); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range series {
+			titles := make([]string, len(s.Issues))
+			for i, item := range s.Issues {
+				titles[i] = item.Title
+			}
+			got = append(got, fmt.Sprintf("%s (%d): %s", s.Name, s.Count, strings.Join(titles, ", ")))
+		}
+		return got
+	}
+	if got, want := shelves("/api/series"), []string{
+		"Amazing Stories (2): Amazing Stories 001 (2021), Amazing_Stories_002",
+		"Berserk (1): Vol 1",
+		"Saga (1): saga-012",
+	}; !slices.Equal(got, want) {
+		t.Errorf("series %q, want %q", got, want)
+	}
+	if got, want := shelves("/api/series?name=AMAZING_stories"), []string{"Amazing Stories (2): Amazing Stories 001 (2021), Amazing_Stories_002"}; !slices.Equal(got, want) {
+		t.Errorf("named series %q, want %q", got, want)
+	}
+	if w := serve(handleSeries, "GET", "/api/series?name=Oneshot"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown series: status %d, want 404", w.Code)
+	}
+
+	// Renaming an item moves it to the series of its new title, and rescans keep it there
+	id := itemID(t, "Oneshot")
+	if w := serveBody(handleItem, "PATCH", "/api/item?id="+strconv.Itoa(id), `{"title": "Saga 13"}`); w.Code != http.StatusOK {
+		t.Fatalf("rename: status %d", w.Code)
+	}
+	rescanItem(filepath.Join(lib, "Oneshot.cbz"))
+	if got, want := shelves("/api/series?name=saga"), []string{"Saga (2): saga-012, Saga 13"}; !slices.Equal(got, want) {
+		t.Errorf("after rename %q, want %q", got, want)
+	}
+
+	// Rows from before the column existed get the keys a scan would have stored
+	if _, err := db.Exec("UPDATE library SET series_key=NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fillSeriesKeys(db); err != nil {
+		t.Fatal(err)
+	}
+	want["Saga 13"] = "saga"
+	delete(want, "Oneshot")
+	if got := keys(); !maps.Equal(got, want) {
+		t.Errorf("filled series keys %q, want %q", got, want)
+	}
+}
+
+func TestPageContentLength(t *testing.T) {
+	lib := setupLibrary(t)
+	page := jpegPage(t, 640, 960)
+	writeCBZ(t, filepath.Join(lib, "Zip.cbz"), archiveEntry{"01.jpg", page})
+	writeCBR(t, filepath.Join(lib, "Rar.cbr"), archiveEntry{"01.jpg", page})
+	writeCB7(t, filepath.Join(lib, "Seven.cb7"), archiveEntry{"01.jpg", page})
+
+	for _, kind := range []string{"cbz=Zip.cbz", "cbr=Rar.cbr", "cb7=Seven.cb7"} {
+		param, file, _ := strings.Cut(kind, "=")
+		w := serve(handleMedia, "GET", "/media?"+param+"="+url.QueryEscape(filepath.Join(lib, file))+"&page=01.jpg")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", file, w.Code)
+		}
+		if got := w.Header().Get("Content-Length"); got != strconv.Itoa(w.Body.Len()) || w.Body.Len() != len(page) {
+			t.Errorf("%s: Content-Length %q for a %d byte body, want %d", file, got, w.Body.Len(), len(page))
+		}
+	}
+}
+
+// A database from before schema_version, with some later columns already added
+// by hand, upgrades without duplicate column errors and can be listed again
+func TestMigrateUnversionedDB(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cache.db")
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(`CREATE TABLE library (
+		id INTEGER PRIMARY KEY AUTOINCREMENT, category TEXT, title TEXT, path TEXT UNIQUE,
+		cover TEXT, coverData TEXT, lastModified TEXT, series TEXT DEFAULT '', page_count INTEGER DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP, updated_at DATETIME DEFAULT CURRENT_TIMESTAMP);
+	INSERT INTO library (category, title, path, cover, lastModified, series) VALUES ('Comics', 'Saga 001', '/library/Saga 001.cbz', '(cbz internal)', '2024-01-01T00:00:00Z', 'Saga')`)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setupLibrary(t, func(cfg *Config) { cfg.CacheDB = path })
+	var version int
+	if err := db.QueryRow("SELECT version FROM schema_version").Scan(&version); err != nil || version != len(migrations) {
+		t.Fatalf("version %d (%v), want %d", version, err, len(migrations))
+	}
+
+	items, err := queryLibraryItems("SELECT " + libraryColumns + " FROM " + libraryFrom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Series != "Saga" || items[0].Status != "ok" {
+		t.Errorf("items after the upgrade: %+v", items)
+	}
+}
+
+func TestImport(t *testing.T) {
+	lib := setupLibrary(t)
+	saga := filepath.Join(lib, "Saga 001.cbz")
+	catalog := fmt.Sprintf(`[{"path": %q, "category": "Comics", "title": "Saga 001", "series": "Saga", "pageCount": 24},
+		{"path": "/elsewhere/Other.cbz", "title": "Other"}]`, saga)
+
+	// Scans go on while the body uploads, and the upload may outlast the read timeout
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(handleImport))
+	srv.Config.ReadTimeout = 200 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	body, upload := io.Pipe()
+	go func() {
+		upload.Write([]byte(catalog[:20]))
+		time.Sleep(400 * time.Millisecond)
+		if !scanMu.TryLock() {
+			t.Error("scanMu held while the body uploads")
+		} else {
+			scanMu.Unlock()
+		}
+		upload.Write([]byte(catalog[20:]))
+		upload.Close()
+	}()
+	resp, err := http.Post(srv.URL+"/api/import", "application/json", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result ImportResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("status %d: %v", resp.StatusCode, err)
+	}
+	if result.Imported != 1 || result.Skipped != 1 {
+		t.Errorf("result %+v, want 1 imported and 1 skipped", result)
+	}
+	var series string
+	var pages int
+	if err := db.QueryRow("SELECT series, page_count FROM library WHERE path=?", saga).Scan(&series, &pages); err != nil || series != "Saga" || pages != 24 {
+		t.Errorf("imported row: series %q, %d pages (%v)", series, pages, err)
+	}
+
+	for _, body := range []string{`{"path": "x"}`, `[{"path": `, `[1]`} {
+		if w := serveBody(handleImport, "POST", "/api/import", body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLogs(t, "debug")
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		path       string
+		user, pass string
+		want       int
+	}{
+		{"disabled", false, "/api/library", "", "", http.StatusOK},
+		{"no credentials", true, "/api/library", "", "", http.StatusUnauthorized},
+		{"wrong password", true, "/api/library", "reader", "guess", http.StatusUnauthorized},
+		{"unknown user", true, "/api/library", "intruder", "s3cret pass", http.StatusUnauthorized},
+		{"valid", true, "/api/library", "reader", "s3cret pass", http.StatusOK},
+		{"valid again from the cache", true, "/api/library", "reader", "s3cret pass", http.StatusOK},
+		{"media", true, "/media", "", "", http.StatusUnauthorized},
+		{"static files", true, "/index.html", "", "", http.StatusUnauthorized},
+		{"health", true, "/api/health", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configManager = NewConfigManager(Config{Auth: AuthConfig{Enabled: tt.enabled, Users: map[string]string{"reader": string(hash)}}})
+			r := httptest.NewRequest("GET", tt.path, nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := httptest.NewRecorder()
+			authMiddleware(ok).ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic ") {
+				t.Errorf("WWW-Authenticate %q", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+	if strings.Contains(logs.String(), "s3cret") {
+		t.Error("a password was logged")
+	}
+}
+
+func TestFavorites(t *testing.T) {
+	setupLibrary(t)
+	ids := map[string]int{}
+	for _, title := range []string{"Alpha", "Beta", "Gamma"} {
+		ids[title] = addItem(t, "Comics", title)
+	}
+	star := func(method, title string) int {
+		return serve(handleFavorite, method, fmt.Sprintf("/api/favorite?id=%d", ids[title])).Code
+	}
+
+	for _, title := range []string{"Gamma", "Alpha", "Alpha"} {
+		if code := star("POST", title); code != http.StatusNoContent {
+			t.Errorf("starring %s: status %d, want 204", title, code)
+		}
+	}
+	// Most recently starred first; stars within one second go by title, with the same result
+	if got, want := titles(t, serve(handleFavorites, "GET", "/api/favorites")), []string{"Alpha", "Gamma"}; !slices.Equal(got, want) {
+		t.Errorf("favorites %v, want %v", got, want)
+	}
+
+	var items []LibraryItem
+	json.Unmarshal(serve(handleLibrary, "GET", "/api/library").Body.Bytes(), &items)
+	for _, item := range items {
+		if want := item.Title != "Beta"; item.Favorite != want {
+			t.Errorf("library lists %s with favorite %v", item.Title, item.Favorite)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := star("DELETE", "Alpha"); code != http.StatusNoContent {
+			t.Errorf("unstarring: status %d, want 204", code)
+		}
+	}
+	if got, want := titles(t, serve(handleFavorites, "GET", "/api/favorites")), []string{"Gamma"}; !slices.Equal(got, want) {
+		t.Errorf("favorites after unstarring %v, want %v", got, want)
+	}
+
+	for _, tt := range []struct {
+		method, target string
+		want           int
+	}{
+		{"POST", "/api/favorite?id=999", http.StatusNotFound},
+		{"DELETE", "/api/favorite?id=999", http.StatusNotFound},
+		{"POST", "/api/favorite", http.StatusBadRequest},
+		{"GET", fmt.Sprintf("/api/favorite?id=%d", ids["Beta"]), http.StatusMethodNotAllowed},
+	} {
+		if w := serve(handleFavorite, tt.method, tt.target); w.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminVacuum(t *testing.T) {
+	mem, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection would get its own in-memory database
+	mem.SetMaxOpenConns(1)
+	t.Cleanup(func() { mem.Close() })
+	if err := MigrateDB(mem, migrations); err != nil {
+		t.Fatal(err)
+	}
+	db = mem
+
+	filler := strings.Repeat("x", 4096)
+	for i := 0; i < 200; i++ {
+		if _, err := db.Exec("INSERT INTO library (title, path, summary) VALUES (?, ?, ?)", "Item", fmt.Sprintf("/library/%d.cbz", i), filler); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("DELETE FROM library"); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := requireAdminToken(handleVacuum)
+	tests := []struct {
+		name, token, header string
+		want                int
+	}{
+		{"disabled", "", "Bearer anything", http.StatusNotImplemented},
+		{"no token", "letmein", "", http.StatusUnauthorized},
+		{"wrong token", "letmein", "Bearer letmeout", http.StatusUnauthorized},
+		{"basic credentials", "letmein", "Basic bGV0bWVpbg==", http.StatusUnauthorized},
+		{"valid", "letmein", "Bearer letmein", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configManager = NewConfigManager(Config{AdminToken: tt.token})
+			w := serve(handler, "POST", "/api/admin/vacuum", "Authorization", tt.header)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d", w.Code, tt.want)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var result VacuumResult
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(result.Integrity, []string{"ok"}) || !result.Vacuumed || result.BytesFreed < 200*4096 {
+				t.Errorf("result %+v, want an ok check and the deleted rows freed", result)
+			}
+		})
+	}
+
+	if w := serve(handler, "GET", "/api/admin/vacuum", "Authorization", "Bearer letmein"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: status %d, want 405", w.Code)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	lib := setupLibrary(t)
+	page := jpegPage(t, 300, 450)
+	writeCBR(t, filepath.Join(lib, "Rar.cbr"), archiveEntry{"01.jpg", page})
+	writeCB7(t, filepath.Join(lib, "Seven.cb7"), archiveEntry{"01.jpg", page})
+	writeCBZ(t, filepath.Join(lib, "Zip.cbz"), archiveEntry{"01.jpg", page})
+	folder := filepath.Join(lib, "Folder")
+	os.Mkdir(folder, 0o755)
+	for _, name := range []string{"01.jpg", "02.jpg"} {
+		if err := os.WriteFile(filepath.Join(folder, name), page, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buildCache(context.Background())
+
+	for _, tt := range []struct{ title, file, contentType string }{
+		{"Rar", "Rar.cbr", "application/vnd.comicbook-rar"},
+		{"Seven", "Seven.cb7", "application/x-cb7"},
+		{"Zip", "Zip.cbz", "application/vnd.comicbook+zip"},
+	} {
+		target := fmt.Sprintf("/api/download?id=%d", itemID(t, tt.title))
+		original, err := os.ReadFile(filepath.Join(lib, tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := serve(handleDownload, "GET", target)
+		if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), original) {
+			t.Errorf("%s: status %d, body isn't the file", tt.file, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("%s: Content-Type %q, want %q", tt.file, got, tt.contentType)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != "attachment; filename="+tt.file {
+			t.Errorf("%s: Content-Disposition %q", tt.file, got)
+		}
+
+		// An interrupted download resumes
+		w = serve(handleDownload, "GET", target, "Range", "bytes=100-")
+		if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), original[100:]) {
+			t.Errorf("%s resumed: status %d with %d bytes, want 206 with %d", tt.file, w.Code, w.Body.Len(), len(original)-100)
+		}
+	}
+
+	w := serve(handleDownload, "GET", fmt.Sprintf("/api/download?id=%d", itemID(t, "Folder")))
+	if got := w.Header().Get("Content-Disposition"); w.Code != http.StatusOK || got != "attachment; filename=Folder.cbz" {
+		t.Fatalf("folder: status %d, Content-Disposition %q", w.Code, got)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if want := []string{"01.jpg", "02.jpg"}; !slices.Equal(names, want) {
+		t.Errorf("folder zip holds %v, want %v", names, want)
+	}
+
+	if w := serve(handleDownload, "GET", "/api/download?id=999"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown id: status %d, want 404", w.Code)
+	}
+	if w := serve(handleDownload, "GET", "/api/download"); w.Code != http.StatusBadRequest {
+		t.Errorf("missing id: status %d, want 400", w.Code)
+	}
+}
+
+func TestMediaRange(t *testing.T) {
+	lib := setupLibrary(t)
+	page := jpegPage(t, 640, 960)
+	writeCBZ(t, filepath.Join(lib, "Zip.cbz"), archiveEntry{"01.jpg", page})
+	writeCBR(t, filepath.Join(lib, "Rar.cbr"), archiveEntry{"01.jpg", page})
+
+	for _, target := range []string{
+		"/media?cbz=" + url.QueryEscape(filepath.Join(lib, "Zip.cbz")) + "&page=01.jpg",
+		"/media?cbr=" + url.QueryEscape(filepath.Join(lib, "Rar.cbr")) + "&page=01.jpg",
+	} {
+		w := serve(handleMedia, "GET", target, "Range", "bytes=0-99")
+		if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), page[:100]) {
+			t.Errorf("%s: status %d with %d bytes, want 206 with the first 100", target, w.Code, w.Body.Len())
+		}
+		if got, want := w.Header().Get("Content-Range"), fmt.Sprintf("bytes 0-99/%d", len(page)); got != want {
+			t.Errorf("%s: Content-Range %q, want %q", target, got, want)
+		}
+
+		w = serve(handleMedia, "GET", target, "Range", fmt.Sprintf("bytes=%d-", len(page)-10))
+		if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), page[len(page)-10:]) {
+			t.Errorf("%s: last 10 bytes: status %d with %d bytes", target, w.Code, w.Body.Len())
+		}
+
+		if w := serve(handleMedia, "GET", target, "Range", fmt.Sprintf("bytes=%d-", len(page))); w.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("%s: range past the end: status %d, want 416", target, w.Code)
+		}
+	}
+}
+
+func TestThumbnailSize(t *testing.T) {
+	lib := setupLibrary(t)
+	writeCBZ(t, filepath.Join(lib, "Cover.cbz"), archiveEntry{"01.jpg", jpegPage(t, 600, 900)})
+	buildCache(context.Background())
+	id := itemID(t, "Cover")
+
+	tests := []struct {
+		size          string
+		width, height int
+	}{
+		{"", 266, 400},
+		{"400", 266, 400},
+		{"800", 533, 800},
+		{"500", 400, 600},
+		{"700", 533, 800},
+		{"10", 33, 50},
+		{"50", 33, 50},
+		{"5000", 800, 1200},
+	}
+	for _, tt := range tests {
+		w := serve(handleThumbnail, "GET", fmt.Sprintf("/api/thumbnail?id=%d&size=%s", id, tt.size))
+		if w.Code != http.StatusOK {
+			t.Fatalf("size=%s: status %d: %s", tt.size, w.Code, w.Body)
+		}
+		cfg, _, err := image.DecodeConfig(w.Body)
+		if err != nil {
+			t.Fatalf("size=%s: %v", tt.size, err)
+		}
+		if cfg.Width != tt.width || cfg.Height != tt.height {
+			t.Errorf("size=%s: %dx%d, want %dx%d", tt.size, cfg.Width, cfg.Height, tt.width, tt.height)
+		}
+	}
+
+	// Sizes are rounded to thumbnailSizes, so only those are written, and the
+	// default size and its explicit value share a file
+	var base string
+	if err := db.QueryRow("SELECT thumbnail FROM library WHERE id=?", id).Scan(&base); err != nil {
+		t.Fatal(err)
+	}
+	dir := configManager.Get().ThumbnailDir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, e := range entries {
+		files = append(files, e.Name())
+	}
+	want := []string{base}
+	for _, size := range []int{50, 600, 800, 1200} {
+		want = append(want, sizedThumbnailName(base, size))
+	}
+	slices.Sort(files)
+	slices.Sort(want)
+	if !slices.Equal(files, want) {
+		t.Errorf("thumbnail files %q, want %q", files, want)
+	}
+
+	// A cached size is served from memory, even when its file changes
+	sized := sizedThumbnailName(base, 800)
+	cached, ok := thumbnailBytes.Get(sized)
+	if !ok {
+		t.Fatal("size=800 isn't cached")
+	}
+	if err := os.WriteFile(filepath.Join(dir, sized), []byte("gone"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(handleThumbnail, "GET", fmt.Sprintf("/api/thumbnail?id=%d&size=800", id))
+	if !bytes.Equal(w.Body.Bytes(), cached) {
+		t.Error("cached size=800 was read again")
+	}
+	if w := serve(handleThumbnail, "GET", fmt.Sprintf("/api/thumbnail?id=%d&size=800", id), "If-None-Match", w.Header().Get("ETag")); w.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match: status %d, want 304", w.Code)
+	}
+
+	for _, tt := range []struct {
+		target string
+		want   int
+	}{
+		{fmt.Sprintf("/api/thumbnail?id=%d&size=abc", id), http.StatusBadRequest},
+		{fmt.Sprintf("/api/thumbnail?id=%d&size=0", id), http.StatusBadRequest},
+		{"/api/thumbnail", http.StatusBadRequest},
+		{"/api/thumbnail?id=999", http.StatusNotFound},
+	} {
+		if w := serve(handleThumbnail, "GET", tt.target); w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+
+	// Pruning drops variants in sizes no longer generated, and all those of removed items
+	stale := sizedThumbnailName(base, 437)
+	if err := os.WriteFile(filepath.Join(dir, stale), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{stale, sized} {
+		if err := os.Chtimes(filepath.Join(dir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pruneThumbnails()
+	if _, err := os.Stat(filepath.Join(dir, stale)); !os.IsNotExist(err) {
+		t.Errorf("size 437 survived pruning: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, sized)); err != nil {
+		t.Errorf("size 800 was pruned: %v", err)
+	}
+	if _, err := db.Exec("DELETE FROM library WHERE id=?", id); err != nil {
+		t.Fatal(err)
+	}
+	pruneThumbnails()
+	if _, err := os.Stat(filepath.Join(dir, sized)); !os.IsNotExist(err) {
+		t.Errorf("size 800 of a removed item survived pruning: %v", err)
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	buf := captureLogs(t, "info")
+	logger.SetFormat("json")
+	logger.Debug("hidden below the level")
+	logger.Info("Scanned %d items in %s", 42, "Comics")
+	logger.With("request_id", "abc123").Error(`quote " and newline
+inside`)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d lines, want 2: %q", len(lines), buf.String())
+	}
+	var entries []map[string]interface{}
+	for _, line := range lines {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("line %q isn't JSON: %v", line, err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(entry["ts"])); err != nil {
+			t.Errorf("ts: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	if entries[0]["level"] != "info" || entries[0]["msg"] != "Scanned 42 items in Comics" || entries[0]["fields"] != nil {
+		t.Errorf("first entry %v", entries[0])
+	}
+	fields, _ := entries[1]["fields"].(map[string]interface{})
+	if entries[1]["level"] != "error" || entries[1]["msg"] != "quote \" and newline\ninside" || fields["request_id"] != "abc123" {
+		t.Errorf("second entry %v", entries[1])
+	}
+
+	// Switching back gives the readable lines again
+	buf.Reset()
+	logger.SetFormat("text")
+	logger.With("request_id", "abc123").Warn("plain")
+	if line := buf.String(); !strings.Contains(line, "[WARN] plain request_id=abc123") || strings.HasPrefix(line, "{") {
+		t.Errorf("text line %q", line)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	setupLibrary(t)
+	logs := captureLogs(t, "error")
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.WithContext(r.Context()).Error("failed %s", r.URL.Path)
+	})).ServeHTTP
+
+	first := serve(handler, "GET", "/api/library").Header().Get("X-Request-ID")
+	second := serve(handler, "GET", "/api/library").Header().Get("X-Request-ID")
+	if len(first) != 16 || !validRequestID(first) {
+		t.Errorf("generated ID %q", first)
+	}
+	if first == second {
+		t.Errorf("two requests share the ID %q", first)
+	}
+	if !strings.Contains(logs.String(), "failed /api/library request_id="+first+"\n") {
+		t.Errorf("logs %q don't carry the ID %q", logs.String(), first)
+	}
+
+	// IDs from clients and proxies are kept, unless they would break up log lines
+	for id, kept := range map[string]bool{
+		"proxy-42.abc":           true,
+		strings.Repeat("x", 128): true,
+		strings.Repeat("x", 129): false,
+		"two words":              false,
+		"new\nline":              false,
+		"caf\u00e9":              false,
+	} {
+		got := serve(handler, "GET", "/api/library", "X-Request-ID", id).Header().Get("X-Request-ID")
+		if kept && got != id {
+			t.Errorf("ID %q replaced with %q", id, got)
+		}
+		if !kept && (got == id || !validRequestID(got)) {
+			t.Errorf("ID %q answered with %q, want a new one", id, got)
+		}
+	}
+
+	// The ID is set for every route, including errors and static files
+	router := requestIDMiddleware(newRouter()).ServeHTTP
+	for _, target := range []string{"/", "/api/item?id=999", "/nope"} {
+		if w := serve(router, "GET", target, "X-Request-ID", "trace-1"); w.Header().Get("X-Request-ID") != "trace-1" {
+			t.Errorf("%s: X-Request-ID %q", target, w.Header().Get("X-Request-ID"))
+		}
+	}
+}
+
+// writeSelfSigned writes a self-signed certificate for localhost and 127.0.0.1
+// and its key to dir, returning their paths and the certificate
+func writeSelfSigned(t testing.TB, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestTLS(t *testing.T) {
+	lib := setupLibrary(t)
+	certFile, keyFile, cert := writeSelfSigned(t, t.TempDir())
+
+	for name, edit := range map[string]func(*Config){
+		"cert without key":     func(c *Config) { c.TLSKey = "" },
+		"missing key file":     func(c *Config) { c.TLSKey = filepath.Join(lib, "missing.pem") },
+		"unknown version":      func(c *Config) { c.TLSMinVersion = "1.1" },
+		"redirect on own port": func(c *Config) { c.HTTPSRedirectPort = c.Port },
+	} {
+		cfg := Config{LibraryPaths: []string{lib}, Port: 8443, TLSCert: certFile, TLSKey: keyFile}
+		edit(&cfg)
+		if err := validateConfig(&cfg); err == nil {
+			t.Errorf("%s: config accepted", name)
+		}
+	}
+
+	cfg := Config{LibraryPaths: []string{lib}, Port: 8443, TLSCert: certFile, TLSKey: keyFile, TLSMinVersion: "1.3"}
+	if err := validateConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := serverURL(&cfg); got != "https://localhost:8443" {
+		t.Errorf("server URL %q", got)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(&cfg)
+	go server.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+	t.Cleanup(func() { server.Close() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	get := func(tlsConfig *tls.Config) (*http.Response, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: 5 * time.Second}
+		defer client.CloseIdleConnections()
+		return client.Get("https://" + ln.Addr().String() + "/api/health")
+	}
+
+	resp, err := get(&tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil || resp.TLS.Version != tls.VersionTLS13 {
+		t.Errorf("status %d over %v", resp.StatusCode, resp.TLS)
+	}
+
+	// Clients that don't trust the certificate or only speak TLS 1.2 are turned away
+	if resp, err := get(&tls.Config{}); err == nil {
+		resp.Body.Close()
+		t.Error("untrusted self-signed certificate accepted")
+	}
+	if resp, err := get(&tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}); err == nil {
+		resp.Body.Close()
+		t.Error("TLS 1.2 client accepted with TLSMinVersion 1.3")
+	}
+
+	// Plain HTTP is redirected to the same host and path on the HTTPS port
+	for target, want := range map[string]string{
+		"http://example.com/api/library?sort=title": "https://example.com:8443/api/library?sort=title",
+		"http://[::1]:8080/":                        "https://[::1]:8443/",
+	} {
+		w := serve(httpsRedirect(cfg.Port).ServeHTTP, "GET", target)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != want {
+			t.Errorf("%s: %d to %q, want %q", target, w.Code, w.Header().Get("Location"), want)
+		}
+	}
+	if w := serve(httpsRedirect(443).ServeHTTP, "GET", "http://example.com:80/opds"); w.Header().Get("Location") != "https://example.com/opds" {
+		t.Errorf("redirect to 443: %q", w.Header().Get("Location"))
+	}
+}
+
+func TestLibraryStats(t *testing.T) {
+	lib := setupLibrary(t)
+	page := jpegPage(t, 300, 450)
+	writeCBZ(t, filepath.Join(lib, "Zip.cbz"), archiveEntry{"01.jpg", page}, archiveEntry{"02.jpg", page})
+	writeCB7(t, filepath.Join(lib, "Seven.cb7"), archiveEntry{"01.jpg", page})
+	if err := os.WriteFile(filepath.Join(lib, "Broken.cbz"), []byte("not a zip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	folder := filepath.Join(lib, "Mags", "Folder")
+	if err := os.MkdirAll(folder, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"01.jpg", "02.jpg"} {
+		if err := os.WriteFile(filepath.Join(folder, name), page, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lastScan.Store(nil)
+	get := func() (LibraryStats, map[string]interface{}) {
+		t.Helper()
+		w := serve(handleLibraryStats, "GET", "/api/stats/library")
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+		var stats LibraryStats
+		var fields map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		json.Unmarshal(w.Body.Bytes(), &fields)
+		return stats, fields
+	}
+	if _, fields := get(); fields["lastScanDurationMs"] != nil || fields["lastScanFinishedAt"] != nil {
+		t.Errorf("last scan before any scan: %v, %v", fields["lastScanFinishedAt"], fields["lastScanDurationMs"])
+	}
+
+	buildCache(context.Background())
+	librarySize = diskSize{}
+	var size int64
+	for _, file := range []string{"Zip.cbz", "Seven.cb7", "Broken.cbz", "Mags/Folder/01.jpg", "Mags/Folder/02.jpg"} {
+		info, err := os.Stat(filepath.Join(lib, file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+
+	// Thumbnails are dropped when a cover page is chosen; the item still has a cover
+	if _, err := db.Exec("UPDATE library SET cover_page='02.jpg', thumbnail='' WHERE title='Zip'"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, fields := get()
+	for _, key := range []string{"totalItems", "totalCategories", "totalSizeBytes", "itemsWithCover", "itemsWithoutCover", "lastScanDurationMs"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("no %s in %v", key, fields)
+		}
+	}
+	if stats.TotalItems != 4 || stats.TotalCategories != 2 || stats.TotalPages != 5 {
+		t.Errorf("%d items in %d categories with %d pages, want 4 in 2 with 5", stats.TotalItems, stats.TotalCategories, stats.TotalPages)
+	}
+	if stats.ItemsWithCover != 3 || stats.ItemsWithoutCover != 1 {
+		t.Errorf("%d items with a cover, %d without, want 3 and 1", stats.ItemsWithCover, stats.ItemsWithoutCover)
+	}
+	if stats.TotalSizeBytes != size {
+		t.Errorf("total size %d, want %d", stats.TotalSizeBytes, size)
+	}
+	if stats.LastScanDurationMs == nil || *stats.LastScanDurationMs < 0 || stats.LastScanFinishedAt == nil {
+		t.Errorf("last scan %v, %v", stats.LastScanFinishedAt, stats.LastScanDurationMs)
+	}
+	if !maps.Equal(stats.Formats, map[string]int{"cbz": 2, "cb7": 1, "directory": 1}) {
+		t.Errorf("formats %v", stats.Formats)
+	}
+
+	// The size on disk is reused until it is a minute old
+	if err := os.Remove(filepath.Join(lib, "Seven.cb7")); err != nil {
+		t.Fatal(err)
+	}
+	if stats, _ := get(); stats.TotalSizeBytes != size {
+		t.Errorf("cached total size %d, want %d", stats.TotalSizeBytes, size)
+	}
+	librarySize.statted = time.Now().Add(-librarySizeTTL)
+	if stats, _ := get(); stats.TotalSizeBytes >= size {
+		t.Errorf("total size %d after the cache expired, want less than %d", stats.TotalSizeBytes, size)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	lib := setupLibrary(t, func(cfg *Config) {
+		cfg.RateLimitRPS = 0.5
+		cfg.RateLimitBurst = 2
+	})
+	mediaLimiter = &IPRateLimiter{}
+	t.Cleanup(func() { mediaLimiter = &IPRateLimiter{} })
+	writeCBZ(t, filepath.Join(lib, "Zip.cbz"), archiveEntry{"01.jpg", jpegPage(t, 300, 450)})
+	buildCache(context.Background())
+
+	router := newRouter()
+	get := func(ip, target string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", target, nil)
+		r.RemoteAddr = ip + ":40000"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+	media := "/media?cbz=" + url.QueryEscape(filepath.Join(lib, "Zip.cbz")) + "&page=01.jpg"
+	pse := "/opds/pse?id=" + strconv.Itoa(itemID(t, "Zip")) + "&page=0"
+
+	// /media and /opds/pse draw from the same bucket of each client
+	for i, target := range []string{media, pse} {
+		if w := get("192.0.2.1", target); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i+1, w.Code)
+		}
+	}
+	for _, target := range []string{media, pse} {
+		w := get("192.0.2.1", target)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s over the burst: status %d, want 429", target, w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != "2" {
+			t.Errorf("%s: Retry-After %q, want 2", target, got)
+		}
+	}
+
+	// Other clients and other routes aren't limited
+	if w := get("192.0.2.2", pse); w.Code != http.StatusOK {
+		t.Errorf("other client: status %d", w.Code)
+	}
+	if w := get("192.0.2.1", "/api/library"); w.Code != http.StatusOK {
+		t.Errorf("/api/library: status %d", w.Code)
+	}
+
+	// Turning the limit off lets the limited client through again
+	cfg := configManager.Get()
+	cfg.RateLimitRPS = 0
+	configManager = NewConfigManager(cfg)
+	if w := get("192.0.2.1", media); w.Code != http.StatusOK {
+		t.Errorf("without a limit: status %d", w.Code)
+	}
+}
+
+func TestCancelScan(t *testing.T) {
+	lib := setupLibrary(t)
+	page := jpegPage(t, 200, 300)
+	for i := 0; i < 100; i++ {
+		writeCBZ(t, filepath.Join(lib, fmt.Sprintf("Issue %03d.cbz", i)), archiveEntry{"01.jpg", page})
+	}
+	old := addItem(t, "Comics", "Old")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	progress := newProgressReporter()
+	go func() {
+		for progress.scanned.Load() < 10 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	buildCacheWithProgress(ctx, progress)
+
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM library WHERE id != ?", old).Scan(&n)
+	if n == 0 || n >= 100 {
+		t.Fatalf("%d of 100 items stored, want the scan cut short after some", n)
+	}
+	if progress.summary.New != n {
+		t.Errorf("summary counts %d new items, %d were stored", progress.summary.New, n)
+	}
+
+	// Every stored item is whole, with its page list and cover
+	var partial int
+	db.QueryRow(`SELECT COUNT(*) FROM library l LEFT JOIN pages p ON p.item_id = l.id
+		WHERE l.id != ? AND (l.page_count != 1 OR l.thumbnail = '' OR p.item_id IS NULL)`, old).Scan(&partial)
+	if partial != 0 {
+		t.Errorf("%d items stored without their pages or cover", partial)
+	}
+	// Unreached paths can't be told apart from deleted ones, so nothing is removed
+	db.QueryRow("SELECT COUNT(*) FROM library WHERE id=?", old).Scan(&n)
+	if n != 1 {
+		t.Error("a cancelled scan removed an entry")
+	}
+
+	buildCache(context.Background())
+	db.QueryRow("SELECT COUNT(*) FROM library").Scan(&n)
+	if n != 100 {
+		t.Errorf("%d items after a full scan, want 100", n)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	lib := setupLibrary(t)
+	for i := range 40 {
+		addItem(t, "Comics", fmt.Sprintf("Issue %02d", i))
+	}
+	if err := os.WriteFile(filepath.Join(lib, "loose.jpg"), jpegPage(t, 400, 400), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	router := newRouter().ServeHTTP
+
+	plain := serve(router, "GET", "/api/library")
+	zipped := serve(router, "GET", "/api/library", "Accept-Encoding", "gzip")
+	if plain.Code != http.StatusOK || zipped.Code != http.StatusOK {
+		t.Fatalf("status = %d, %d", plain.Code, zipped.Code)
+	}
+	if ce := plain.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("without Accept-Encoding, Content-Encoding = %q", ce)
+	}
+	if ce := zipped.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", ce)
+	}
+	if zipped.Body.Len() >= plain.Body.Len() {
+		t.Errorf("compressed body is %d bytes, uncompressed %d", zipped.Body.Len(), plain.Body.Len())
+	}
+	zr, err := gzip.NewReader(zipped.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(body) {
+		t.Errorf("decompressed body is not valid JSON: %.100s", body)
+	}
+	if !bytes.Equal(body, plain.Body.Bytes()) {
+		t.Error("decompressed body differs from the uncompressed response")
+	}
+
+	if w := serve(router, "GET", "/api/health", "Accept-Encoding", "gzip"); w.Header().Get("Content-Encoding") != "" {
+		t.Error("responses under 1 KB should not be compressed")
+	}
+	// promhttp compresses on its own; gzipMiddleware must not wrap it a second time
+	w := serve(router, "GET", "/metrics", "Accept-Encoding", "gzip")
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(body, []byte("# HELP")) {
+			t.Errorf("/metrics decompresses to %.40q, want the text exposition format", body)
+		}
+	}
+	for _, target := range []string{"/", "/media?path=" + url.QueryEscape(filepath.Join(lib, "loose.jpg"))} {
+		w := serve(router, "GET", target, "Accept-Encoding", "gzip")
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d", target, w.Code)
+			continue
+		}
+		if w.Body.Len() < gzipMinSize {
+			t.Errorf("%s: body is only %d bytes", target, w.Body.Len())
+		}
+		if ce := w.Header().Get("Content-Encoding"); ce != "" {
+			t.Errorf("%s: Content-Encoding = %q, want none", target, ce)
+		}
+	}
+}
+
+func TestCoverOverride(t *testing.T) {
+	lib := setupLibrary(t)
+	page := jpegPage(t, 600, 900)
+	writeCBZ(t, filepath.Join(lib, "Zip.cbz"), archiveEntry{"01.jpg", page}, archiveEntry{"02.jpg", page}, archiveEntry{"03.jpg", page})
+	folder := filepath.Join(lib, "Folder")
+	if err := os.Mkdir(folder, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"01.jpg", "02.jpg"} {
+		if err := os.WriteFile(filepath.Join(folder, name), page, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buildCache(context.Background())
+	zip, dir := itemID(t, "Zip"), itemID(t, "Folder")
+
+	// POST /api/cover is PUT /api/item/cover with the page given by name
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+		want    string
+	}{
+		{handleItemCover, "PUT", fmt.Sprintf("/api/item/cover?id=%d&page=2", zip), "02.jpg"},
+		{handleItemCover, "PUT", fmt.Sprintf("/api/item/cover?id=%d&name=03.jpg", zip), "03.jpg"},
+		{handleCover, "POST", fmt.Sprintf("/api/cover?id=%d&page=01.jpg", zip), "01.jpg"},
+		{handleItemCover, "DELETE", fmt.Sprintf("/api/item/cover?id=%d", zip), ""},
+		{handleItemCover, "PUT", fmt.Sprintf("/api/item/cover?id=%d&page=2", dir), "02.jpg"},
+		{handleCover, "POST", fmt.Sprintf("/api/cover?id=%d&page=%s", dir, url.QueryEscape(filepath.Join(folder, "01.jpg"))), "01.jpg"},
+	}
+	for _, tt := range tests {
+		w := serve(tt.handler, tt.method, tt.target)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: status %d: %s", tt.method, tt.target, w.Code, w.Body)
+		}
+		var item LibraryItem
+		if err := json.Unmarshal(w.Body.Bytes(), &item); err != nil {
+			t.Fatal(err)
+		}
+		if item.CoverPage != tt.want || item.CoverURL == "" {
+			t.Errorf("%s %s: cover page %q, URL %q, want %q", tt.method, tt.target, item.CoverPage, item.CoverURL, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+		want    int
+	}{
+		{handleItemCover, "PUT", fmt.Sprintf("/api/item/cover?id=%d&page=4", zip), http.StatusBadRequest},
+		{handleItemCover, "PUT", fmt.Sprintf("/api/item/cover?id=%d", zip), http.StatusBadRequest},
+		{handleItemCover, "PUT", fmt.Sprintf("/api/item/cover?id=%d&name=04.jpg", zip), http.StatusNotFound},
+		{handleItemCover, "PUT", "/api/item/cover?id=999&page=1", http.StatusNotFound},
+		{handleItemCover, "POST", fmt.Sprintf("/api/item/cover?id=%d&page=1", zip), http.StatusMethodNotAllowed},
+		{handleCover, "POST", fmt.Sprintf("/api/cover?id=%d", zip), http.StatusBadRequest},
+		{handleCover, "POST", fmt.Sprintf("/api/cover?id=%d&page=04.jpg", zip), http.StatusNotFound},
+		{handleCover, "POST", "/api/cover?id=999&page=01.jpg", http.StatusNotFound},
+		{handleCover, "GET", fmt.Sprintf("/api/cover?id=%d", zip), http.StatusOK},
+	} {
+		if w := serve(tt.handler, tt.method, tt.target); w.Code != tt.want {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, w.Code, tt.want)
+		}
+	}
+}
@@ -4,7 +4,7 @@
 
 let
   project-cleanup = pkgs.writeShellScriptBin "project-cleanup" ''
-    rm -fr magz magz_cache.db *.exe *.out *.log magz.config.json .DS_Store *.tmp *.bak pkg/ .vscode/ .idea/
+    rm -fr magz magz_cache.db magz_thumbs/ *.exe *.out *.log magz.config.json .DS_Store *.tmp *.bak pkg/ .vscode/ .idea/
   '';
 
   first-time-running = pkgs.writeShellScriptBin "first-time-running" ''
@@ -53,6 +53,8 @@ pkgs.mkShell {
     nixfmt-rfc-style
     # Source packages
     go_latest
+    # PDF page rendering
+    poppler_utils
   ]);
 
   shellHook = ''